@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var acknowledgedMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "number_of_acknowledged_messages",
+	Help: "The total number of messages removed from storage after the receiver acknowledged them",
+})
+
+// ackPendingWindow is how long after its creation an acknowledged message may still be on its way to the storage,
+// e.g. with the fail_open storage policy the receiver may get and acknowledge a message before it's stored.
+const ackPendingWindow = time.Minute
+
+// AckHandler removes a message processed by the receiver from the storage, so it's not replayed
+// on the next connection and doesn't wait for its ttl to expire.
+// It's only served with ACK_ENABLE: the receiver signs with an ed25519 client id key,
+// while TON Connect client ids are x25519 session keys that can't sign.
+func (h *handler) AckHandler(c echo.Context) error {
+	log := log.WithField("prefix", "AckHandler")
+	params := c.QueryParams()
+	clientId := params.Get("client_id")
+	if clientId == "" {
+		badRequestMetric.Inc()
+		errorMsg := "param \"client_id\" not present"
+		log.Error(errorMsg)
+		return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
+	}
+	eventId, _, err := parseEventId(params.Get("event_id"))
+	if err != nil {
+		badRequestMetric.Inc()
+		errorMsg := "param \"event_id\" should be int"
+		log.Error(errorMsg)
+		return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
+	}
+	if eventId > h.newestEventId(time.Now()) {
+		badRequestMetric.Inc()
+		errorMsg := "param \"event_id\" is newer than any message"
+		log.Error(errorMsg)
+		return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
+	}
+	// only the receiver may remove its messages, it proves that it owns client_id like a sender does
+	signature := c.Request().Header.Get("X-Signature")
+	if signature == "" {
+		badRequestMetric.Inc()
+		errorMsg := "header \"X-Signature\" not present"
+		log.Error(errorMsg)
+		return c.JSON(HttpResError(errorMsg, http.StatusUnauthorized))
+	}
+	if err := verifyAckSignature(clientId, params.Get("event_id"), signature); err != nil {
+		badRequestMetric.Inc()
+		log.Error(err)
+		return c.JSON(HttpResError(err.Error(), http.StatusUnauthorized))
+	}
+	remover, ok := h.storage.(messageRemover)
+	if !ok {
+		return c.JSON(HttpResError("storage doesn't support acknowledgements", http.StatusNotImplemented))
+	}
+	if err := remover.Remove(c.Request().Context(), clientId, eventId); err != nil {
+		log.Errorf("remove %v: %v", eventId, err)
+		h.health.Failure("storage", err)
+		return c.JSON(HttpResError("failed to remove the message", http.StatusInternalServerError))
+	}
+	if h.recent != nil {
+		h.recent.Remove(clientId, eventId)
+	}
+	if time.Since(time.UnixMicro(eventId)) < ackPendingWindow {
+		// the message may not be stored yet, persist removes it once it is
+		h.acked.Add(clientId, eventId)
+	}
+	h.digests.Acknowledged(clientId, eventId)
+	acknowledgedMessagesMetric.Inc()
+	h.tracer.Record(traceEvent{EventId: eventId, Stage: traceStageAcknowledged, ClientId: clientId})
+	log.Debugf("message %v acknowledged by %v", eventId, logId(clientId))
+	return c.JSON(http.StatusOK, HttpResOk())
+}
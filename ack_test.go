@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/config"
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestAckHandler(t *testing.T) {
+	defer func(enabled bool) { config.Config.AckEnabled = enabled }(config.Config.AckEnabled)
+	config.Config.AckEnabled = true
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet := hex.EncodeToString(pub)
+	ackSigned := func(query, signature string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/bridge/ack?"+query, nil)
+		if signature != "" {
+			req.Header.Set("X-Signature", signature)
+		}
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	ack := func(eventId int64) int {
+		signature := hex.EncodeToString(ed25519.Sign(priv, ackSignaturePayload(fmt.Sprint(eventId))))
+		return ackSigned(fmt.Sprintf("client_id=%v&event_id=%v", wallet, eventId), signature)
+	}
+
+	stored := datatype.SseMessage{EventId: h.nextID(), Message: []byte("stored"), To: wallet}
+	if err := h.persist(context.Background(), wallet, 60, "", stored); err != nil {
+		t.Fatal(err)
+	}
+	if code := ack(stored.EventId); code != http.StatusOK {
+		t.Fatalf("want 200, got %v", code)
+	}
+	// the receiver may acknowledge a message stored in the background before it's written
+	pending := datatype.SseMessage{EventId: h.nextID(), Message: []byte("pending"), To: wallet}
+	if code := ack(pending.EventId); code != http.StatusOK {
+		t.Fatalf("want 200, got %v", code)
+	}
+	if err := h.persist(context.Background(), wallet, 60, "", pending); err != nil {
+		t.Fatal(err)
+	}
+	if messages, _ := storage.GetMessages(context.Background(), []string{wallet}, 0); len(messages) != 0 {
+		t.Fatalf("acknowledged messages are still stored: %v", messages)
+	}
+
+	for _, query := range []string{"event_id=1", "client_id=wallet", "client_id=wallet&event_id=x"} {
+		if code := ackSigned(query, ""); code != http.StatusBadRequest {
+			t.Fatalf("%v: want 400, got %v", query, code)
+		}
+	}
+	if code := ack(time.Now().Add(time.Hour).UnixMicro()); code != http.StatusBadRequest {
+		t.Fatalf("want 400 for an event id from the future, got %v", code)
+	}
+
+	kept := datatype.SseMessage{EventId: h.nextID(), Message: []byte("kept"), To: wallet}
+	if err := h.persist(context.Background(), wallet, 60, "", kept); err != nil {
+		t.Fatal(err)
+	}
+	query := fmt.Sprintf("client_id=%v&event_id=%v", wallet, kept.EventId)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	for name, signature := range map[string]string{
+		"missing":   "",
+		"malformed": "x",
+		"other key": hex.EncodeToString(ed25519.Sign(other, ackSignaturePayload(fmt.Sprint(kept.EventId)))),
+		"other id":  hex.EncodeToString(ed25519.Sign(priv, ackSignaturePayload(fmt.Sprint(stored.EventId)))),
+	} {
+		if code := ackSigned(query, signature); code != http.StatusUnauthorized {
+			t.Fatalf("%v signature: want 401, got %v", name, code)
+		}
+	}
+	if messages, _ := storage.GetMessages(context.Background(), []string{wallet}, 0); len(messages) != 1 {
+		t.Fatalf("unauthorized acknowledgement removed the message: %v", messages)
+	}
+}
+
+func TestAckHandler_Disabled(t *testing.T) {
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet := hex.EncodeToString(pub)
+	stored := datatype.SseMessage{EventId: h.nextID(), Message: []byte("stored"), To: wallet}
+	if err := h.persist(context.Background(), wallet, 60, "", stored); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/bridge/ack?client_id=%v&event_id=%v", wallet, stored.EventId), nil)
+	req.Header.Set("X-Signature", hex.EncodeToString(ed25519.Sign(priv, ackSignaturePayload(fmt.Sprint(stored.EventId)))))
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("want 404 without ACK_ENABLE, got %v", rec.Code)
+	}
+	if messages, _ := storage.GetMessages(context.Background(), []string{wallet}, 0); len(messages) != 1 {
+		t.Fatalf("acknowledgement removed the message while disabled: %v", messages)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+func registerAdminHandlers(g *echo.Group, h *handler) {
+	g.GET("/subscriptions", h.SubscriptionsHandler)
+	g.GET("/trace", h.TraceHandler)
+	g.GET("/side-effects", h.SideEffectsHandler)
+	g.GET("/connections", h.ConnectionStatsHandler)
+	g.GET("/top-clients", h.TopClientsHandler)
+	g.GET("/audit", h.AuditExportHandler)
+	g.GET("/grafana-dashboard", h.GrafanaDashboardHandler)
+	g.POST("/gc", h.GCHandler)
+	g.POST("/drain", h.DrainHandler)
+	g.GET("/read-only", h.ReadOnlyHandler)
+	g.POST("/read-only", h.ReadOnlyHandler)
+}
+
+// adminAuthMiddleware only lets through requests carrying "Authorization: Bearer <token>".
+func adminAuthMiddleware(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			provided := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				return c.JSON(HttpResError("unauthorized", http.StatusUnauthorized))
+			}
+			return next(c)
+		}
+	}
+}
+
+type subscriptionInfo struct {
+	ClientId       string `json:"client_id"`
+	Sessions       int    `json:"sessions"`
+	Buffered       []int  `json:"buffered"`
+	BufferCapacity int    `json:"buffer_capacity"`
+	// RTTMs is the last heartbeat round trip of every session in milliseconds, 0 until it's measured.
+	RTTMs []float64 `json:"rtt_ms"`
+	// CloseReasons are set for the sessions that are being closed, see Session.SetCloseReason.
+	CloseReasons []string `json:"close_reasons"`
+	// LastCloseReason is why the last closed stream of the client id ended.
+	LastCloseReason string `json:"last_close_reason,omitempty"`
+}
+
+type subscriptionsRes struct {
+	TotalKeys          int                `json:"total_keys"`
+	TotalSubscriptions int                `json:"total_subscriptions"`
+	Subscriptions      []subscriptionInfo `json:"subscriptions"`
+}
+
+// SubscriptionsHandler returns a snapshot of the client_id -> sessions registry
+// including how many messages are waiting in each session's channel, its heartbeat round trip time
+// and close reason, and why the last stream of the client id was closed.
+// Optional params: client_id to inspect a single key, limit to cap the number of returned keys.
+func (h *handler) SubscriptionsHandler(c echo.Context) error {
+	limit := 1000
+	if l := c.QueryParam("limit"); l != "" {
+		v, err := strconv.Atoi(l)
+		if err != nil || v <= 0 {
+			return c.JSON(HttpResError("param \"limit\" should be positive int", http.StatusBadRequest))
+		}
+		limit = v
+	}
+	filter := c.QueryParam("client_id")
+
+	h.Mux.RLock()
+	streams := make(map[string]*stream, len(h.Connections))
+	for id, s := range h.Connections {
+		if filter != "" && id != filter {
+			continue
+		}
+		streams[id] = s
+	}
+	h.Mux.RUnlock()
+
+	res := subscriptionsRes{TotalKeys: len(streams), Subscriptions: []subscriptionInfo{}}
+	for id, s := range streams {
+		info := subscriptionInfo{ClientId: id}
+		s.mux.RLock()
+		info.Sessions = len(s.Sessions)
+		for _, ses := range s.Sessions {
+			info.Buffered = append(info.Buffered, len(ses.MessageCh))
+			info.BufferCapacity = cap(ses.MessageCh)
+			info.RTTMs = append(info.RTTMs, float64(ses.RTT())/float64(time.Millisecond))
+			info.CloseReasons = append(info.CloseReasons, ses.CloseReason())
+		}
+		s.mux.RUnlock()
+		info.LastCloseReason = h.stats.LastCloseReason(id)
+		res.TotalSubscriptions += info.Sessions
+		res.Subscriptions = append(res.Subscriptions, info)
+	}
+	sort.Slice(res.Subscriptions, func(i, j int) bool {
+		return res.Subscriptions[i].ClientId < res.Subscriptions[j].ClientId
+	})
+	if len(res.Subscriptions) > limit {
+		res.Subscriptions = res.Subscriptions[:limit]
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+type storedMessageInfo struct {
+	ClientId string `json:"client_id"`
+	EventId  int64  `json:"event_id"`
+	InStore  bool   `json:"in_storage"`
+}
+
+type traceRes struct {
+	TraceId string              `json:"trace_id,omitempty"`
+	Events  []traceEvent        `json:"events"`
+	Storage []storedMessageInfo `json:"storage"`
+}
+
+// TraceHandler aggregates what the bridge knows about a message identified by trace_id or event_id:
+// recent trace events kept in memory and whether the message is still present in storage.
+func (h *handler) TraceHandler(c echo.Context) error {
+	traceId := c.QueryParam("trace_id")
+	var eventId int64
+	if e := c.QueryParam("event_id"); e != "" {
+		v, err := strconv.ParseInt(e, 10, 64)
+		if err != nil {
+			return c.JSON(HttpResError("param \"event_id\" should be int", http.StatusBadRequest))
+		}
+		eventId = v
+	}
+	if traceId == "" && eventId == 0 {
+		return c.JSON(HttpResError("param \"trace_id\" or \"event_id\" required", http.StatusBadRequest))
+	}
+
+	res := traceRes{TraceId: traceId, Events: h.tracer.Find(traceId, eventId), Storage: []storedMessageInfo{}}
+	if res.Events == nil {
+		res.Events = []traceEvent{}
+	}
+	for _, e := range res.Events {
+		if e.Stage != traceStageReceived {
+			continue
+		}
+		info := storedMessageInfo{ClientId: e.ClientId, EventId: e.EventId}
+		messages, err := h.storage.GetMessages(c.Request().Context(), []string{e.ClientId}, e.EventId-1)
+		if err != nil {
+			return c.JSON(HttpResError(err.Error(), http.StatusInternalServerError))
+		}
+		for _, m := range messages {
+			if m.EventId == e.EventId {
+				info.InStore = true
+				break
+			}
+		}
+		res.Storage = append(res.Storage, info)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// ConnectionStatsHandler returns reconnect frequency, mean connection lifetime and heartbeat misses
+// of a client_id over the rolling stats window.
+func (h *handler) ConnectionStatsHandler(c echo.Context) error {
+	clientId := c.QueryParam("client_id")
+	if clientId == "" {
+		return c.JSON(HttpResError("param \"client_id\" not present", http.StatusBadRequest))
+	}
+	return c.JSON(http.StatusOK, h.stats.Get(clientId, time.Now()))
+}
+
+// AuditExportHandler exports audit records created in [from, to), both RFC3339, defaulting to the last 24 hours.
+func (h *handler) AuditExportHandler(c echo.Context) error {
+	if h.audit == nil {
+		return c.JSON(HttpResError("audit log is disabled", http.StatusNotFound))
+	}
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		v := c.QueryParam(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return c.JSON(HttpResError(fmt.Sprintf("param %q should be RFC3339 time", name), http.StatusBadRequest))
+		}
+		*t = parsed
+	}
+	records, err := h.audit.GetAuditRecords(c.Request().Context(), from, to)
+	if err != nil {
+		return c.JSON(HttpResError(err.Error(), http.StatusInternalServerError))
+	}
+	return c.JSON(http.StatusOK, records)
+}
+
+// expiredRemover is implemented by storages that can sweep expired messages on demand.
+type expiredRemover interface {
+	RemoveExpired(ctx context.Context) (int64, error)
+}
+
+type gcRes struct {
+	Removed  int64   `json:"removed"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// GCHandler removes expired messages from the storage right away instead of waiting for the periodic sweep.
+func (h *handler) GCHandler(c echo.Context) error {
+	remover, ok := h.storage.(expiredRemover)
+	if !ok {
+		return c.JSON(HttpResError("storage doesn't support garbage collection", http.StatusNotImplemented))
+	}
+	started := time.Now()
+	removed, err := remover.RemoveExpired(c.Request().Context())
+	if err != nil {
+		return c.JSON(HttpResError(err.Error(), http.StatusInternalServerError))
+	}
+	log.WithField("prefix", "GCHandler").Infof("removed %v expired messages", removed)
+	return c.JSON(http.StatusOK, gcRes{Removed: removed, Duration: time.Since(started).Seconds()})
+}
+
+type sideEffectsRes struct {
+	Failures []sideEffectFailure `json:"failures"`
+}
+
+// SideEffectsHandler returns the recent failed webhook and CopyToURL calls, newest first.
+func (h *handler) SideEffectsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, sideEffectsRes{Failures: h.sideEffects.Recent()})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+var resumesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "number_of_resumes",
+	Help: "The total number of streams resumed with a Last-Event-ID, by the replay path: fast from memory or slow from storage",
+}, []string{"path"})
+
+const (
+	resumePathFast = "fast"
+	resumePathSlow = "slow"
+)
+
+// eventIdSeparator splits the event id from the instance epoch in affinity event ids, e.g. "1700000000000000.lj3k8a".
+const eventIdSeparator = "."
+
+// formatEventId returns the SSE id of a message, with the instance epoch appended if SSE_AFFINITY_IDS is set.
+func (h *handler) formatEventId(eventId int64) string {
+	id := strconv.FormatInt(eventId, 10)
+	if h.recent == nil {
+		return id
+	}
+	return id + eventIdSeparator + h.recent.epoch
+}
+
+// parseEventId parses an id written by formatEventId, epoch is empty for plain ids.
+func parseEventId(s string) (eventId int64, epoch string, err error) {
+	if i := strings.LastIndex(s, eventIdSeparator); i >= 0 {
+		s, epoch = s[:i], s[i+1:]
+	}
+	eventId, err = strconv.ParseInt(s, 10, 64)
+	return eventId, epoch, err
+}
+
+// resumeStorage returns where a session resuming after lastEventId replays the history from.
+// The messages seen by this instance are kept in memory, a client which got lastEventId from this instance
+// replays them without querying the storage, unless some of them were evicted or came from another instance.
+// Messages stored by other instances only show up in memory through the relay, so without a healthy relay
+// every resume replays from storage. An instance that failed to publish announces the gap once it publishes again,
+// until then a resume here may miss its messages.
+func (h *handler) resumeStorage(clientIds []string, lastEventId int64, epoch string) db {
+	if lastEventId <= 0 {
+		return h.storage
+	}
+	if h.recent != nil && h.relayHealthy() && epoch == h.recent.epoch && h.recent.Covers(clientIds, lastEventId) {
+		resumesMetric.WithLabelValues(resumePathFast).Inc()
+		return h.recent
+	}
+	resumesMetric.WithLabelValues(resumePathSlow).Inc()
+	return h.storage
+}
+
+type recentMessage struct {
+	datatype.SseMessage
+	expireAt time.Time
+}
+
+type recentClient struct {
+	messages []recentMessage
+	// evictedUpTo is the newest id dropped or not seen by this instance, the history after it is complete.
+	evictedUpTo int64
+}
+
+// recentMessages keeps the last messages of every client that went through this instance
+// for the fast resume path, see resumeStorage.
+type recentMessages struct {
+	mu      sync.Mutex
+	clients map[string]*recentClient
+	size    int
+	// since is the first event id of this instance, older ids may belong to messages it hasn't seen.
+	since int64
+	// epoch identifies this instance in event ids.
+	epoch string
+}
+
+func newRecentMessages(size int, since int64) *recentMessages {
+	r := &recentMessages{
+		clients: map[string]*recentClient{},
+		size:    size,
+		since:   since,
+		epoch:   strconv.FormatInt(since, 36),
+	}
+	return r
+}
+
+func (r *recentMessages) Add(ctx context.Context, key string, ttl int64, mes datatype.SseMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.client(key)
+	c.messages = append(c.messages, recentMessage{SseMessage: mes, expireAt: time.Now().Add(time.Duration(ttl) * time.Second)})
+	if len(c.messages) > r.size {
+		evicted := c.messages[0]
+		c.messages = c.messages[1:]
+		if evicted.EventId > c.evictedUpTo {
+			c.evictedUpTo = evicted.EventId
+		}
+	}
+	return nil
+}
+
+// Missed records a message for key that this instance doesn't keep, e.g. relayed from another instance.
+func (r *recentMessages) Missed(key string, eventId int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.client(key)
+	if eventId > c.evictedUpTo {
+		c.evictedUpTo = eventId
+	}
+}
+
+// Remove forgets an acknowledged or consumed message, so it's not replayed.
+func (r *recentMessages) Remove(key string, eventId int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.clients[key]
+	if !ok {
+		return
+	}
+	for i, m := range c.messages {
+		if m.EventId == eventId {
+			c.messages = append(c.messages[:i], c.messages[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *recentMessages) GetMessages(ctx context.Context, keys []string, lastEventId int64) ([]datatype.SseMessage, error) {
+	now := time.Now()
+	results := make([]datatype.SseMessage, 0)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		c, ok := r.clients[key]
+		if !ok {
+			continue
+		}
+		for _, m := range c.messages {
+			if m.EventId <= lastEventId || now.After(m.expireAt) {
+				continue
+			}
+			results = append(results, m.SseMessage)
+		}
+	}
+	return results, nil
+}
+
+// Invalidate makes resumes after ids up to eventId take the slow path, e.g. when relayed messages may have been lost.
+func (r *recentMessages) Invalidate(eventId int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if eventId > r.since {
+		r.since = eventId
+	}
+}
+
+// Covers reports whether every message for keys after lastEventId is kept in memory.
+func (r *recentMessages) Covers(keys []string, lastEventId int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if lastEventId < r.since {
+		return false
+	}
+	for _, key := range keys {
+		if c, ok := r.clients[key]; ok && c.evictedUpTo > lastEventId {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *recentMessages) client(key string) *recentClient {
+	c, ok := r.clients[key]
+	if !ok {
+		c = &recentClient{}
+		r.clients[key] = c
+	}
+	return c
+}
+
+// watcher drops expired messages. A client without messages is kept while its evictedUpTo
+// may still be newer than a Last-Event-ID, i.e. for the longest ttl.
+func (r *recentMessages) watcher(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Minute):
+		}
+		now := time.Now()
+		keepAfter := now.Add(-time.Duration(longestTTL()) * time.Second).UnixMicro()
+		r.mu.Lock()
+		for key, c := range r.clients {
+			alive := c.messages[:0]
+			for _, m := range c.messages {
+				if !now.After(m.expireAt) {
+					alive = append(alive, m)
+				}
+			}
+			c.messages = alive
+			if len(c.messages) == 0 && c.evictedUpTo < keepAfter {
+				delete(r.clients, key)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
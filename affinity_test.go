@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestEventIdAffinity(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	if id := h.formatEventId(42); id != "42" {
+		t.Fatalf("want a plain id without affinity, got %q", id)
+	}
+	h.recent = newRecentMessages(2, h._eventIDs)
+	id, epoch, err := parseEventId(h.formatEventId(42))
+	if err != nil || id != 42 || epoch != h.recent.epoch {
+		t.Fatalf("got %v %q %v", id, epoch, err)
+	}
+	if _, _, err := parseEventId("42.x.y"); err == nil {
+		t.Fatal("want an error for a malformed id")
+	}
+
+	ctx := context.Background()
+	var sent []datatype.SseMessage
+	for i := 0; i < 3; i++ {
+		mes := datatype.SseMessage{EventId: h.nextID(), Message: []byte("m"), To: "wallet"}
+		h.recent.Add(ctx, "wallet", 60, mes)
+		sent = append(sent, mes)
+	}
+	fast := counterValue(resumesMetric.WithLabelValues(resumePathFast))
+	slow := counterValue(resumesMetric.WithLabelValues(resumePathSlow))
+
+	// other instances sharing the storage could have stored messages the memory doesn't know about
+	if s := h.resumeStorage([]string{"wallet"}, sent[1].EventId, h.recent.epoch); s != h.storage {
+		t.Fatal("want the slow path without a relay")
+	}
+	h.relay = &hubRelay{hub: &relayHub{subscribers: map[*hubRelay]func(datatype.SseMessage){}}}
+	h.health.Success("relay")
+	if s := h.resumeStorage([]string{"wallet"}, sent[1].EventId, h.recent.epoch); s != h.recent {
+		t.Fatal("want the fast path for a resume on the same instance")
+	}
+	if messages, _ := h.recent.GetMessages(ctx, []string{"wallet"}, sent[1].EventId); len(messages) != 1 || messages[0].EventId != sent[2].EventId {
+		t.Fatalf("unexpected replay: %v", messages)
+	}
+	// the first message was evicted, the replay after it would be incomplete
+	if s := h.resumeStorage([]string{"wallet"}, sent[0].EventId-1, h.recent.epoch); s != h.storage {
+		t.Fatal("want the slow path after evicted messages")
+	}
+	if s := h.resumeStorage([]string{"wallet"}, sent[1].EventId, "other"); s != h.storage {
+		t.Fatal("want the slow path for a resume from another instance")
+	}
+	h.recent.Missed("wallet", h.nextID())
+	if s := h.resumeStorage([]string{"wallet"}, sent[2].EventId, h.recent.epoch); s != h.storage {
+		t.Fatal("want the slow path after a relayed message")
+	}
+	if got := counterValue(resumesMetric.WithLabelValues(resumePathFast)) - fast; got != 1 {
+		t.Fatalf("want 1 fast resume, got %v", got)
+	}
+	if got := counterValue(resumesMetric.WithLabelValues(resumePathSlow)) - slow; got != 4 {
+		t.Fatalf("want 4 slow resumes, got %v", got)
+	}
+
+	h.recent.Remove("wallet", sent[2].EventId)
+	if messages, _ := h.recent.GetMessages(ctx, []string{"wallet"}, 0); len(messages) != 1 {
+		t.Fatalf("removed message is replayed: %v", messages)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+type auditStorage interface {
+	AddAuditRecord(ctx context.Context, record datatype.AuditRecord) error
+	GetAuditRecords(ctx context.Context, from, to time.Time) ([]datatype.AuditRecord, error)
+	RemoveAuditRecordsBefore(ctx context.Context, before time.Time) error
+}
+
+func hashClientId(clientId string) string {
+	sum := sha256.Sum256([]byte(clientId))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditRetentionWorker removes audit records older than retention once an hour.
+func auditRetentionWorker(storage auditStorage, retention time.Duration, done <-chan struct{}) {
+	log := log.WithField("prefix", "auditRetentionWorker")
+	for {
+		err := storage.RemoveAuditRecordsBefore(context.Background(), time.Now().Add(-retention))
+		if err != nil {
+			log.Errorf("remove old audit records: %v", err)
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
@@ -7,15 +7,22 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/labstack/echo/v4"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/tonkeeper/bridge/config"
 	"golang.org/x/exp/slices"
 )
 
-var tokenUsageMetric = promauto.NewCounterVec(prometheus.CounterOpts{
-	Name: "bridge_token_usage",
-}, []string{"token"})
+var (
+	tokenUsageMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bridge_token_usage",
+	}, []string{"token"})
+	allowlistedRequestsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_allowlisted_requests",
+		Help: "The total number of requests that bypassed a limiter because of the allowlist",
+	}, []string{"limiter", "kind"})
+)
 
 // ConnectionsLimiter is a middleware that limits the number of simultaneous connections per IP.
 type ConnectionsLimiter struct {
@@ -32,15 +39,15 @@ func newConnectionLimiter(i int) *ConnectionsLimiter {
 }
 
 // leaseConnection increases a number of connections per given token and
-// returns a release function to be called once a request is finished.
+// returns a release function to be called once a request is finished along with the number of leased connections.
 // If the token reaches the limit of max simultaneous connections, leaseConnection returns an error.
-func (auth *ConnectionsLimiter) leaseConnection(request *http.Request) (release func(), err error) {
+func (auth *ConnectionsLimiter) leaseConnection(request *http.Request) (release func(), used int, err error) {
 	key := fmt.Sprintf("ip-%v", realIP(request))
 	auth.mu.Lock()
 	defer auth.mu.Unlock()
 
 	if auth.connections[key] >= auth.max {
-		return nil, fmt.Errorf("you have reached the limit of streaming connections: %v max", auth.max)
+		return nil, auth.connections[key], fmt.Errorf("you have reached the limit of streaming connections: %v max", auth.max)
 	}
 	auth.connections[key] += 1
 
@@ -51,11 +58,32 @@ func (auth *ConnectionsLimiter) leaseConnection(request *http.Request) (release
 		if auth.connections[key] == 0 {
 			delete(auth.connections, key)
 		}
-	}, nil
+	}, auth.connections[key], nil
 }
 
-func realIP(request *http.Request) string {
-	// Fall back to legacy behavior
+// ipExtractor resolves the client ip of a request, see newIPExtractor.
+var ipExtractor echo.IPExtractor = legacyRealIP
+
+// newIPExtractor returns legacyRealIP without cidrs. Otherwise X-Forwarded-For is only trusted when the peer
+// is in one of cidrs and the peer address is used for everyone else, so clients can't pick their own ip.
+func newIPExtractor(cidrs []string) (echo.IPExtractor, error) {
+	if len(cidrs) == 0 {
+		return legacyRealIP, nil
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy cidr %q: %w", cidr, err)
+		}
+		options = append(options, echo.TrustIPRange(network))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// legacyRealIP takes the first address of X-Forwarded-For, then X-Real-Ip, then the peer address.
+// Bridges behind a proxy depend on it, the headers are trusted from anyone.
+func legacyRealIP(request *http.Request) string {
 	if ip := request.Header.Get("X-Forwarded-For"); ip != "" {
 		i := strings.IndexAny(ip, ",")
 		if i > 0 {
@@ -70,6 +98,10 @@ func realIP(request *http.Request) string {
 	return ra
 }
 
+func realIP(request *http.Request) string {
+	return ipExtractor(request)
+}
+
 func skipRateLimitsByToken(request *http.Request) bool {
 	if request == nil {
 		return false
@@ -86,3 +118,69 @@ func skipRateLimitsByToken(request *http.Request) bool {
 	}
 	return false
 }
+
+// limitsAllowlist lets health checkers and internal probes bypass the rate and connection limiters
+// by source network or by a dedicated bearer token.
+type limitsAllowlist struct {
+	networks []*net.IPNet
+	tokens   []string
+}
+
+func newLimitsAllowlist(cidrs, tokens []string) (*limitsAllowlist, error) {
+	a := limitsAllowlist{tokens: tokens}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist cidr %q: %w", cidr, err)
+		}
+		a.networks = append(a.networks, network)
+	}
+	return &a, nil
+}
+
+// Skip reports whether request is allowlisted and counts it against the given limiter.
+func (a *limitsAllowlist) Skip(request *http.Request, limiter string) bool {
+	kind := a.match(request)
+	if kind == "" {
+		return false
+	}
+	allowlistedRequestsMetric.WithLabelValues(limiter, kind).Inc()
+	return true
+}
+
+// match returns how request is allowlisted, "token" or "cidr", or an empty string.
+func (a *limitsAllowlist) match(request *http.Request) string {
+	if a == nil || request == nil {
+		return ""
+	}
+	if len(a.tokens) > 0 {
+		token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if token != "" && slices.Contains(a.tokens, token) {
+			return "token"
+		}
+	}
+	if len(a.networks) > 0 {
+		ip := net.ParseIP(realIP(request))
+		for _, network := range a.networks {
+			if ip != nil && network.Contains(ip) {
+				return "cidr"
+			}
+		}
+	}
+	return ""
+}
+
+// unlimited reports whether request bypasses the limiters, without counting it.
+func (a *limitsAllowlist) unlimited(request *http.Request) bool {
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return (token != "" && slices.Contains(config.Config.RateLimitsByPassToken, token)) || a.match(request) != ""
+}
+
+// authenticated reports whether request carries a rate limits bypass or an allowlist token.
+func (a *limitsAllowlist) authenticated(request *http.Request) bool {
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return false
+	}
+	return slices.Contains(config.Config.RateLimitsByPassToken, token) || (a != nil && slices.Contains(a.tokens, token))
+}
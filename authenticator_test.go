@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestLimitsAllowlist_Skip(t *testing.T) {
+	a, err := newLimitsAllowlist([]string{"10.0.0.0/8", " 192.168.1.1/32"}, []string{"probe-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		authorization string
+		want          bool
+	}{
+		{name: "private network", remoteAddr: "10.1.2.3:1234", want: true},
+		{name: "single host", remoteAddr: "192.168.1.1:1234", want: true},
+		{name: "other host", remoteAddr: "192.168.1.2:1234", want: false},
+		{name: "token", remoteAddr: "8.8.8.8:1234", authorization: "Bearer probe-token", want: true},
+		{name: "wrong token", remoteAddr: "8.8.8.8:1234", authorization: "Bearer other", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/bridge/events", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			if got := a.Skip(r, "test"); got != tt.want {
+				t.Errorf("Skip() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := newLimitsAllowlist([]string{"not-a-cidr"}, nil); err == nil {
+		t.Fatal("expected error for invalid cidr")
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/bridge/events", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if got := realIP(r); got != "1.2.3.4" {
+		t.Fatalf("without TRUSTED_PROXIES X-Forwarded-For must be used, got %v", got)
+	}
+	defer func(e echo.IPExtractor) { ipExtractor = e }(ipExtractor)
+	tests := []struct {
+		name       string
+		proxies    []string
+		remoteAddr string
+		xff        string
+		realIP     string
+		want       string
+	}{
+		{name: "no proxies", remoteAddr: "10.0.0.1:1234", xff: "1.2.3.4, 10.0.0.2", want: "1.2.3.4"},
+		{name: "no proxies real ip", remoteAddr: "10.0.0.1:1234", realIP: "1.2.3.4", want: "1.2.3.4"},
+		{name: "no proxies no headers", remoteAddr: "8.8.8.8:1234", want: "8.8.8.8"},
+		{name: "trusted proxy", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.1:1234", xff: "1.2.3.4", want: "1.2.3.4"},
+		{name: "spoofed chain", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.1:1234", xff: "9.9.9.9, 1.2.3.4", want: "1.2.3.4"},
+		{name: "untrusted peer", proxies: []string{"10.0.0.0/8"}, remoteAddr: "8.8.8.8:1234", xff: "1.2.3.4", want: "8.8.8.8"},
+		{name: "private peer not listed", proxies: []string{"10.0.0.0/8"}, remoteAddr: "192.168.1.1:1234", xff: "1.2.3.4", want: "192.168.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			ipExtractor, err = newIPExtractor(tt.proxies)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/bridge/events", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-Ip", tt.realIP)
+			}
+			if got := realIP(r); got != tt.want {
+				t.Errorf("realIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := newIPExtractor([]string{"not-a-cidr"}); err == nil {
+		t.Fatal("expected error for invalid cidr")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+var throttledClientsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "number_of_throttled_requests_by_client",
+	Help: "The total number of requests rejected by the per client_id rate limit",
+}, []string{"client_id", "endpoint"})
+
+// maxThrottledClientLabels caps the number of distinct client_id label values, the rest is counted as "other".
+const maxThrottledClientLabels = 100
+
+var throttledClientLabels = struct {
+	sync.Mutex
+	seen map[string]struct{}
+}{seen: map[string]struct{}{}}
+
+// throttledClientLabel returns the metric label of clientId formatted according to LOG_IDS.
+func throttledClientLabel(clientId string) string {
+	label := logId(clientId)
+	throttledClientLabels.Lock()
+	defer throttledClientLabels.Unlock()
+	if _, ok := throttledClientLabels.seen[label]; !ok {
+		if len(throttledClientLabels.seen) >= maxThrottledClientLabels {
+			return "other"
+		}
+		throttledClientLabels.seen[label] = struct{}{}
+	}
+	return label
+}
+
+// clientRateLimitMiddleware limits requests to path to rps per client_id query param,
+// so a single dapp behind a NAT can't use up the per IP budget of its neighbours or the other way round.
+// Requests without client_id in the query and requests skipped by skipper are not limited.
+func clientRateLimitMiddleware(path string, rps int, skipper func(c echo.Context) bool) echo.MiddlewareFunc {
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Skipper: func(c echo.Context) bool {
+			return rps <= 0 || c.Path() != path || c.QueryParam("client_id") == "" || skipper(c)
+		},
+		Store: middleware.NewRateLimiterMemoryStore(rate.Limit(rps)),
+		IdentifierExtractor: func(c echo.Context) (string, error) {
+			return c.QueryParam("client_id"), nil
+		},
+		DenyHandler: func(c echo.Context, clientId string, err error) error {
+			throttledClientsMetric.WithLabelValues(throttledClientLabel(clientId), path).Inc()
+			return c.JSON(HttpResError("client_id rate limit exceeded", http.StatusTooManyRequests))
+		},
+	})
+}
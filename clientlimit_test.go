@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestClientRateLimitMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Use(clientRateLimitMiddleware("/bridge/message", 1, func(c echo.Context) bool {
+		return c.Request().Header.Get("Authorization") != ""
+	}))
+	e.POST("/bridge/message", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	send := func(clientId string, token bool) int {
+		req := httptest.NewRequest(http.MethodPost, "/bridge/message?client_id="+clientId, nil)
+		if token {
+			req.Header.Set("Authorization", "Bearer token")
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := send("dapp", false); code != http.StatusOK {
+		t.Fatalf("first request: want 200, got %v", code)
+	}
+	if code := send("dapp", false); code != http.StatusTooManyRequests {
+		t.Fatalf("second request: want 429, got %v", code)
+	}
+	if code := send("other", false); code != http.StatusOK {
+		t.Fatalf("other client: want 200, got %v", code)
+	}
+	if code := send("dapp", true); code != http.StatusOK {
+		t.Fatalf("skipped request: want 200, got %v", code)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	connectionLifetimeMetric = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "connection_lifetime_seconds",
+		Help:    "How long SSE connections stay open",
+		Buckets: []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 4 * 3600},
+	})
+	reconnectsMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_reconnects",
+		Help: "The total number of connections opened for a client_id that already connected within the stats window",
+	})
+	heartbeatMissesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_heartbeat_misses",
+		Help: "The total number of heartbeats not echoed back before the next one was sent",
+	})
+	closedConnectionsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_closed_connections",
+		Help: "The total number of SSE connections closed, by reason",
+	}, []string{"reason"})
+	originChangesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_origin_changes",
+		Help: "The total number of connections for a client_id with a different Origin than its previous connection",
+	})
+)
+
+// connectionStats keeps per client_id connection history for a rolling window.
+type connectionStats struct {
+	mu      sync.Mutex
+	window  time.Duration
+	clients map[string]*clientHistory
+}
+
+type clientHistory struct {
+	connects        []time.Time
+	disconnects     []time.Time
+	lifetimes       []time.Duration
+	heartbeatMisses []time.Time
+	originChanges   []time.Time
+	reports         []abuseReport
+	origin          string
+	closeReason     string
+	active          int
+}
+
+type clientStats struct {
+	ClientId            string  `json:"client_id"`
+	WindowSeconds       float64 `json:"window_seconds"`
+	Active              int     `json:"active"`
+	Connects            int     `json:"connects"`
+	Reconnects          int     `json:"reconnects"`
+	MeanLifetimeSeconds float64 `json:"mean_lifetime_seconds"`
+	HeartbeatMisses     int     `json:"heartbeat_misses"`
+	Origin              string  `json:"origin,omitempty"`
+	OriginChanges       int     `json:"origin_changes"`
+	Reports             int     `json:"reports"`
+	LastCloseReason     string  `json:"last_close_reason,omitempty"`
+}
+
+func newConnectionStats(window time.Duration) *connectionStats {
+	s := &connectionStats{
+		window:  window,
+		clients: map[string]*clientHistory{},
+	}
+	return s
+}
+
+func (s *connectionStats) watcher(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Minute):
+		}
+		now := time.Now()
+		s.mu.Lock()
+		for id, h := range s.clients {
+			h.trim(now.Add(-s.window))
+			if h.active == 0 && len(h.connects) == 0 && len(h.disconnects) == 0 && len(h.heartbeatMisses) == 0 && len(h.originChanges) == 0 && len(h.reports) == 0 {
+				delete(s.clients, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *connectionStats) history(id string) *clientHistory {
+	h, ok := s.clients[id]
+	if !ok {
+		h = &clientHistory{}
+		s.clients[id] = h
+	}
+	return h
+}
+
+func (s *connectionStats) Connected(ids []string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		h := s.history(id)
+		h.trim(now.Add(-s.window))
+		if len(h.connects) > 0 {
+			reconnectsMetric.Inc()
+		}
+		h.connects = append(h.connects, now)
+		h.active++
+	}
+}
+
+// Disconnected records a closed connection and the reason it was closed for, see Session.SetCloseReason.
+func (s *connectionStats) Disconnected(ids []string, startedAt, now time.Time, reason string) {
+	lifetime := now.Sub(startedAt)
+	connectionLifetimeMetric.Observe(lifetime.Seconds())
+	closedConnectionsMetric.WithLabelValues(reason).Inc()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		h := s.history(id)
+		h.trim(now.Add(-s.window))
+		h.disconnects = append(h.disconnects, now)
+		h.lifetimes = append(h.lifetimes, lifetime)
+		h.closeReason = reason
+		if h.active > 0 {
+			h.active--
+		}
+	}
+}
+
+func (s *connectionStats) HeartbeatMissed(ids []string, now time.Time) {
+	heartbeatMissesMetric.Inc()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		h := s.history(id)
+		h.trim(now.Add(-s.window))
+		h.heartbeatMisses = append(h.heartbeatMisses, now)
+	}
+}
+
+// originChange describes a client_id that reconnected from a different Origin.
+type originChange struct {
+	ClientId       string
+	PreviousOrigin string
+	Origin         string
+}
+
+// OriginSeen records the Origin of a new connection and returns the client ids
+// whose previous connection within the window came from another Origin.
+func (s *connectionStats) OriginSeen(ids []string, origin string, now time.Time) []originChange {
+	if origin == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var changes []originChange
+	for _, id := range ids {
+		h := s.history(id)
+		h.trim(now.Add(-s.window))
+		if h.origin != "" && h.origin != origin {
+			originChangesMetric.Inc()
+			h.originChanges = append(h.originChanges, now)
+			changes = append(changes, originChange{ClientId: id, PreviousOrigin: h.origin, Origin: origin})
+		}
+		h.origin = origin
+	}
+	return changes
+}
+
+// abuseReport is a receiver's complaint about a message from a client_id, see ReportHandler.
+type abuseReport struct {
+	at       time.Time
+	reporter string
+	eventId  int64
+}
+
+// Reported records a report of a message sent by id and returns whether it's new,
+// a receiver reporting the same message again is only counted once.
+func (s *connectionStats) Reported(id string, report abuseReport) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.history(id)
+	h.trim(report.at.Add(-s.window))
+	for _, r := range h.reports {
+		if r.reporter == report.reporter && r.eventId == report.eventId {
+			return false
+		}
+	}
+	h.reports = append(h.reports, report)
+	return true
+}
+
+// LastCloseReason returns why the last stream of id was closed within the window, if any.
+func (s *connectionStats) LastCloseReason(id string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.clients[id]; ok {
+		return h.closeReason
+	}
+	return ""
+}
+
+func (s *connectionStats) Get(id string, now time.Time) clientStats {
+	stats := clientStats{ClientId: id, WindowSeconds: s.window.Seconds()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.clients[id]
+	if !ok {
+		return stats
+	}
+	h.trim(now.Add(-s.window))
+	stats.Active = h.active
+	stats.Connects = len(h.connects)
+	if stats.Connects > 1 {
+		stats.Reconnects = stats.Connects - 1
+	}
+	stats.HeartbeatMisses = len(h.heartbeatMisses)
+	stats.Origin = h.origin
+	stats.OriginChanges = len(h.originChanges)
+	stats.Reports = len(h.reports)
+	stats.LastCloseReason = h.closeReason
+	if len(h.lifetimes) > 0 {
+		var total time.Duration
+		for _, l := range h.lifetimes {
+			total += l
+		}
+		stats.MeanLifetimeSeconds = (total / time.Duration(len(h.lifetimes))).Seconds()
+	}
+	return stats
+}
+
+// trim drops records older than since.
+func (h *clientHistory) trim(since time.Time) {
+	h.connects = trimTimes(h.connects, since)
+	n := len(h.disconnects)
+	h.disconnects = trimTimes(h.disconnects, since)
+	h.lifetimes = h.lifetimes[n-len(h.disconnects):]
+	h.heartbeatMisses = trimTimes(h.heartbeatMisses, since)
+	h.originChanges = trimTimes(h.originChanges, since)
+	i := 0
+	for i < len(h.reports) && h.reports[i].at.Before(since) {
+		i++
+	}
+	h.reports = h.reports[i:]
+}
+
+func trimTimes(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(since) {
+		i++
+	}
+	return times[i:]
+}
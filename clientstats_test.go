@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectionStats(t *testing.T) {
+	s := newConnectionStats(time.Hour)
+	now := time.Now()
+	ids := []string{"client"}
+
+	s.Connected(ids, now.Add(-2*time.Hour))
+	s.Disconnected(ids, now.Add(-2*time.Hour), now.Add(-90*time.Minute), closeReasonWriteError)
+	s.Connected(ids, now.Add(-30*time.Minute))
+	s.Disconnected(ids, now.Add(-30*time.Minute), now.Add(-20*time.Minute), closeReasonWriteError)
+	s.Connected(ids, now.Add(-10*time.Minute))
+	s.Disconnected(ids, now.Add(-10*time.Minute), now.Add(-5*time.Minute), closeReasonClientDisconnect)
+	s.Connected(ids, now)
+	s.HeartbeatMissed(ids, now)
+
+	got := s.Get("client", now)
+	want := clientStats{
+		ClientId:            "client",
+		WindowSeconds:       3600,
+		Active:              1,
+		Connects:            3,
+		Reconnects:          2,
+		MeanLifetimeSeconds: 450,
+		HeartbeatMisses:     1,
+		LastCloseReason:     closeReasonClientDisconnect,
+	}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got := s.Get("unknown", now); got.Connects != 0 || got.Active != 0 {
+		t.Fatalf("unexpected stats for unknown client: %+v", got)
+	}
+}
+
+func TestConnectionStats_OriginSeen(t *testing.T) {
+	s := newConnectionStats(time.Hour)
+	now := time.Now()
+	ids := []string{"client"}
+
+	if changes := s.OriginSeen(ids, "https://app.example", now); len(changes) != 0 {
+		t.Fatalf("first origin is not a change: %v", changes)
+	}
+	if changes := s.OriginSeen(ids, "", now); len(changes) != 0 {
+		t.Fatalf("missing origin is not a change: %v", changes)
+	}
+	if changes := s.OriginSeen(ids, "https://app.example", now); len(changes) != 0 {
+		t.Fatalf("same origin is not a change: %v", changes)
+	}
+	changes := s.OriginSeen(ids, "https://evil.example", now)
+	want := originChange{ClientId: "client", PreviousOrigin: "https://app.example", Origin: "https://evil.example"}
+	if len(changes) != 1 || changes[0] != want {
+		t.Fatalf("want %+v, got %v", want, changes)
+	}
+	if got := s.Get("client", now); got.Origin != "https://evil.example" || got.OriginChanges != 1 {
+		t.Fatalf("unexpected stats: %+v", got)
+	}
+}
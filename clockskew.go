@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var clockSkewMetric = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "clock_skew_seconds",
+	Help: "The largest difference between the clock of this instance and the clocks of the other instances sharing the storage",
+})
+
+// clockSkewInterval is how often instances share their clocks, an instance that missed
+// a few of them is considered gone.
+const (
+	clockSkewInterval = 30 * time.Second
+	clockSkewTTL      = 3 * clockSkewInterval
+)
+
+// clockStorage is implemented by storages shared by several instances, they compare their clocks through it.
+// Every instance measures the offset of its clock from the storage clock, the skew between two instances
+// is the difference of their offsets whatever the storage clock is.
+type clockStorage interface {
+	// StorageTime returns the current time of the storage server.
+	StorageTime(ctx context.Context) (time.Time, error)
+	// ShareClock stores offset for this instance and returns the offsets shared by the instances within ttl, including it.
+	ShareClock(ctx context.Context, offset, ttl time.Duration) (map[string]time.Duration, error)
+}
+
+// clockSkewWorker reports the "clock" dependency as degraded while the clock of this instance
+// differs from the clock of another one by more than threshold, event ids issued by them are then out of order.
+func (h *handler) clockSkewWorker(s clockStorage, threshold time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), clockSkewInterval)
+		if err := h.checkClockSkew(ctx, s, threshold); err != nil {
+			log.WithField("prefix", "clockSkewWorker").Errorf("compare clocks: %v", err)
+		}
+		cancel()
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-time.After(clockSkewInterval):
+		}
+	}
+}
+
+func (h *handler) checkClockSkew(ctx context.Context, s clockStorage, threshold time.Duration) error {
+	offset, err := storageClockOffset(ctx, s)
+	if err != nil {
+		return err
+	}
+	offsets, err := s.ShareClock(ctx, offset, clockSkewTTL)
+	if err != nil {
+		return err
+	}
+	var skew time.Duration
+	for _, o := range offsets {
+		d := o - offset
+		if d < 0 {
+			d = -d
+		}
+		if d > skew {
+			skew = d
+		}
+	}
+	clockSkewMetric.Set(skew.Seconds())
+	if skew > threshold {
+		log.WithField("prefix", "clockSkewWorker").Warnf("clock skew %v between instances exceeds %v", skew, threshold)
+		h.health.Failure("clock", fmt.Errorf("clock skew %v between instances exceeds %v", skew, threshold))
+		return nil
+	}
+	h.health.Success("clock")
+	return nil
+}
+
+// storageClockOffset returns how far the local clock is ahead of the storage clock,
+// assuming the request takes as long to reach the storage as its response to come back.
+func storageClockOffset(ctx context.Context, s clockStorage) (time.Duration, error) {
+	sent := time.Now()
+	t, err := s.StorageTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+	received := time.Now()
+	return sent.Add(received.Sub(sent) / 2).Sub(t), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+// sharedClock is a storage whose clock is behind by lag, other are offsets of the other instances.
+type sharedClock struct {
+	lag   time.Duration
+	other map[string]time.Duration
+}
+
+func (c *sharedClock) StorageTime(ctx context.Context) (time.Time, error) {
+	return time.Now().Add(-c.lag), nil
+}
+
+func (c *sharedClock) ShareClock(ctx context.Context, offset, ttl time.Duration) (map[string]time.Duration, error) {
+	offsets := map[string]time.Duration{"self": offset}
+	for k, v := range c.other {
+		offsets[k] = v
+	}
+	return offsets, nil
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	// the storage clock doesn't matter, only the offsets of the instances from it
+	s := &sharedClock{lag: time.Hour, other: map[string]time.Duration{"close": time.Hour + 100*time.Millisecond}}
+	if err := h.checkClockSkew(context.Background(), s, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := h.health.Report("memory").Dependencies["clock"]; d.State != healthStateOk {
+		t.Fatalf("want ok, got %+v", d)
+	}
+
+	s.other["far"] = time.Hour - 3*time.Second
+	if err := h.checkClockSkew(context.Background(), s, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := h.health.Report("memory").Dependencies["clock"]; d.State != healthStateDegraded {
+		t.Fatalf("want degraded, got %+v", d)
+	}
+	if skew := gaugeValue(clockSkewMetric); skew < 2.9 || skew > 3.1 {
+		t.Fatalf("want a skew of about 3s, got %v", skew)
+	}
+}
@@ -7,6 +7,13 @@ type HttpRes struct {
 	StatusCode int    `json:"statusCode,omitempty" example:"200"`
 }
 
+// SendMessageRes is returned by /bridge/message and carries the ttl the message was stored with.
+type SendMessageRes struct {
+	HttpRes
+	TTL     int64 `json:"ttl" example:"300"`
+	EventId int64 `json:"event_id,omitempty" example:"1692263422405962"`
+}
+
 func HttpResOk() HttpRes {
 	return HttpRes{
 		Message:    "OK",
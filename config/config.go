@@ -1,26 +1,359 @@
 package config
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/caarlos0/env/v6"
+	"gopkg.in/yaml.v3"
 )
 
+// EnvPrefix may be prepended to every key, prefixed variables win over unprefixed ones.
+const EnvPrefix = "BRIDGE_"
+
+// configFileKey names the yaml config file, it can only be set in the environment.
+const configFileKey = "CONFIG_FILE"
+
 var Config = struct {
+	Host                  string   `env:"HOST"`
 	Port                  int      `env:"PORT" envDefault:"8081"`
+	EventsHost            string   `env:"EVENTS_HOST"`
+	EventsPort            int      `env:"EVENTS_PORT"`
+	EventsSelfSignedTLS   bool     `env:"EVENTS_SELF_SIGNED_TLS" envDefault:"false"`
 	DbURI                 string   `env:"POSTGRES_URI"`
+	ValkeyURI             string   `env:"VALKEY_URI"`
+	ValkeyMode            string   `env:"VALKEY_MODE" envDefault:"auto"`
+	ValkeyMasterName      string   `env:"VALKEY_MASTER_NAME"`
+	PgQueryTimeout        int      `env:"POSTGRES_QUERY_TIMEOUT_MS" envDefault:"0"`
+	PgAcquireAlarm        int      `env:"POSTGRES_ACQUIRE_ALARM_MS" envDefault:"100"`
+	StorageDownPolicy     string   `env:"STORAGE_DOWN_POLICY" envDefault:"fail_open"`
 	WebhookURL            string   `env:"WEBHOOK_URL"`
+	WebhookTopicURLs      []string `env:"WEBHOOK_TOPIC_URLS"`
+	WebhookSecret         string   `env:"WEBHOOK_SECRET"`
+	WebhookRetries        int      `env:"WEBHOOK_RETRIES" envDefault:"5"`
+	WebhookBackoff        int      `env:"WEBHOOK_BACKOFF_MS" envDefault:"1000"`
 	CopyToURL             string   `env:"COPY_TO_URL"`
 	CorsEnable            bool     `env:"CORS_ENABLE"`
 	HeartbeatInterval     int      `env:"HEARTBEAT_INTERVAL" envDefault:"10"`
+	HeartbeatRTT          bool     `env:"HEARTBEAT_RTT_ENABLE" envDefault:"false"`
+	HeartbeatMetadata     bool     `env:"HEARTBEAT_METADATA" envDefault:"false"`
+	SSEBatchSize          int      `env:"SSE_BATCH_SIZE" envDefault:"1"`
+	SSEBatchWindow        int      `env:"SSE_BATCH_WINDOW_MS" envDefault:"0"`
+	SSEWriteTimeout       int      `env:"SSE_WRITE_TIMEOUT_MS" envDefault:"10000"`
+	SSERetry              int      `env:"SSE_RETRY_MS" envDefault:"2000"`
+	ReplayOrder           string   `env:"REPLAY_ORDER" envDefault:"oldest_first"`
+	ReplayPageSize        int      `env:"REPLAY_PAGE_SIZE" envDefault:"500"`
+	DeliveryMode          string   `env:"DELIVERY_MODE" envDefault:"at_least_once"`
+	DeliveredCacheSize    int      `env:"DELIVERED_CACHE_SIZE" envDefault:"10000"`
+	TransferedCacheSize   int      `env:"TRANSFERED_CACHE_SIZE" envDefault:"100000"`
+	AffinityEventIds      bool     `env:"SSE_AFFINITY_IDS" envDefault:"false"`
+	AffinityBufferSize    int      `env:"SSE_AFFINITY_BUFFER" envDefault:"100"`
+	MaxTTL                int      `env:"MAX_TTL" envDefault:"300"`
+	TopicMaxTTL           []string `env:"TOPIC_MAX_TTL"`
+	TTLClamp              bool     `env:"TTL_CLAMP" envDefault:"false"`
+	TTLJitterPercent      int      `env:"TTL_JITTER_PERCENT" envDefault:"0"`
+	DisconnectTTL         int      `env:"DISCONNECT_TTL" envDefault:"0"`
+	DisconnectMaxSize     int      `env:"DISCONNECT_MAX_SIZE" envDefault:"512"`
+	RejectSelfSend        bool     `env:"REJECT_SELF_SEND" envDefault:"false"`
+	ReadOnly              bool     `env:"READ_ONLY" envDefault:"false"`
+	SenderSignature       string   `env:"SENDER_SIGNATURE" envDefault:"off"`
+	AckEnabled            bool     `env:"ACK_ENABLE" envDefault:"false"`
+	IdempotencyWindow     int      `env:"IDEMPOTENCY_WINDOW" envDefault:"300"`
+	ConsumeOnRead         bool     `env:"CONSUME_ON_READ" envDefault:"false"`
+	CrossInstanceFanOut   bool     `env:"CROSS_INSTANCE_FANOUT" envDefault:"false"`
+	LastEventIdCheck      bool     `env:"LAST_EVENT_ID_CHECK_STORAGE" envDefault:"false"`
 	RPSLimit              int      `env:"RPS_LIMIT" envDefault:"1"`
 	RateLimitsByPassToken []string `env:"RATE_LIMITS_BY_PASS_TOKEN"`
+	SoftLimitRatio        float64  `env:"SOFT_LIMIT_RATIO" envDefault:"0.8"`
 	ConnectionsLimit      int      `env:"CONNECTIONS_LIMIT" envDefault:"50"`
+	ShedWatermark         int      `env:"SHED_CONNECTIONS_WATERMARK" envDefault:"0"`
+	ClientMessageRPSLimit int      `env:"CLIENT_MESSAGE_RPS_LIMIT" envDefault:"0"`
+	ClientEventsRPSLimit  int      `env:"CLIENT_EVENTS_RPS_LIMIT" envDefault:"0"`
+	LimitsAllowlistCIDRs  []string `env:"LIMITS_ALLOWLIST_CIDRS"`
+	LimitsAllowlistTokens []string `env:"LIMITS_ALLOWLIST_TOKENS"`
+	TrustedProxies        []string `env:"TRUSTED_PROXIES"`
 	SelfSignedTLS         bool     `env:"SELF_SIGNED_TLS" envDefault:"false"`
+	PreflightFailFast     bool     `env:"PREFLIGHT_FAIL_FAST" envDefault:"false"`
+	NTPServer             string   `env:"NTP_SERVER" envDefault:"pool.ntp.org:123"`
+	ClockSkewThreshold    int      `env:"CLOCK_SKEW_THRESHOLD_MS" envDefault:"1000"`
+	MaxHeaderBytes        int      `env:"MAX_HEADER_BYTES" envDefault:"1048576"`
+	MaxURLLength          int      `env:"MAX_URL_LENGTH" envDefault:"16384"`
+	MessageBodyLimit      int64    `env:"MESSAGE_BODY_LIMIT" envDefault:"1048576"`
+	EventsBodyLimit       int64    `env:"EVENTS_BODY_LIMIT" envDefault:"65536"`
+	DefaultBodyLimit      int64    `env:"DEFAULT_BODY_LIMIT" envDefault:"65536"`
+	AdminToken            string   `env:"ADMIN_TOKEN"`
+	TraceBufferSize       int      `env:"TRACE_BUFFER_SIZE" envDefault:"10000"`
+	AuditRetentionDays    int      `env:"AUDIT_RETENTION_DAYS" envDefault:"0"`
+	PayloadLint           bool     `env:"PAYLOAD_LINT" envDefault:"false"`
+	MessageHooks          []string `env:"MESSAGE_HOOKS"`
+	MessageHooksTimeout   int      `env:"MESSAGE_HOOKS_TIMEOUT_MS" envDefault:"50"`
+	Environment           string   `env:"ENVIRONMENT"`
+	LogIds                string   `env:"LOG_IDS" envDefault:"full"`
+	ServerTiming          bool     `env:"SERVER_TIMING"`
+	DrainPause            int      `env:"DRAIN_PAUSE_SECONDS" envDefault:"30"`
+	ConformanceInterval   int      `env:"CONFORMANCE_INTERVAL_SECONDS" envDefault:"3600"`
+	DevMode               bool     `env:"DEV_MODE" envDefault:"false"`
+	ConnectionStatsWindow int      `env:"CONNECTION_STATS_WINDOW" envDefault:"3600"`
+	TopClientsWindow      int      `env:"TOP_CLIENTS_WINDOW" envDefault:"3600"`
+	OriginChangeWebhook   bool     `env:"ORIGIN_CHANGE_WEBHOOK" envDefault:"false"`
+	DigestInterval        int      `env:"DIGEST_INTERVAL" envDefault:"0"`
+	DigestAfter           int      `env:"DIGEST_AFTER" envDefault:"120"`
+	MetricsReconcile      int      `env:"METRICS_RECONCILE_INTERVAL" envDefault:"60"`
+	SecretsRefresh        int      `env:"SECRETS_REFRESH_INTERVAL" envDefault:"0"`
+	SideEffectWorkers     int      `env:"SIDE_EFFECT_WORKERS" envDefault:"16"`
+	SideEffectQueueSize   int      `env:"SIDE_EFFECT_QUEUE_SIZE" envDefault:"10000"`
+	SideEffectTimeout     int      `env:"SIDE_EFFECT_TIMEOUT_MS" envDefault:"10000"`
+
+	// TopicTTLs are the TOPIC_MAX_TTL overrides of MaxTTL by topic, e.g. "connect:600,sendTransaction:300".
+	TopicTTLs map[string]int
 }{}
 
 func LoadConfig() {
-	if err := env.Parse(&Config); err != nil {
+	if err := Load(os.Environ()); err != nil {
 		log.Fatalf("config parsing failed: %v\n", err)
 	}
 }
+
+// Error points at the configuration key with an invalid value.
+type Error struct {
+	Key string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Key, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Load fills Config from environ and the yaml file named by CONFIG_FILE.
+// Values are taken, from lowest to highest precedence, from defaults, the config file,
+// plain environment variables and BRIDGE_ prefixed environment variables.
+// Config is left untouched if any value is invalid.
+func Load(environ []string) error {
+	plain := map[string]string{}
+	prefixed := map[string]string{}
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(k, EnvPrefix) {
+			prefixed[strings.TrimPrefix(k, EnvPrefix)] = v
+		} else {
+			plain[k] = v
+		}
+	}
+	values := map[string]string{}
+	path, ok := prefixed[configFileKey]
+	if !ok {
+		path = plain[configFileKey]
+	}
+	if path != "" {
+		fileValues, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		for k, v := range fileValues {
+			values[k] = v
+		}
+	}
+	for k, v := range plain {
+		values[k] = v
+	}
+	for k, v := range prefixed {
+		values[k] = v
+	}
+
+	refs, err := resolveSecrets(values)
+	if err != nil {
+		return err
+	}
+
+	parsed := Config
+	reflect.ValueOf(&parsed).Elem().Set(reflect.Zero(reflect.TypeOf(parsed)))
+	if err := validateTypes(reflect.TypeOf(parsed), values); err != nil {
+		return err
+	}
+	if err := env.Parse(&parsed, env.Options{Environment: values}); err != nil {
+		return err
+	}
+	switch parsed.SenderSignature {
+	case "off", "optional", "required":
+	default:
+		return &Error{Key: "SENDER_SIGNATURE", Err: fmt.Errorf("must be one of off, optional, required")}
+	}
+	switch parsed.StorageDownPolicy {
+	case "fail_open", "fail_closed", "live_only", "retry":
+	default:
+		return &Error{Key: "STORAGE_DOWN_POLICY", Err: fmt.Errorf("must be one of fail_open, fail_closed, live_only, retry")}
+	}
+	switch parsed.ReplayOrder {
+	case "oldest_first", "newest_first":
+	default:
+		return &Error{Key: "REPLAY_ORDER", Err: fmt.Errorf("must be one of oldest_first, newest_first")}
+	}
+	switch parsed.DeliveryMode {
+	case "at_least_once", "at_most_once":
+	default:
+		return &Error{Key: "DELIVERY_MODE", Err: fmt.Errorf("must be one of at_least_once, at_most_once")}
+	}
+	if parsed.ReplayOrder == "newest_first" && parsed.DeliveryMode != "at_most_once" {
+		// the client resumes after the last id it got, the oldest written so far, the older ones are never replayed
+		return &Error{Key: "REPLAY_ORDER", Err: fmt.Errorf("newest_first loses messages on a disconnect during the replay, it requires DELIVERY_MODE=at_most_once")}
+	}
+	if parsed.DeliveryMode == "at_most_once" && parsed.DeliveredCacheSize <= 0 {
+		return &Error{Key: "DELIVERED_CACHE_SIZE", Err: fmt.Errorf("must be positive")}
+	}
+	if parsed.TransferedCacheSize <= 0 {
+		return &Error{Key: "TRANSFERED_CACHE_SIZE", Err: fmt.Errorf("must be positive")}
+	}
+	switch parsed.LogIds {
+	case "full", "truncated", "hashed":
+	default:
+		return &Error{Key: "LOG_IDS", Err: fmt.Errorf("must be one of full, truncated, hashed")}
+	}
+	switch parsed.ValkeyMode {
+	case "auto", "standalone", "sentinel", "cluster":
+	default:
+		return &Error{Key: "VALKEY_MODE", Err: fmt.Errorf("must be one of auto, standalone, sentinel, cluster")}
+	}
+	if parsed.ValkeyMode == "sentinel" && parsed.ValkeyMasterName == "" {
+		return &Error{Key: "VALKEY_MASTER_NAME", Err: fmt.Errorf("is required in sentinel mode")}
+	}
+	if parsed.AffinityEventIds && parsed.AffinityBufferSize <= 0 {
+		return &Error{Key: "SSE_AFFINITY_BUFFER", Err: fmt.Errorf("must be positive")}
+	}
+	if parsed.MaxTTL <= 0 {
+		return &Error{Key: "MAX_TTL", Err: fmt.Errorf("must be positive")}
+	}
+	if parsed.ReplayPageSize < 0 {
+		return &Error{Key: "REPLAY_PAGE_SIZE", Err: fmt.Errorf("must not be negative")}
+	}
+	if parsed.TTLJitterPercent < 0 || parsed.TTLJitterPercent > 100 {
+		return &Error{Key: "TTL_JITTER_PERCENT", Err: fmt.Errorf("must be between 0 and 100")}
+	}
+	if parsed.DisconnectTTL < 0 {
+		return &Error{Key: "DISCONNECT_TTL", Err: fmt.Errorf("must not be negative")}
+	}
+	if parsed.DisconnectTTL > 0 && parsed.DisconnectMaxSize <= 0 {
+		return &Error{Key: "DISCONNECT_MAX_SIZE", Err: fmt.Errorf("must be positive")}
+	}
+	if parsed.SideEffectWorkers <= 0 {
+		return &Error{Key: "SIDE_EFFECT_WORKERS", Err: fmt.Errorf("must be positive")}
+	}
+	if parsed.SideEffectQueueSize <= 0 {
+		return &Error{Key: "SIDE_EFFECT_QUEUE_SIZE", Err: fmt.Errorf("must be positive")}
+	}
+	if parsed.SideEffectTimeout <= 0 {
+		return &Error{Key: "SIDE_EFFECT_TIMEOUT_MS", Err: fmt.Errorf("must be positive")}
+	}
+	for _, v := range parsed.WebhookTopicURLs {
+		if topic, url, _ := strings.Cut(v, ":"); topic == "" || url == "" {
+			return &Error{Key: "WEBHOOK_TOPIC_URLS", Err: fmt.Errorf("%q must be a topic and a url, e.g. connect:https://example.com/hook", v)}
+		}
+	}
+	parsed.TopicTTLs = map[string]int{}
+	for _, override := range parsed.TopicMaxTTL {
+		topic, v, _ := strings.Cut(override, ":")
+		ttl, err := strconv.Atoi(v)
+		if topic == "" || err != nil || ttl <= 0 {
+			return &Error{Key: "TOPIC_MAX_TTL", Err: fmt.Errorf("%q must be a topic and a positive ttl, e.g. connect:600", override)}
+		}
+		parsed.TopicTTLs[topic] = ttl
+	}
+	if parsed.DevMode && isProduction(parsed.Environment) {
+		return &Error{Key: "DEV_MODE", Err: fmt.Errorf("can't be enabled in %v environment", parsed.Environment)}
+	}
+	Config = parsed
+	secrets.mu.Lock()
+	secrets.refs, secrets.env = refs, values
+	secrets.values = map[string]string{}
+	for key := range refs {
+		secrets.values[key] = values[key]
+	}
+	secrets.mu.Unlock()
+	return nil
+}
+
+// readFile reads a flat yaml map of configuration keys, with or without the BRIDGE_ prefix
+// and in any case, e.g. "port: 8081". Lists are joined with commas.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("config file %v: %w", path, err)
+	}
+	known := keys(reflect.TypeOf(Config))
+	values := make(map[string]string, len(raw))
+	for k, v := range raw {
+		key := strings.TrimPrefix(strings.ToUpper(k), EnvPrefix)
+		if !known[key] {
+			return nil, &Error{Key: k, Err: fmt.Errorf("unknown key in %v", path)}
+		}
+		switch v := v.(type) {
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, &Error{Key: k, Err: fmt.Errorf("nested values are not supported")}
+		case nil:
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+func keys(t reflect.Type) map[string]bool {
+	known := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("env"); key != "" {
+			known[key] = true
+		}
+	}
+	return known
+}
+
+// validateTypes checks that every value can be parsed into its field
+// so that errors name the key instead of the go field.
+func validateTypes(t reflect.Type, values map[string]string) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := f.Tag.Get("env")
+		v, ok := values[key]
+		if key == "" || !ok {
+			continue
+		}
+		var err error
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int64:
+			_, err = strconv.ParseInt(v, 10, f.Type.Bits())
+		case reflect.Float64:
+			_, err = strconv.ParseFloat(v, 64)
+		case reflect.Bool:
+			_, err = strconv.ParseBool(v)
+		}
+		if err != nil {
+			return &Error{Key: key, Err: fmt.Errorf("invalid %v value %q", f.Type.Kind(), v)}
+		}
+	}
+	return nil
+}
+
+func IsProduction() bool {
+	return isProduction(Config.Environment)
+}
+
+func isProduction(environment string) bool {
+	return environment == "production" || environment == "prod"
+}
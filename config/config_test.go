@@ -0,0 +1,74 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "bridge.yaml")
+	err := os.WriteFile(file, []byte("port: 9000\nheartbeat_interval: 5\nBRIDGE_CORS_ENABLE: true\nrate_limits_by_pass_token:\n  - a\n  - b\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := Config
+	defer func() { Config = prev }()
+
+	err = Load([]string{"CONFIG_FILE=" + file, "HEARTBEAT_INTERVAL=7", "BRIDGE_PORT=9001", "PORT=9002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Config.Port != 9001 {
+		t.Errorf("prefixed env must win, got port %v", Config.Port)
+	}
+	if Config.HeartbeatInterval != 7 {
+		t.Errorf("env must override the file, got heartbeat interval %v", Config.HeartbeatInterval)
+	}
+	if !Config.CorsEnable || len(Config.RateLimitsByPassToken) != 2 {
+		t.Errorf("file values are not applied: %+v", Config)
+	}
+	if Config.ConnectionsLimit != 50 {
+		t.Errorf("defaults must be kept, got connections limit %v", Config.ConnectionsLimit)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "bridge.yaml")
+	if err := os.WriteFile(file, []byte("prot: 9000\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		environ []string
+		key     string
+	}{
+		{name: "bad int", environ: []string{"PORT=http"}, key: "PORT"},
+		{name: "bad prefixed bool", environ: []string{"BRIDGE_CORS_ENABLE=maybe"}, key: "CORS_ENABLE"},
+		{name: "bad enum", environ: []string{"SENDER_SIGNATURE=always"}, key: "SENDER_SIGNATURE"},
+		{name: "bad replay order", environ: []string{"REPLAY_ORDER=random"}, key: "REPLAY_ORDER"},
+		{name: "newest first with at least once", environ: []string{"REPLAY_ORDER=newest_first"}, key: "REPLAY_ORDER"},
+		{name: "bad delivery mode", environ: []string{"DELIVERY_MODE=exactly_once"}, key: "DELIVERY_MODE"},
+		{name: "zero transfered cache", environ: []string{"TRANSFERED_CACHE_SIZE=0"}, key: "TRANSFERED_CACHE_SIZE"},
+		{name: "zero max ttl", environ: []string{"MAX_TTL=0"}, key: "MAX_TTL"},
+		{name: "ttl jitter over 100%", environ: []string{"TTL_JITTER_PERCENT=150"}, key: "TTL_JITTER_PERCENT"},
+		{name: "negative disconnect ttl", environ: []string{"DISCONNECT_TTL=-1"}, key: "DISCONNECT_TTL"},
+		{name: "zero side effect workers", environ: []string{"SIDE_EFFECT_WORKERS=0"}, key: "SIDE_EFFECT_WORKERS"},
+		{name: "negative side effect queue", environ: []string{"SIDE_EFFECT_QUEUE_SIZE=-1"}, key: "SIDE_EFFECT_QUEUE_SIZE"},
+		{name: "zero side effect timeout", environ: []string{"SIDE_EFFECT_TIMEOUT_MS=0"}, key: "SIDE_EFFECT_TIMEOUT_MS"},
+		{name: "negative topic ttl", environ: []string{"TOPIC_MAX_TTL=connect:-1"}, key: "TOPIC_MAX_TTL"},
+		{name: "unknown file key", environ: []string{"CONFIG_FILE=" + file}, key: "prot"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfgErr *Error
+			err := Load(tt.environ)
+			if !errors.As(err, &cfgErr) || cfgErr.Key != tt.key {
+				t.Fatalf("want error for key %v, got %v", tt.key, err)
+			}
+		})
+	}
+}
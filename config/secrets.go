@@ -0,0 +1,389 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretKeys may hold a reference to a secret manager instead of the value:
+//   - vault://<path>#<field> reads a KV secret from VAULT_ADDR with VAULT_TOKEN,
+//   - awssm://<secret id>[#<json field>] reads from AWS Secrets Manager in AWS_REGION,
+//     with AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or the container or instance role,
+//   - gcpsm://projects/<project>/secrets/<name>/versions/<version>[#<json field>] reads from GCP Secret Manager
+//     with GCP_ACCESS_TOKEN or the token of the instance service account.
+var secretKeys = []string{"POSTGRES_URI", "VALKEY_URI", "WEBHOOK_SECRET", "ADMIN_TOKEN"}
+
+// secretTimeout limits fetching a single secret.
+const secretTimeout = 10 * time.Second
+
+// gcpSecretManagerURL, gcpMetadataURL, awsContainerCredentialsURL and awsMetadataURL are variables to be replaced in tests.
+var (
+	gcpSecretManagerURL        = "https://secretmanager.googleapis.com/v1/"
+	gcpMetadataURL             = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	awsContainerCredentialsURL = "http://169.254.170.2"
+	awsMetadataURL             = "http://169.254.169.254/latest"
+)
+
+// secrets remembers the references resolved by the last Load for WatchSecrets.
+var secrets struct {
+	mu     sync.Mutex
+	refs   map[string]string
+	values map[string]string
+	env    map[string]string
+}
+
+// resolveSecrets replaces references in values with the secrets and returns the references by key.
+func resolveSecrets(values map[string]string) (map[string]string, error) {
+	refs := map[string]string{}
+	for _, key := range secretKeys {
+		ref, ok := values[key]
+		if !ok || !isSecretRef(ref) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+		v, err := fetchSecret(ctx, ref, values)
+		cancel()
+		if err != nil {
+			return nil, &Error{Key: key, Err: err}
+		}
+		values[key] = v
+		refs[key] = ref
+	}
+	return refs, nil
+}
+
+func isSecretRef(v string) bool {
+	for _, scheme := range []string{"vault://", "awssm://", "gcpsm://"} {
+		if strings.HasPrefix(v, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchSecret reads the secret ref points at, env holds the credentials of the secret managers.
+func fetchSecret(ctx context.Context, ref string, env map[string]string) (string, error) {
+	scheme, rest, _ := strings.Cut(ref, "://")
+	name, field, _ := strings.Cut(rest, "#")
+	switch scheme {
+	case "vault":
+		if field == "" {
+			return "", fmt.Errorf("%v: a #field is required", ref)
+		}
+		return fetchVault(ctx, name, field, env)
+	case "awssm":
+		v, err := fetchAWS(ctx, name, env)
+		if err != nil {
+			return "", err
+		}
+		return secretField(v, field)
+	case "gcpsm":
+		v, err := fetchGCP(ctx, name, env)
+		if err != nil {
+			return "", err
+		}
+		return secretField(v, field)
+	}
+	return "", fmt.Errorf("unknown secret manager %q", scheme)
+}
+
+// secretField returns field of a json object secret, or the whole secret if field is empty.
+func secretField(secret, field string) (string, error) {
+	if field == "" {
+		return secret, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret with a #field must be a json object: %w", err)
+	}
+	v, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("no field %q in the secret", field)
+	}
+	return fmt.Sprint(v), nil
+}
+
+func fetchVault(ctx context.Context, path, field string, env map[string]string) (string, error) {
+	addr := env["VAULT_ADDR"]
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", env["VAULT_TOKEN"])
+	var res struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := doSecretRequest(req, &res); err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	data := res.Data
+	// KV version 2 nests the secret and its metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	v, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("vault: no field %q in %v", field, path)
+	}
+	return fmt.Sprint(v), nil
+}
+
+func fetchAWS(ctx context.Context, secretId string, env map[string]string) (string, error) {
+	region := env["AWS_REGION"]
+	if region == "" {
+		return "", fmt.Errorf("AWS_REGION is not set")
+	}
+	endpoint := env["AWS_ENDPOINT_URL"]
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%v.amazonaws.com", region)
+	}
+	body, _ := json.Marshal(map[string]string{"SecretId": secretId})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	creds, err := awsCredentials(ctx, env)
+	if err != nil {
+		return "", fmt.Errorf("aws credentials: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWS(req, body, region, "secretsmanager", creds.AccessKeyId, creds.SecretAccessKey, creds.Token, time.Now())
+	var res struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := doSecretRequest(req, &res); err != nil {
+		return "", fmt.Errorf("aws secrets manager: %w", err)
+	}
+	return res.SecretString, nil
+}
+
+type awsCredentialsResponse struct {
+	AccessKeyId     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// awsCredentials returns the static keys from env if they are set, otherwise the credentials of the container role
+// (ECS task roles and EKS Pod Identity) or of the EC2 instance role through IMDSv2.
+// Web identity (IRSA) credentials aren't supported.
+func awsCredentials(ctx context.Context, env map[string]string) (awsCredentialsResponse, error) {
+	if env["AWS_ACCESS_KEY_ID"] != "" {
+		return awsCredentialsResponse{
+			AccessKeyId:     env["AWS_ACCESS_KEY_ID"],
+			SecretAccessKey: env["AWS_SECRET_ACCESS_KEY"],
+			Token:           env["AWS_SESSION_TOKEN"],
+		}, nil
+	}
+	var creds awsCredentialsResponse
+	if uri := env["AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"]; uri != "" || env["AWS_CONTAINER_CREDENTIALS_FULL_URI"] != "" {
+		url := awsContainerCredentialsURL + uri
+		if uri == "" {
+			url = env["AWS_CONTAINER_CREDENTIALS_FULL_URI"]
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return creds, err
+		}
+		token := env["AWS_CONTAINER_AUTHORIZATION_TOKEN"]
+		if file := env["AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"]; file != "" {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				return creds, err
+			}
+			token = strings.TrimSpace(string(b))
+		}
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		if err := doSecretRequest(req, &creds); err != nil {
+			return creds, fmt.Errorf("container: %w", err)
+		}
+		return creds, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, awsMetadataURL+"/api/token", nil)
+	if err != nil {
+		return creds, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := doMetadataRequest(req)
+	if err != nil {
+		return creds, fmt.Errorf("instance metadata token: %w", err)
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, awsMetadataURL+"/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return creds, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	roles, err := doMetadataRequest(req)
+	if err != nil {
+		return creds, fmt.Errorf("instance role: %w", err)
+	}
+	role, _, _ := strings.Cut(roles, "\n")
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, awsMetadataURL+"/meta-data/iam/security-credentials/"+role, nil)
+	if err != nil {
+		return creds, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	if err := doSecretRequest(req, &creds); err != nil {
+		return creds, fmt.Errorf("instance role %v: %w", role, err)
+	}
+	return creds, nil
+}
+
+// signAWS signs req with AWS Signature Version 4.
+func signAWS(req *http.Request, body []byte, region, service, keyId, secret, token string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	headers := []string{"content-type", "host", "x-amz-date", "x-amz-target"}
+	if token != "" {
+		headers = append(headers, "x-amz-security-token")
+		sort.Strings(headers)
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{req.Method, "/", req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(bodyHash[:])}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", keyId, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func fetchGCP(ctx context.Context, name string, env map[string]string) (string, error) {
+	token := env["GCP_ACCESS_TOKEN"]
+	if token == "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataURL, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		var res struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := doSecretRequest(req, &res); err != nil {
+			return "", fmt.Errorf("gcp metadata token: %w", err)
+		}
+		token = res.AccessToken
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpSecretManagerURL+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var res struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := doSecretRequest(req, &res); err != nil {
+		return "", fmt.Errorf("gcp secret manager: %w", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(res.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("gcp secret manager: %w", err)
+	}
+	return string(data), nil
+}
+
+func doSecretRequest(req *http.Request, v interface{}) error {
+	body, err := readSecretResponse(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// doMetadataRequest returns the plain text body of an instance metadata response.
+func doMetadataRequest(req *http.Request) (string, error) {
+	body, err := readSecretResponse(req)
+	return strings.TrimSpace(string(body)), err
+}
+
+func readSecretResponse(req *http.Request) ([]byte, error) {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		// the body of an error names the problem and never carries the secret
+		return nil, fmt.Errorf("bad status code %v: %s", res.StatusCode, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+// WatchSecrets fetches the secrets referenced in the configuration every interval
+// and calls apply with the keys whose values changed. Config itself is not updated.
+func WatchSecrets(interval time.Duration, apply func(key, value string)) {
+	for {
+		time.Sleep(interval)
+		for key, value := range refreshSecrets() {
+			apply(key, value)
+		}
+	}
+}
+
+// refreshSecrets returns the secrets that changed since the last call, failures are logged and retried later.
+func refreshSecrets() map[string]string {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	changed := map[string]string{}
+	for key, ref := range secrets.refs {
+		ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+		v, err := fetchSecret(ctx, ref, secrets.env)
+		cancel()
+		if err != nil {
+			log.Printf("refresh %v from %v: %v", key, ref, err)
+			continue
+		}
+		if v != secrets.values[key] {
+			secrets.values[key] = v
+			changed[key] = v
+		}
+	}
+	return changed
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoad_Secrets(t *testing.T) {
+	password := "first"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/secret/data/bridge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": map[string]string{"postgres_uri": "postgres://bridge:" + password + "@db/bridge"}}})
+	})
+	mux.HandleFunc("/aws/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"SecretString": `{"webhook":"aws-secret"}`})
+	})
+	mux.HandleFunc("/gcp/projects/p/secrets/admin/versions/latest:access", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gcp-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"payload":{"data":"` + base64.StdEncoding.EncodeToString([]byte("gcp-secret")) + `"}}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	prevGCP := gcpSecretManagerURL
+	gcpSecretManagerURL = srv.URL + "/gcp/"
+	prev := Config
+	defer func() { Config, gcpSecretManagerURL = prev, prevGCP }()
+
+	err := Load([]string{
+		"VAULT_ADDR=" + srv.URL, "VAULT_TOKEN=vault-token", "POSTGRES_URI=vault://secret/data/bridge#postgres_uri",
+		"AWS_REGION=eu-west-1", "AWS_ENDPOINT_URL=" + srv.URL + "/aws", "AWS_ACCESS_KEY_ID=key", "AWS_SECRET_ACCESS_KEY=secret",
+		"WEBHOOK_SECRET=awssm://bridge#webhook",
+		"GCP_ACCESS_TOKEN=gcp-token", "ADMIN_TOKEN=gcpsm://projects/p/secrets/admin/versions/latest",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Config.DbURI != "postgres://bridge:first@db/bridge" || Config.WebhookSecret != "aws-secret" || Config.AdminToken != "gcp-secret" {
+		t.Fatalf("secrets are not resolved: %q %q %q", Config.DbURI, Config.WebhookSecret, Config.AdminToken)
+	}
+
+	if changed := refreshSecrets(); len(changed) != 0 {
+		t.Fatalf("nothing was rotated, got %v", changed)
+	}
+	password = "second"
+	changed := refreshSecrets()
+	if len(changed) != 1 || changed["POSTGRES_URI"] != "postgres://bridge:second@db/bridge" {
+		t.Fatalf("want the rotated postgres uri, got %v", changed)
+	}
+
+	var cfgErr *Error
+	err = Load([]string{"VAULT_ADDR=" + srv.URL, "VAULT_TOKEN=wrong", "POSTGRES_URI=vault://secret/data/bridge#postgres_uri"})
+	if !errors.As(err, &cfgErr) || cfgErr.Key != "POSTGRES_URI" {
+		t.Fatalf("want an error for POSTGRES_URI, got %v", err)
+	}
+}
+
+func TestFetchAWS_RoleCredentials(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/aws/", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=role-key/") || r.Header.Get("X-Amz-Security-Token") != "role-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"SecretString": "aws-secret"})
+	})
+	credentials := map[string]string{"AccessKeyId": "role-key", "SecretAccessKey": "role-secret", "Token": "role-token"}
+	mux.HandleFunc("/v2/credentials/task", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(credentials)
+	})
+	mux.HandleFunc("/pod", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "pod-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(credentials)
+	})
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Write([]byte("imds-token"))
+	})
+	mux.HandleFunc("/latest/meta-data/iam/security-credentials/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-aws-ec2-metadata-token") != "imds-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") {
+			w.Write([]byte("bridge-role\n"))
+			return
+		}
+		if !strings.HasSuffix(r.URL.Path, "/bridge-role") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(credentials)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	defer func(container, metadata string) {
+		awsContainerCredentialsURL, awsMetadataURL = container, metadata
+	}(awsContainerCredentialsURL, awsMetadataURL)
+	awsContainerCredentialsURL, awsMetadataURL = srv.URL, srv.URL+"/latest"
+
+	for name, env := range map[string]map[string]string{
+		"container": {"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/credentials/task"},
+		"pod identity": {
+			"AWS_CONTAINER_CREDENTIALS_FULL_URI": srv.URL + "/pod",
+			"AWS_CONTAINER_AUTHORIZATION_TOKEN":  "pod-token",
+		},
+		"instance": {},
+	} {
+		env["AWS_REGION"], env["AWS_ENDPOINT_URL"] = "eu-west-1", srv.URL+"/aws"
+		v, err := fetchAWS(context.Background(), "bridge", env)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if v != "aws-secret" {
+			t.Fatalf("%v: got %q", name, v)
+		}
+	}
+}
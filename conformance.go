@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/config"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+// conformanceHeader carries conformanceToken on the requests of the conformance checks and the self test,
+// SendMessageHandler skips the side effects of their messages: webhooks, copies, audit records, digests
+// and relaying to the other instances.
+const conformanceHeader = "X-Bridge-Conformance"
+
+// conformanceToken is random, so outside requests can't pass for conformance checks.
+var conformanceToken = newTraceId()
+
+// isConformanceRequest reports whether r was made by the conformance checks of this instance.
+func isConformanceRequest(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(conformanceHeader)), []byte(conformanceToken)) == 1
+}
+
+type syntheticContextKey struct{}
+
+// withSynthetic marks the messages dispatched with ctx as synthetic, they aren't relayed to the other instances.
+func withSynthetic(ctx context.Context) context.Context {
+	return context.WithValue(ctx, syntheticContextKey{}, true)
+}
+
+func isSynthetic(ctx context.Context) bool {
+	synthetic, _ := ctx.Value(syntheticContextKey{}).(bool)
+	return synthetic
+}
+
+// errConformanceSkipped is returned by checks of features disabled on the instance.
+var errConformanceSkipped = errors.New("skipped")
+
+type conformanceCheck struct {
+	Name string
+	Run  func(ctx context.Context, url string) error
+}
+
+// conformanceChecks exercise the guarantees a bridge gives to wallets and dapps through the public api.
+var conformanceChecks = []conformanceCheck{
+	{Name: "delivery", Run: conformanceDelivery},
+	{Name: "sse_resume", Run: conformanceResume},
+	{Name: "ordering", Run: conformanceOrdering},
+	{Name: "ttl", Run: conformanceTTL},
+	{Name: "verify", Run: conformanceVerify},
+}
+
+type conformanceReport struct {
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt time.Time        `json:"finished_at"`
+	Passed     bool             `json:"passed"`
+	Checks     []selfTestResult `json:"checks"`
+}
+
+// conformanceResults keeps the report of the last conformance run.
+type conformanceResults struct {
+	mu   sync.Mutex
+	last *conformanceReport
+}
+
+func (r *conformanceResults) Set(report conformanceReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last = &report
+}
+
+func (r *conformanceResults) Last() *conformanceReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// conformanceWorker runs the conformance checks against h right away and then every interval.
+func (h *handler) conformanceWorker(interval time.Duration) {
+	for {
+		report := h.runConformance()
+		if !report.Passed {
+			log.WithField("prefix", "conformanceWorker").Warnf("conformance checks failed: %+v", report.Checks)
+		}
+		h.conformance.Set(report)
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// runConformance serves the handlers of h on a local listener without limiters and runs every check against it.
+func (h *handler) runConformance() conformanceReport {
+	e := echo.New()
+	registerHandlers(e, h)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	report := conformanceReport{StartedAt: time.Now(), Passed: true, Checks: make([]selfTestResult, 0, len(conformanceChecks))}
+	for _, check := range conformanceChecks {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		start := time.Now()
+		err := check.Run(ctx, srv.URL)
+		cancel()
+		res := selfTestResult{Name: check.Name, Passed: err == nil, Duration: time.Since(start)}
+		switch {
+		case errors.Is(err, errConformanceSkipped):
+			res.Passed, res.Skipped = true, true
+		case err != nil:
+			res.Error = err.Error()
+			report.Passed = false
+		}
+		report.Checks = append(report.Checks, res)
+	}
+	report.FinishedAt = time.Now()
+	return report
+}
+
+// ConformanceHandler returns the report of the last conformance run.
+func (h *handler) ConformanceHandler(c echo.Context) error {
+	if h.conformance == nil {
+		return c.JSON(HttpResError("conformance checks are disabled", http.StatusNotFound))
+	}
+	report := h.conformance.Last()
+	if report == nil {
+		return c.JSON(HttpResError("conformance checks haven't finished yet", http.StatusServiceUnavailable))
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+type conformanceEvent struct {
+	name string
+	id   int64
+	data string
+}
+
+// conformanceSend posts body from "from" to "to" and fails on any status but 200.
+func conformanceSend(ctx context.Context, url, from, to string, ttl int, body string, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		fmt.Sprintf("%v/bridge/message?client_id=%v&to=%v&ttl=%v", url, from, to, ttl), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set(conformanceHeader, conformanceToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("send: bad status code %v", res.StatusCode)
+	}
+	return nil
+}
+
+// conformanceSubscribe opens a stream for clientId, the subscription is registered once it returns.
+func conformanceSubscribe(ctx context.Context, url, clientId string, lastEventId int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/bridge/events?client_id="+clientId, nil)
+	if err != nil {
+		return nil, err
+	}
+	if lastEventId > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(lastEventId, 10))
+	}
+	req.Header.Set(conformanceHeader, conformanceToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("subscribe: bad status code %v", res.StatusCode)
+	}
+	return res, nil
+}
+
+// readConformanceEvents reads message events from an SSE stream until n are read.
+// A message sent right after subscribing may come both live and from the storage replay, repeats are skipped.
+func readConformanceEvents(r io.Reader, n int) ([]conformanceEvent, error) {
+	var events []conformanceEvent
+	var e conformanceEvent
+	seen := map[int64]bool{}
+	scanner := bufio.NewScanner(r)
+	for len(events) < n && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if e.name == "message" && !seen[e.id] {
+				seen[e.id] = true
+				events = append(events, e)
+			}
+			e = conformanceEvent{}
+		case strings.HasPrefix(line, "event: "):
+			e.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "id: "):
+			e.id, _, _ = parseEventId(strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	if len(events) < n {
+		if err := scanner.Err(); err != nil {
+			return events, err
+		}
+		return events, fmt.Errorf("stream closed after %v of %v messages", len(events), n)
+	}
+	return events, nil
+}
+
+func conformanceMessage(data string) (datatype.BridgeMessage, error) {
+	var msg datatype.BridgeMessage
+	err := json.Unmarshal([]byte(data), &msg)
+	return msg, err
+}
+
+func conformanceClients() (sender, receiver string) {
+	return "conformance-" + newTraceId(), "conformance-" + newTraceId()
+}
+
+// conformanceLive subscribes receiver, sends bodies to it and returns the first n messages of the stream.
+func conformanceLive(ctx context.Context, url, sender, receiver string, lastEventId int64, n int, bodies []string, header http.Header) ([]conformanceEvent, error) {
+	res, err := conformanceSubscribe(ctx, url, receiver, lastEventId)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	for _, body := range bodies {
+		if err := conformanceSend(ctx, url, sender, receiver, 60, body, header); err != nil {
+			return nil, err
+		}
+	}
+	events, err := readConformanceEvents(res.Body, n)
+	if err != nil {
+		return nil, fmt.Errorf("read stream: %w", err)
+	}
+	return events, nil
+}
+
+// conformanceDelivery checks that a message reaches a connected receiver.
+func conformanceDelivery(ctx context.Context, url string) error {
+	sender, receiver := conformanceClients()
+	events, err := conformanceLive(ctx, url, sender, receiver, 0, 1, []string{"delivery"}, nil)
+	if err != nil {
+		return err
+	}
+	if msg, err := conformanceMessage(events[0].data); err != nil || msg.From != sender || msg.Message != "delivery" {
+		return fmt.Errorf("unexpected message %q", events[0].data)
+	}
+	return nil
+}
+
+// conformanceResume checks that reconnecting with Last-Event-ID replays only the messages after it.
+func conformanceResume(ctx context.Context, url string) error {
+	sender, receiver := conformanceClients()
+	events, err := conformanceLive(ctx, url, sender, receiver, 0, 2, []string{"first", "second"}, nil)
+	if err != nil {
+		return err
+	}
+	lastEventId := events[0].id
+	// messages may be stored in the background, give the storage a moment
+	for {
+		attempt, cancel := context.WithTimeout(ctx, time.Second)
+		events, err = conformanceLive(attempt, url, sender, receiver, lastEventId, 1, nil, nil)
+		cancel()
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("no replay after Last-Event-ID: %w", err)
+		}
+	}
+	if msg, err := conformanceMessage(events[0].data); err != nil || msg.Message != "second" {
+		return fmt.Errorf("want the second message after Last-Event-ID, got %q", events[0].data)
+	}
+	return nil
+}
+
+// conformanceOrdering checks that messages come in the order they were sent with increasing ids.
+func conformanceOrdering(ctx context.Context, url string) error {
+	bodies := []string{"0", "1", "2", "3", "4"}
+	sender, receiver := conformanceClients()
+	events, err := conformanceLive(ctx, url, sender, receiver, 0, len(bodies), bodies, nil)
+	if err != nil {
+		return err
+	}
+	for i, e := range events {
+		if msg, err := conformanceMessage(e.data); err != nil || msg.Message != bodies[i] {
+			return fmt.Errorf("message %v is out of order: %q", i, e.data)
+		}
+		if i > 0 && e.id <= events[i-1].id {
+			return fmt.Errorf("event id %v is not greater than the previous %v", e.id, events[i-1].id)
+		}
+	}
+	return nil
+}
+
+// conformanceTTL checks that an expired message is not replayed.
+func conformanceTTL(ctx context.Context, url string) error {
+	sender, receiver := conformanceClients()
+	if err := conformanceSend(ctx, url, sender, receiver, 1, "expired", nil); err != nil {
+		return err
+	}
+	// the message may be stored a little longer with TTL_JITTER_PERCENT
+	select {
+	case <-time.After(time.Duration(2+maxTTLJitter(1)) * time.Second):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	events, err := conformanceLive(ctx, url, sender, receiver, 0, 1, []string{"alive"}, nil)
+	if err != nil {
+		return err
+	}
+	if msg, err := conformanceMessage(events[0].data); err != nil || msg.Message != "alive" {
+		return fmt.Errorf("expired message is replayed: %q", events[0].data)
+	}
+	return nil
+}
+
+// conformanceVerify checks that messages signed by the sender are delivered as verified.
+func conformanceVerify(ctx context.Context, url string) error {
+	if config.Config.SenderSignature == senderSignatureOff || config.Config.SenderSignature == "" {
+		return errConformanceSkipped
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	sender, receiver := hex.EncodeToString(pub), "conformance-"+newTraceId()
+	signature := ed25519.Sign(priv, senderSignaturePayload(receiver, "60", []byte("verify")))
+	header := http.Header{"X-Signature": []string{hex.EncodeToString(signature)}}
+	events, err := conformanceLive(ctx, url, sender, receiver, 0, 1, []string{"verify"}, header)
+	if err != nil {
+		return err
+	}
+	if msg, err := conformanceMessage(events[0].data); err != nil || !msg.SenderVerified {
+		return fmt.Errorf("signed message is not verified: %q", events[0].data)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/config"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestRunConformance(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	report := h.runConformance()
+	if !report.Passed {
+		t.Fatalf("conformance checks failed: %+v", report.Checks)
+	}
+	for _, check := range report.Checks {
+		if check.Name == "verify" && !check.Skipped {
+			t.Fatalf("verify must be skipped without sender signatures: %+v", check)
+		}
+	}
+
+	h.conformance = &conformanceResults{}
+	h.conformance.Set(report)
+	rec := httptest.NewRecorder()
+	if err := h.ConformanceHandler(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/bridge/conformance", nil), rec)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %v", rec.Code)
+	}
+}
+
+func TestConformanceRequest_NoSideEffects(t *testing.T) {
+	defer func(u string) { config.Config.CopyToURL = u }(config.Config.CopyToURL)
+	config.Config.CopyToURL = "http://copies.example.com/copy"
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	// without workers the submitted copies stay in the queue
+	h.copyPool.Close()
+	h.copyPool = newWorkerPool("copy", 0, 10, dropWhenFull)
+	h.digests = newPendingDigests(time.Minute)
+	e := echo.New()
+	registerHandlers(e, h)
+	send := func(header string) {
+		req := httptest.NewRequest(http.MethodPost, "/bridge/message?client_id=dapp&to=wallet&ttl=60", strings.NewReader("message"))
+		if header != "" {
+			req.Header.Set(conformanceHeader, header)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("want 200, got %v", rec.Code)
+		}
+	}
+
+	send(conformanceToken)
+	if len(h.copyPool.queue) != 0 || len(h.digests.clients) != 0 {
+		t.Fatal("conformance message has side effects")
+	}
+	send("guess")
+	if len(h.copyPool.queue) != 1 || len(h.digests.clients) != 1 {
+		t.Fatal("want the side effects of a message with a wrong token")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var consumedMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "number_of_consumed_messages",
+	Help: "The total number of messages removed from storage on delivery in consume-on-read mode",
+})
+
+// messageRemover is implemented by storages supporting consume-on-read mode.
+type messageRemover interface {
+	Remove(ctx context.Context, key string, eventId int64) error
+}
+
+type consumedKey struct {
+	clientId string
+	eventId  int64
+}
+
+// consumedMessages remembers messages delivered in consume-on-read mode,
+// so a message delivered before the storage write finished is removed right after the write.
+type consumedMessages struct {
+	mu    sync.Mutex
+	items map[consumedKey]time.Time
+}
+
+func newConsumedMessages(ttl time.Duration) *consumedMessages {
+	c := &consumedMessages{items: map[consumedKey]time.Time{}}
+	return c
+}
+
+func (c *consumedMessages) Add(clientId string, eventId int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items[consumedKey{clientId, eventId}] = time.Now()
+}
+
+// Take reports whether the message was consumed and forgets it.
+func (c *consumedMessages) Take(clientId string, eventId int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := consumedKey{clientId, eventId}
+	_, ok := c.items[key]
+	delete(c.items, key)
+	return ok
+}
+
+// watcher forgets messages that outlived any possible ttl.
+func (c *consumedMessages) watcher(ttl time.Duration, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Minute):
+		}
+		expireBefore := time.Now().Add(-ttl)
+		c.mu.Lock()
+		for key, at := range c.items {
+			if at.Before(expireBefore) {
+				delete(c.items, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// consume removes a delivered message from storage in consume-on-read mode.
+func (h *handler) consume(clientId string, eventId int64) {
+	if h.remover == nil || clientId == "" {
+		return
+	}
+	h.consumed.Add(clientId, eventId)
+	if h.recent != nil {
+		h.recent.Remove(clientId, eventId)
+	}
+	h.storagePool.Submit(func() {
+		h.removeMessage(clientId, eventId)
+	})
+}
+
+func (h *handler) removeMessage(clientId string, eventId int64) {
+	if err := h.remover.Remove(context.Background(), clientId, eventId); err != nil {
+		log.WithField("prefix", "consume").Errorf("remove %v: %v", eventId, err)
+		return
+	}
+	consumedMessagesMetric.Inc()
+}
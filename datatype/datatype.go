@@ -1,11 +1,49 @@
 package datatype
 
+import "time"
+
 type SseMessage struct {
 	EventId int64
 	Message []byte
+	// To is the client_id the message is addressed to.
+	To string
 }
 
 type BridgeMessage struct {
 	From    string `json:"from"`
 	Message string `json:"message"`
+	// SenderVerified is set when the sender proved ownership of From with a signature.
+	SenderVerified bool `json:"sender_verified,omitempty"`
+	// Meta holds annotations added by message hooks.
+	Meta map[string]string `json:"meta,omitempty"`
+	// RequestSource is the sender's BridgeRequestSource sealed to the recipient's client id, base64 encoded.
+	RequestSource string `json:"request_source,omitempty"`
+	// Receipt is set in the messages the bridge sends back to senders that asked for delivery receipts.
+	Receipt *DeliveryReceipt `json:"receipt,omitempty"`
+}
+
+// DeliveryReceipt tells that the message EventId was written to a stream of its recipient at DeliveredAt, unix milliseconds.
+type DeliveryReceipt struct {
+	EventId     int64 `json:"event_id"`
+	DeliveredAt int64 `json:"delivered_at"`
+}
+
+// BridgeRequestSource describes the request a message was sent with.
+type BridgeRequestSource struct {
+	Origin    string `json:"origin"`
+	IP        string `json:"ip"`
+	Time      int64  `json:"time"`
+	UserAgent string `json:"user_agent"`
+}
+
+// AuditRecord is the metadata of a transferred message kept for compliance investigations.
+// It never contains the payload or raw client ids.
+type AuditRecord struct {
+	EventId   int64     `json:"event_id"`
+	FromHash  string    `json:"from_hash"`
+	ToHash    string    `json:"to_hash"`
+	Topic     string    `json:"topic,omitempty"`
+	Size      int       `json:"size"`
+	TTL       int64     `json:"ttl"`
+	CreatedAt time.Time `json:"created_at"`
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var writeTimeoutsMetric = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "number_of_write_timeouts",
+	Help: "The total number of streams closed because writing an event took longer than SSE_WRITE_TIMEOUT_MS",
+})
+
+// errWriteTimeout is returned when an event isn't written to a stalled client before the write deadline.
+var errWriteTimeout = errors.New("write deadline exceeded")
+
+type connContextKey struct{}
+
+// withConn is used as http.Server.ConnContext, it makes the connection of a request available to handlers.
+// http.ResponseController isn't available before go 1.20.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// writeDeadline limits how long writing and flushing a single event to a stream may take,
+// so a client that stopped reading doesn't block the delivery goroutine until the kernel gives up.
+type writeDeadline struct {
+	conn     net.Conn
+	timeout  time.Duration
+	deadline time.Time
+}
+
+// newWriteDeadline returns nil if timeout is 0 or the connection of r isn't known.
+// HTTP/2 connections are shared by several streams and are never given a deadline.
+func newWriteDeadline(r *http.Request, timeout time.Duration) *writeDeadline {
+	conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+	if !ok || timeout <= 0 || r.ProtoMajor != 1 {
+		return nil
+	}
+	return &writeDeadline{conn: conn, timeout: timeout}
+}
+
+// Begin sets the deadline for the next event.
+func (d *writeDeadline) Begin() {
+	if d == nil {
+		return
+	}
+	d.deadline = time.Now().Add(d.timeout)
+	d.conn.SetWriteDeadline(d.deadline)
+}
+
+// End clears the deadline and returns errWriteTimeout if it was reached.
+// Flush doesn't return errors, a failed write is only noticed by the time it took.
+func (d *writeDeadline) End() error {
+	if d == nil {
+		return nil
+	}
+	d.conn.SetWriteDeadline(time.Time{})
+	if !time.Now().Before(d.deadline) {
+		return errWriteTimeout
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestWriteDeadline(t *testing.T) {
+	// writes to a pipe block until the other end reads, like writes to a stalled client
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	r := httptest.NewRequest(http.MethodGet, "/bridge/events", nil)
+	if d := newWriteDeadline(r, time.Second); d != nil {
+		t.Fatal("want no deadline without a known connection")
+	}
+	r = r.WithContext(withConn(r.Context(), server))
+	if d := newWriteDeadline(r, 0); d != nil {
+		t.Fatal("want no deadline with a zero timeout")
+	}
+	d := newWriteDeadline(r, 50*time.Millisecond)
+
+	go client.Read(make([]byte, 5))
+	d.Begin()
+	if _, err := server.Write([]byte("ready")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.End(); err != nil {
+		t.Fatalf("want no timeout for a reading client, got %v", err)
+	}
+
+	before := counterValue(writeTimeoutsMetric)
+	d.Begin()
+	_, err := server.Write([]byte("stalled"))
+	if err == nil {
+		t.Fatal("want the write to a stalled client to fail")
+	}
+	timeout := d.End()
+	if !errors.Is(timeout, errWriteTimeout) {
+		t.Fatalf("want errWriteTimeout, got %v", timeout)
+	}
+	if reason := writeCloseReason(timeout); reason != closeReasonWriteTimeout {
+		t.Fatalf("want %v, got %v", closeReasonWriteTimeout, reason)
+	}
+	if got := counterValue(writeTimeoutsMetric) - before; got != 1 {
+		t.Fatalf("want 1 write timeout, got %v", got)
+	}
+	if reason := writeCloseReason(err); reason != closeReasonWriteError {
+		t.Fatalf("want %v, got %v", closeReasonWriteError, reason)
+	}
+}
+
+// connWriter is a response writer on top of a connection.
+type connWriter struct {
+	net.Conn
+	header http.Header
+}
+
+func (w connWriter) Header() http.Header { return w.header }
+func (w connWriter) WriteHeader(int)     {}
+func (w connWriter) Flush()              {}
+
+type slowDeliverHook struct {
+	delay time.Duration
+}
+
+func (slowDeliverHook) OnSend(ctx context.Context, msg *datatype.BridgeMessage) error {
+	return nil
+}
+
+func (h slowDeliverHook) OnDeliver(ctx context.Context, msg *datatype.SseMessage) error {
+	time.Sleep(h.delay)
+	return nil
+}
+
+func TestDeliver_DeadlineOnlyCoversWrites(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	r := httptest.NewRequest(http.MethodGet, "/bridge/events", nil)
+	deadline := newWriteDeadline(r.WithContext(withConn(r.Context(), server)), 50*time.Millisecond)
+
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	// the hook takes longer than the write timeout, but the client reads every event at once
+	h.hooks = &messageHooks{hooks: []namedHook{{name: "slow", hook: slowDeliverHook{delay: 100 * time.Millisecond}}}, timeout: time.Second}
+	session := NewSession(h.storage, []string{"wallet"}, 0)
+	res := echo.NewResponse(connWriter{Conn: server, header: http.Header{}}, echo.New())
+	msg := datatype.SseMessage{EventId: h.nextID(), Message: []byte("m"), To: "wallet"}
+	if err := h.deliver(context.Background(), res, deadline, session, "wallet", []datatype.SseMessage{msg}); err != nil {
+		t.Fatalf("want the slow hook to be outside of the write deadline, got %v", err)
+	}
+}
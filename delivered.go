@@ -0,0 +1,81 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+var suppressedDuplicatesMetric = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "number_of_suppressed_duplicates",
+	Help: "The total number of messages not written to a stream because another stream of the client already got them",
+})
+
+// Delivery modes, see DELIVERY_MODE.
+const (
+	// deliveryAtLeastOnce writes a message to every stream of its client id and replays it until its ttl expires.
+	deliveryAtLeastOnce = "at_least_once"
+	// deliveryAtMostOnce writes a message to a single stream of its client id, a write that fails isn't repeated.
+	deliveryAtMostOnce = "at_most_once"
+)
+
+type deliveredKey struct {
+	clientId string
+	eventId  int64
+}
+
+// deliveredMessages is an LRU of the messages recently written to any stream, shared by the sessions
+// of all client ids, so in at-most-once mode a message isn't written to two streams of the same client.
+type deliveredMessages struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[deliveredKey]*list.Element
+}
+
+func newDeliveredMessages(size int) *deliveredMessages {
+	return &deliveredMessages{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[deliveredKey]*list.Element, size),
+	}
+}
+
+// Mark remembers the message and reports whether it is new, i.e. may be written.
+// It is marked before the write, a message whose write failed isn't written again.
+func (d *deliveredMessages) Mark(clientId string, eventId int64) bool {
+	k := deliveredKey{clientId: clientId, eventId: eventId}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.items[k]; ok {
+		d.ll.MoveToFront(e)
+		return false
+	}
+	d.items[k] = d.ll.PushFront(k)
+	if d.ll.Len() > d.size {
+		oldest := d.ll.Back()
+		d.ll.Remove(oldest)
+		delete(d.items, oldest.Value.(deliveredKey))
+	}
+	return true
+}
+
+// suppressDuplicates drops from batch the messages another stream has already got.
+// A nil *deliveredMessages, in at-least-once mode, keeps them all.
+func (d *deliveredMessages) suppressDuplicates(batch []datatype.SseMessage) []datatype.SseMessage {
+	if d == nil {
+		return batch
+	}
+	left := batch[:0]
+	for _, msg := range batch {
+		if msg.EventId != queueDoneEventId && !d.Mark(msg.To, msg.EventId) {
+			suppressedDuplicatesMetric.Inc()
+			continue
+		}
+		left = append(left, msg)
+	}
+	return left
+}
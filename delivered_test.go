@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestDeliveredMessages(t *testing.T) {
+	d := newDeliveredMessages(2)
+	if !d.Mark("wallet", 1) || d.Mark("wallet", 1) {
+		t.Fatal("want a message marked once")
+	}
+	if !d.Mark("other", 1) {
+		t.Fatal("want the same event id of another client id marked")
+	}
+	d.Mark("wallet", 2)
+	if d.Mark("other", 1) {
+		t.Fatal("want a recent entry kept")
+	}
+	if !d.Mark("wallet", 1) {
+		t.Fatal("want the least recently used entry evicted")
+	}
+}
+
+func TestDeliver_AtMostOnce(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	h.delivered = newDeliveredMessages(100)
+	suppressed := counterValue(suppressedDuplicatesMetric)
+	msg := datatype.SseMessage{EventId: h.nextID(), Message: []byte("m"), To: "wallet"}
+
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		rec := &flushCounter{ResponseRecorder: *httptest.NewRecorder()}
+		session := NewSession(h.storage, []string{"wallet"}, 0)
+		if err := h.deliver(context.Background(), echo.NewResponse(rec, echo.New()), nil, session, "wallet", []datatype.SseMessage{msg}); err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, rec.Body.String())
+	}
+	if !strings.Contains(bodies[0], "event: message") || bodies[1] != "" {
+		t.Fatalf("want the message written to the first stream only, got %q", bodies)
+	}
+	if got := counterValue(suppressedDuplicatesMetric) - suppressed; got != 1 {
+		t.Fatalf("want 1 suppressed duplicate, got %v", got)
+	}
+}
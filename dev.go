@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+// registerDevHandlers exposes the message inspector. It must never be enabled on production bridges.
+func registerDevHandlers(g *echo.Group, h *handler) {
+	g.GET("/inspect", h.InspectHandler)
+	g.POST("/inspect", h.InjectHandler)
+}
+
+type inspectedMessage struct {
+	EventId int64  `json:"event_id"`
+	From    string `json:"from"`
+	Message string `json:"message"`
+	Decoded string `json:"decoded,omitempty"`
+}
+
+// InspectHandler returns the stored messages of client_id with base64 payloads decoded when they are valid text.
+func (h *handler) InspectHandler(c echo.Context) error {
+	clientId := c.QueryParam("client_id")
+	if clientId == "" {
+		return c.JSON(HttpResError("param \"client_id\" not present", http.StatusBadRequest))
+	}
+	messages, err := h.storage.GetMessages(c.Request().Context(), []string{clientId}, 0)
+	if err != nil {
+		return c.JSON(HttpResError(err.Error(), http.StatusInternalServerError))
+	}
+	res := make([]inspectedMessage, 0, len(messages))
+	for _, m := range messages {
+		var bridgeMessage datatype.BridgeMessage
+		if err := json.Unmarshal(m.Message, &bridgeMessage); err != nil {
+			res = append(res, inspectedMessage{EventId: m.EventId, Message: string(m.Message)})
+			continue
+		}
+		inspected := inspectedMessage{EventId: m.EventId, From: bridgeMessage.From, Message: bridgeMessage.Message}
+		if decoded, err := base64.StdEncoding.DecodeString(bridgeMessage.Message); err == nil && utf8.Valid(decoded) {
+			inspected.Decoded = string(decoded)
+		}
+		res = append(res, inspected)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// InjectHandler delivers the request body to client_id as if it was sent by "from".
+func (h *handler) InjectHandler(c echo.Context) error {
+	clientId := c.QueryParam("client_id")
+	if clientId == "" {
+		return c.JSON(HttpResError("param \"client_id\" not present", http.StatusBadRequest))
+	}
+	from := c.QueryParam("from")
+	if from == "" {
+		from = "dev-inspector"
+	}
+	ttl := topicMaxTTL(c.QueryParam("topic"))
+	if t := c.QueryParam("ttl"); t != "" {
+		v, err := strconv.ParseInt(t, 10, 32)
+		if err != nil {
+			return c.JSON(HttpResError(err.Error(), http.StatusBadRequest))
+		}
+		if ttl, err = checkTTL(v, c.QueryParam("topic")); err != nil {
+			return c.JSON(HttpResError(err.Error(), http.StatusBadRequest))
+		}
+	}
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(HttpResError(err.Error(), http.StatusBadRequest))
+	}
+	mes, err := json.Marshal(datatype.BridgeMessage{From: from, Message: string(body)})
+	if err != nil {
+		return c.JSON(HttpResError(err.Error(), http.StatusBadRequest))
+	}
+	traceId := newTraceId()
+	sseMessage := datatype.SseMessage{EventId: h.nextID(), Message: mes, To: clientId}
+	log.WithField("prefix", "InjectHandler").Infof("inject message %v to %v", sseMessage.EventId, logId(clientId))
+	h.tracer.Record(traceEvent{TraceId: traceId, EventId: sseMessage.EventId, Stage: traceStageReceived, ClientId: clientId, Details: "injected"})
+	if _, err := h.dispatch(c.Request().Context(), clientId, ttl, traceId, sseMessage); err != nil {
+		return c.JSON(HttpResError(err.Error(), http.StatusServiceUnavailable))
+	}
+	return c.JSON(http.StatusOK, SendMessageRes{HttpRes: HttpResOk(), TTL: ttl})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/config"
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestInjectHandler_Disabled(t *testing.T) {
+	defer func(v bool) { config.Config.DevMode = v }(config.Config.DevMode)
+	config.Config.DevMode = false
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/dev/inspect?client_id=wallet", strings.NewReader("hello")))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("dev handlers must not be registered without DEV_MODE, got %v", rec.Code)
+	}
+}
+
+func TestInjectHandler(t *testing.T) {
+	defer func(v bool) { config.Config.DevMode = v }(config.Config.DevMode)
+	config.Config.DevMode = true
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL+"/dev/inspect", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("missing client_id: got %v", res.StatusCode)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := subscribe(ctx, srv.URL, "wallet", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := readEvents(stream)
+
+	res, err = http.Post(srv.URL+"/dev/inspect?client_id=wallet&from=tester", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("inject: bad status code %v", res.StatusCode)
+	}
+
+	select {
+	case event := <-events:
+		var message datatype.BridgeMessage
+		if err := json.Unmarshal([]byte(event.data), &message); err != nil {
+			t.Fatal(err)
+		}
+		if event.name != "message" || message.From != "tester" || message.Message != "hello" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("injected message was not delivered to the subscribed session")
+	}
+	waitStored(t, storage, "wallet", 1)
+}
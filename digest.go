@@ -0,0 +1,184 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var digestsMetric = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "number_of_digests",
+	Help: "The total number of digest webhooks sent for offline clients with old pending messages",
+})
+
+// digestTopic is the webhook topic of digests, see digestWorker.
+const digestTopic = "digest"
+
+type pendingMessage struct {
+	eventId   int64
+	topic     string
+	createdAt time.Time
+	expireAt  time.Time
+}
+
+type pendingClient struct {
+	messages []pendingMessage
+	// digestedUpTo is the newest event id announced in a digest, a client gets a new digest only for newer messages.
+	digestedUpTo int64
+}
+
+// pendingDigests remembers the messages accepted by this instance until they are delivered or expire,
+// so wallet backends can be told about clients that haven't come to read them.
+type pendingDigests struct {
+	mu      sync.Mutex
+	clients map[string]*pendingClient
+	after   time.Duration
+}
+
+type digest struct {
+	ClientId string
+	Count    int
+	Oldest   time.Duration
+	Topics   []string
+}
+
+func newPendingDigests(after time.Duration) *pendingDigests {
+	return &pendingDigests{clients: map[string]*pendingClient{}, after: after}
+}
+
+func (p *pendingDigests) Pending(clientId string, eventId int64, topic string, ttl int64, now time.Time) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.clients[clientId]
+	if !ok {
+		c = &pendingClient{}
+		p.clients[clientId] = c
+	}
+	c.messages = append(c.messages, pendingMessage{eventId: eventId, topic: topic, createdAt: now, expireAt: now.Add(time.Duration(ttl) * time.Second)})
+}
+
+// Delivered forgets the messages of clientId up to eventId.
+func (p *pendingDigests) Delivered(clientId string, eventId int64) {
+	if p == nil || clientId == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.clients[clientId]
+	if !ok {
+		return
+	}
+	left := c.messages[:0]
+	for _, m := range c.messages {
+		if m.eventId > eventId {
+			left = append(left, m)
+		}
+	}
+	c.messages = left
+	if len(c.messages) == 0 {
+		delete(p.clients, clientId)
+	}
+}
+
+// Acknowledged forgets the message eventId of clientId, older messages are still pending.
+func (p *pendingDigests) Acknowledged(clientId string, eventId int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.clients[clientId]
+	if !ok {
+		return
+	}
+	for i, m := range c.messages {
+		if m.eventId == eventId {
+			c.messages = append(c.messages[:i], c.messages[i+1:]...)
+			break
+		}
+	}
+	if len(c.messages) == 0 {
+		delete(p.clients, clientId)
+	}
+}
+
+// Due drops expired messages and returns digests of the clients that aren't connected
+// and have messages older than the threshold not announced yet.
+func (p *pendingDigests) Due(connected func(clientId string) bool, now time.Time) []digest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var due []digest
+	for id, c := range p.clients {
+		alive := c.messages[:0]
+		for _, m := range c.messages {
+			if now.Before(m.expireAt) {
+				alive = append(alive, m)
+			}
+		}
+		c.messages = alive
+		if len(c.messages) == 0 {
+			delete(p.clients, id)
+			continue
+		}
+		oldest, newest := c.messages[0].createdAt, c.messages[0].eventId
+		seen := map[string]bool{}
+		var topics []string
+		for _, m := range c.messages {
+			if m.createdAt.Before(oldest) {
+				oldest = m.createdAt
+			}
+			if m.eventId > newest {
+				newest = m.eventId
+			}
+			if m.topic != "" && !seen[m.topic] {
+				seen[m.topic] = true
+				topics = append(topics, m.topic)
+			}
+		}
+		if now.Sub(oldest) < p.after || newest <= c.digestedUpTo || connected(id) {
+			continue
+		}
+		c.digestedUpTo = newest
+		d := digest{ClientId: id, Count: len(c.messages), Oldest: now.Sub(oldest), Topics: topics}
+		sort.Strings(d.Topics)
+		due = append(due, d)
+	}
+	return due
+}
+
+// digestWorker sends a digest webhook every interval for the clients returned by Due,
+// so wallet backends can nudge users to open the app before the messages expire.
+func (h *handler) digestWorker(interval time.Duration) {
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		h.sendDigests(time.Now())
+	}
+}
+
+func (h *handler) sendDigests(now time.Time) {
+	due := h.digests.Due(func(clientId string) bool {
+		h.Mux.RLock()
+		defer h.Mux.RUnlock()
+		_, ok := h.Connections[clientId]
+		return ok
+	}, now)
+	for _, d := range due {
+		h.webhooks.Send(d.ClientId, WebhookData{
+			Topic:         digestTopic,
+			Count:         d.Count,
+			OldestSeconds: int64(d.Oldest.Seconds()),
+			Topics:        d.Topics,
+		})
+		digestsMetric.Inc()
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPendingDigests(t *testing.T) {
+	p := newPendingDigests(time.Minute)
+	now := time.Now()
+	offline := func(string) bool { return false }
+
+	p.Pending("wallet", 1, "connect", 300, now.Add(-2*time.Minute))
+	p.Pending("wallet", 2, "sendTransaction", 300, now.Add(-30*time.Second))
+	p.Pending("wallet", 3, "", 60, now.Add(-2*time.Minute))
+	p.Pending("fresh", 4, "connect", 300, now)
+	p.Pending("delivered", 5, "connect", 300, now.Add(-2*time.Minute))
+	p.Delivered("delivered", 5)
+	p.Pending("acked", 6, "connect", 300, now.Add(-2*time.Minute))
+	p.Pending("acked", 7, "connect", 300, now.Add(-2*time.Minute))
+	// an acknowledgement removes only its own message
+	p.Acknowledged("acked", 7)
+
+	due := p.Due(offline, now)
+	sort.Slice(due, func(i, j int) bool { return due[i].ClientId < due[j].ClientId })
+	want := []digest{
+		{ClientId: "acked", Count: 1, Oldest: 2 * time.Minute, Topics: []string{"connect"}},
+		{ClientId: "wallet", Count: 2, Oldest: 2 * time.Minute, Topics: []string{"connect", "sendTransaction"}},
+	}
+	if !reflect.DeepEqual(due, want) {
+		t.Fatalf("want %+v, got %+v", want, due)
+	}
+	if due := p.Due(offline, now); len(due) != 0 {
+		t.Fatalf("the same messages are announced twice: %+v", due)
+	}
+
+	p.Pending("wallet", 8, "connect", 300, now)
+	if due := p.Due(func(id string) bool { return id == "wallet" }, now); len(due) != 0 {
+		t.Fatalf("connected clients don't need a digest: %+v", due)
+	}
+	if due := p.Due(offline, now); len(due) != 1 || due[0].Count != 3 {
+		t.Fatalf("want a digest of the new message, got %+v", due)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/config"
+)
+
+// closeReasonDrain means the client_id is being moved away from this bridge; clients should reconnect after a pause.
+const closeReasonDrain = "drain"
+
+var drainRejectedMetric = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "number_of_drain_rejected_subscriptions",
+	Help: "The total number of subscriptions rejected because a client_id is draining",
+})
+
+// drainingClients keeps the client ids whose subscriptions are rejected until a moment in time.
+type drainingClients struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newDrainingClients() *drainingClients {
+	return &drainingClients{until: map[string]time.Time{}}
+}
+
+// Drain rejects subscriptions for id until the given time.
+func (d *drainingClients) Drain(id string, until time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.until[id] = until
+}
+
+// Draining returns the latest time until which one of ids is draining, or zero time.
+func (d *drainingClients) Draining(ids []string, now time.Time) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var until time.Time
+	for _, id := range ids {
+		t, ok := d.until[id]
+		if !ok {
+			continue
+		}
+		if !t.After(now) {
+			delete(d.until, id)
+			continue
+		}
+		if t.After(until) {
+			until = t
+		}
+	}
+	return until
+}
+
+type drainRes struct {
+	ClientId string `json:"client_id"`
+	Sessions int    `json:"sessions"`
+	Until    int64  `json:"until"`
+}
+
+// DrainHandler closes the sessions subscribed to client_id with the "drain" reason
+// and rejects its new subscriptions for pause seconds, DRAIN_PAUSE_SECONDS by default.
+// Messages sent to the client_id are still stored and are replayed once it reconnects.
+func (h *handler) DrainHandler(c echo.Context) error {
+	clientId := c.QueryParam("client_id")
+	if clientId == "" {
+		return c.JSON(HttpResError("param \"client_id\" not present", http.StatusBadRequest))
+	}
+	pause := config.Config.DrainPause
+	if p := c.QueryParam("pause"); p != "" {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 {
+			return c.JSON(HttpResError("param \"pause\" should be non-negative int", http.StatusBadRequest))
+		}
+		pause = v
+	}
+	until := time.Now().Add(time.Duration(pause) * time.Second)
+	// subscriptions are rejected before the sessions are closed so clients can't slip back in between
+	h.draining.Drain(clientId, until)
+	var sessions []*Session
+	h.Mux.RLock()
+	if s, ok := h.Connections[clientId]; ok {
+		s.mux.RLock()
+		sessions = append(sessions, s.Sessions...)
+		s.mux.RUnlock()
+	}
+	h.Mux.RUnlock()
+	for _, ses := range sessions {
+		ses.Kick(closeReasonDrain)
+	}
+	log.WithField("prefix", "DrainHandler").Infof("draining %v: %v sessions closed, paused for %vs", logId(clientId), len(sessions), pause)
+	return c.JSON(http.StatusOK, drainRes{ClientId: clientId, Sessions: len(sessions), Until: until.Unix()})
+}
+
+// rejectDraining answers a subscription to a client id draining until the given time with 503 and Retry-After.
+func rejectDraining(c echo.Context, until time.Time) error {
+	drainRejectedMetric.Inc()
+	retryAfter := int(time.Until(until).Seconds()) + 1
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	return c.JSON(HttpResError(fmt.Sprintf("client_id is draining, retry in %v seconds", retryAfter), http.StatusServiceUnavailable))
+}
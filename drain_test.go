@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestDrainHandler(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	session := h.CreateSession("wallet", []string{"wallet"}, 0)
+	defer h.removeConnection(session)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/drain?client_id=wallet&pause=60", nil)
+	rec := httptest.NewRecorder()
+	if err := h.DrainHandler(e.NewContext(req, rec)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %v: %v", rec.Code, rec.Body.String())
+	}
+	select {
+	case reason := <-session.kick:
+		if reason != closeReasonDrain {
+			t.Fatalf("want %q reason, got %q", closeReasonDrain, reason)
+		}
+	default:
+		t.Fatal("draining session is not closed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req = httptest.NewRequest(http.MethodGet, "/bridge/events?client_id=other,wallet", nil).WithContext(ctx)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("want 503 with Retry-After, got %v %v", rec.Code, rec.Header())
+	}
+}
+
+func TestDrainingClients_Expire(t *testing.T) {
+	d := newDrainingClients()
+	now := time.Now()
+	d.Drain("wallet", now.Add(time.Second))
+	if d.Draining([]string{"wallet"}, now).IsZero() {
+		t.Fatal("client is not draining")
+	}
+	if !d.Draining([]string{"wallet"}, now.Add(2*time.Second)).IsZero() {
+		t.Fatal("pause is over but client is still draining")
+	}
+}
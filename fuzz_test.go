@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func fuzzServer(f *testing.F) *echo.Echo {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	f.Cleanup(h.Close)
+	e := echo.New()
+	registerHandlers(e, h)
+	return e
+}
+
+// checkFuzzResponse fails unless rec holds one of the allowed statuses and a non-200 response is a json error.
+func checkFuzzResponse(t *testing.T, rec *httptest.ResponseRecorder, allowed ...int) {
+	for _, code := range allowed {
+		if rec.Code != code {
+			continue
+		}
+		var res HttpRes
+		if code != http.StatusOK && json.Unmarshal(rec.Body.Bytes(), &res) != nil {
+			t.Fatalf("status %v with a malformed body %q", rec.Code, rec.Body.String())
+		}
+		return
+	}
+	t.Fatalf("unexpected status %v: %q", rec.Code, rec.Body.String())
+}
+
+func FuzzEventRegistrationHandler(f *testing.F) {
+	f.Add("wallet", "", "", "")
+	f.Add("wallet,dapp", "1682942400000000", "", "")
+	f.Add("a,,b", "", "-1", "15m")
+	f.Add("", "not a number", "9223372036854775808", "2023-05-01T11:00:00Z")
+	e := fuzzServer(f)
+	f.Fuzz(func(t *testing.T, clientId, lastEventIdHeader, lastEventIdQuery, since string) {
+		query := url.Values{"client_id": {clientId}, "since": {since}}
+		if lastEventIdQuery != "" {
+			query.Set("last_event_id", lastEventIdQuery)
+		}
+		// the client is gone right away, so an accepted stream is closed after the handshake
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest(http.MethodGet, "/bridge/events?"+query.Encode(), nil).WithContext(ctx)
+		req.Header.Set("Last-Event-ID", lastEventIdHeader)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		checkFuzzResponse(t, rec, http.StatusOK, http.StatusBadRequest)
+	})
+}
+
+func FuzzSendMessageHandler(f *testing.F) {
+	f.Add("dapp", "wallet", "60", "", []byte("hello"))
+	f.Add("dapp", "dapp", "300", "connect", []byte(""))
+	f.Add("", "wallet", "1e3", "sendTransaction", []byte("\x00\xff"))
+	f.Add("dapp", "", "-1", "", []byte("{}"))
+	e := fuzzServer(f)
+	f.Fuzz(func(t *testing.T, clientId, to, ttl, topic string, body []byte) {
+		query := url.Values{"client_id": {clientId}, "to": {to}, "ttl": {ttl}, "topic": {topic}}
+		req := httptest.NewRequest(http.MethodPost, "/bridge/message?"+query.Encode(), bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		checkFuzzResponse(t, rec, http.StatusOK, http.StatusBadRequest)
+	})
+}
+
+func FuzzSinceEventId(f *testing.F) {
+	f.Add("15m")
+	f.Add("2023-05-01T11:00:00Z")
+	f.Add("-2562047h")
+	f.Add("0001-01-01T00:00:00Z")
+	now := time.Now()
+	f.Fuzz(func(t *testing.T, since string) {
+		id, err := sinceEventId(since, now)
+		if _, derr := time.ParseDuration(since); err == nil && derr == nil && id >= now.UnixMicro() {
+			t.Fatalf("duration %q points to the future: %v", since, id)
+		}
+	})
+}
+
+func FuzzBridgeMessage(f *testing.F) {
+	f.Add([]byte(`{"from":"dapp","message":"hello"}`))
+	f.Add([]byte(`{"from":"dapp","message":"hello","sender_verified":true,"meta":{"size":"5"}}`))
+	f.Add([]byte(`{"from":"\ud800","message":"\u0000","meta":{}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var first datatype.BridgeMessage
+		if json.Unmarshal(data, &first) != nil {
+			return
+		}
+		encoded, err := json.Marshal(first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var second datatype.BridgeMessage
+		if err := json.Unmarshal(encoded, &second); err != nil {
+			t.Fatalf("can't decode %q: %v", encoded, err)
+		}
+		reencoded, err := json.Marshal(second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, reencoded) {
+			t.Fatalf("%q is encoded as %q and then as %q", data, encoded, reencoded)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// grafanaIgnoredPrefixes are the runtime metrics every go exporter has, they belong to generic dashboards.
+var grafanaIgnoredPrefixes = []string{"go_", "process_", "promhttp_"}
+
+type grafanaDashboard struct {
+	Inputs        []grafanaInput `json:"__inputs"`
+	Title         string         `json:"title"`
+	UID           string         `json:"uid"`
+	SchemaVersion int            `json:"schemaVersion"`
+	Refresh       string         `json:"refresh"`
+	Time          grafanaTime    `json:"time"`
+	Panels        []grafanaPanel `json:"panels"`
+}
+
+type grafanaInput struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Type     string `json:"type"`
+	PluginID string `json:"pluginId"`
+}
+
+type grafanaTime struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaPanel struct {
+	ID          int               `json:"id"`
+	Type        string            `json:"type"`
+	Title       string            `json:"title"`
+	Description string            `json:"description,omitempty"`
+	Datasource  grafanaDatasource `json:"datasource"`
+	GridPos     grafanaGridPos    `json:"gridPos"`
+	Targets     []grafanaTarget   `json:"targets"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	RefID        string `json:"refId"`
+}
+
+// newGrafanaDashboard builds a dashboard with a panel for every bridge metric known to gatherer.
+// Labeled metrics only show up after their first observation, so it is best generated from a running instance.
+func newGrafanaDashboard(gatherer prometheus.Gatherer) (grafanaDashboard, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return grafanaDashboard{}, err
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	d := grafanaDashboard{
+		Inputs:        []grafanaInput{{Name: "DS_PROMETHEUS", Label: "Prometheus", Type: "datasource", PluginID: "prometheus"}},
+		Title:         "TON Connect bridge",
+		UID:           "ton-connect-bridge",
+		SchemaVersion: 36,
+		Refresh:       "30s",
+		Time:          grafanaTime{From: "now-6h", To: "now"},
+	}
+	for _, f := range families {
+		if ignoredMetric(f.GetName()) {
+			continue
+		}
+		expr, legend := grafanaQuery(f)
+		if expr == "" {
+			continue
+		}
+		i := len(d.Panels)
+		d.Panels = append(d.Panels, grafanaPanel{
+			ID:          i + 1,
+			Type:        "timeseries",
+			Title:       f.GetName(),
+			Description: f.GetHelp(),
+			Datasource:  grafanaDatasource{Type: "prometheus", UID: "${DS_PROMETHEUS}"},
+			GridPos:     grafanaGridPos{H: 8, W: 12, X: (i % 2) * 12, Y: (i / 2) * 8},
+			Targets:     []grafanaTarget{{Expr: expr, LegendFormat: legend, RefID: "A"}},
+		})
+	}
+	return d, nil
+}
+
+func ignoredMetric(name string) bool {
+	for _, prefix := range grafanaIgnoredPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// grafanaQuery returns the promql expression and legend for a metric family.
+func grafanaQuery(f *dto.MetricFamily) (string, string) {
+	var labels []string
+	if len(f.GetMetric()) > 0 {
+		for _, l := range f.GetMetric()[0].GetLabel() {
+			labels = append(labels, l.GetName())
+		}
+	}
+	by, legend := "", ""
+	if len(labels) > 0 {
+		by = " by (" + strings.Join(labels, ", ") + ")"
+		legend = "{{" + strings.Join(labels, "}} {{") + "}}"
+	}
+	name := f.GetName()
+	switch f.GetType() {
+	case dto.MetricType_COUNTER:
+		return fmt.Sprintf("sum%v (rate(%v[5m]))", by, name), legend
+	case dto.MetricType_GAUGE:
+		return fmt.Sprintf("sum%v (%v)", by, name), legend
+	case dto.MetricType_HISTOGRAM:
+		return fmt.Sprintf("histogram_quantile(0.95, sum by (%v) (rate(%v_bucket[5m])))", strings.Join(append([]string{"le"}, labels...), ", "), name), legend
+	case dto.MetricType_SUMMARY:
+		return fmt.Sprintf("sum%v (rate(%v_sum[5m])) / sum%v (rate(%v_count[5m]))", by, name, by, name), legend
+	}
+	return "", ""
+}
+
+// GrafanaDashboardHandler returns a ready to import grafana dashboard for the metrics of this instance.
+func (h *handler) GrafanaDashboardHandler(c echo.Context) error {
+	d, err := newGrafanaDashboard(prometheus.DefaultGatherer)
+	if err != nil {
+		return c.JSON(HttpResError(err.Error(), http.StatusInternalServerError))
+	}
+	return c.JSON(http.StatusOK, d)
+}
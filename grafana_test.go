@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewGrafanaDashboard(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "number_of_things", Help: "things"}, []string{"kind"})
+	counter.WithLabelValues("a").Inc()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "number_of_active_things"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "thing_seconds"})
+	registry.MustRegister(counter, gauge, histogram, prometheus.NewGoCollector())
+
+	d, err := newGrafanaDashboard(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"number_of_active_things": "sum (number_of_active_things)",
+		"number_of_things":        "sum by (kind) (rate(number_of_things[5m]))",
+		"thing_seconds":           "histogram_quantile(0.95, sum by (le) (rate(thing_seconds_bucket[5m])))",
+	}
+	if len(d.Panels) != len(want) {
+		t.Fatalf("want %v panels, got %+v", len(want), d.Panels)
+	}
+	for _, p := range d.Panels {
+		if p.Targets[0].Expr != want[p.Title] {
+			t.Errorf("panel %v: want %q, got %q", p.Title, want[p.Title], p.Targets[0].Expr)
+		}
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
@@ -39,14 +41,47 @@ var (
 		Name: "number_of_delivered_messages",
 		Help: "The total number of delivered_messages",
 	})
+	selfSentMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_self_sent_messages",
+		Help: "The total number of messages whose receiver is the sender itself",
+	})
+	undeliveredMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_undelivered_messages",
+		Help: "The total number of messages that failed to be written to a connection",
+	})
 	badRequestMetric = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "number_of_bad_requests",
 		Help: "The total number of bad requests",
 	})
+	ttlClampedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_clamped_ttls",
+		Help: "The total number of messages whose ttl was lowered to the maximum",
+	})
+	disconnectTTLsMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_extended_disconnect_ttls",
+		Help: "The total number of disconnect events whose ttl was raised to DISCONNECT_TTL",
+	})
 	clientIdsPerConnectionMetric = promauto.NewHistogram(prometheus.HistogramOpts{
 		Name:    "number_of_client_ids_per_connection",
 		Buckets: []float64{1, 2, 3, 4, 5, 10, 20, 30, 40, 50, 100},
 	})
+	closeEventsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_close_events",
+		Help: "The total number of streams closed by the bridge, by reason",
+	}, []string{"reason"})
+	handedOverMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_handed_over_messages",
+		Help: "The total number of queued messages moved from a replaced session to the one that replaced it",
+	})
+	sessionPanicsMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "session_panics_total",
+		Help: "The total number of panics recovered in SSE session goroutines",
+	})
+	heartbeatRTTMetric = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "heartbeat_rtt_seconds",
+		Help:    "Round trip time between sending a heartbeat and receiving its echo",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	})
 )
 
 type stream struct {
@@ -59,6 +94,58 @@ type handler struct {
 	storage           db
 	_eventIDs         int64
 	heartbeatInterval time.Duration
+	webhooks          *webhookDispatcher
+	copyPool          *workerPool
+	copyClient        *http.Client
+	storagePool       *workerPool
+	receiptPool       *workerPool
+	tracer            *traceRing
+	sideEffects       *sideEffectFailures
+	stats             *connectionStats
+	watermarks        *watermarkTracker
+	idempotency       *idempotencyCache
+	// audit is nil unless the audit log is enabled.
+	audit auditStorage
+	hooks *messageHooks
+	// storageName identifies the storage backend in /health.
+	storageName string
+	health      *healthTracker
+	draining    *drainingClients
+	// conformance is nil unless conformance checks run periodically, see conformanceWorker.
+	conformance *conformanceResults
+	// allowlist is used to tell clients their effective limits.
+	allowlist *limitsAllowlist
+	// remover is nil unless consume-on-read mode is enabled.
+	remover  messageRemover
+	consumed *consumedMessages
+	// readOnly rejects new messages during incidents, see ReadOnlyHandler.
+	readOnly *readOnlyMode
+	// digests is nil unless DIGEST_INTERVAL is set.
+	digests *pendingDigests
+	// delivered is nil unless DELIVERY_MODE is at_most_once.
+	delivered *deliveredMessages
+	receipts  *deliveryReceipts
+	// topClients is nil if TOP_CLIENTS_WINDOW is 0.
+	topClients *topClients
+	// relay is nil unless messages are passed between instances, see CROSS_INSTANCE_FANOUT.
+	relay messageRelay
+	// relayStopped is set once the relay subscription stops, accessed atomically.
+	relayStopped int32
+	// relayGap is the newest event id this instance failed to publish since the last announced gap, accessed atomically.
+	relayGap int64
+	// recent is nil unless event ids carry the instance epoch, see resumeStorage.
+	recent *recentMessages
+	// transfered tells unique sent messages from retries in the metrics.
+	transfered *transferedCache
+	// acked are recently acknowledged messages, see AckHandler.
+	acked *consumedMessages
+	// sessionReplayed is a hook called when a new session finishes the storage replay.
+	sessionReplayed func(*Session)
+	// drifts are the gauge differences seen by the last reconcileMetrics pass.
+	drifts map[string]float64
+	// ctx is canceled by Close to stop the background workers.
+	ctx  context.Context
+	stop context.CancelFunc
 }
 
 type db interface {
@@ -73,31 +160,120 @@ func newHandler(db db, heartbeatInterval time.Duration) *handler {
 		storage:           db,
 		_eventIDs:         time.Now().UnixMicro(),
 		heartbeatInterval: heartbeatInterval,
+		webhooks:          newWebhookDispatcher(newWorkerPool("webhook", config.Config.SideEffectWorkers, config.Config.SideEffectQueueSize, dropWhenFull)),
+		copyPool:          newWorkerPool("copy", config.Config.SideEffectWorkers, config.Config.SideEffectQueueSize, dropWhenFull),
+		copyClient:        newSideEffectClient(),
+		storagePool:       newWorkerPool("storage", config.Config.SideEffectWorkers, config.Config.SideEffectQueueSize, runWhenFull),
+		receiptPool:       newWorkerPool("receipt", config.Config.SideEffectWorkers, config.Config.SideEffectQueueSize, dropWhenFull),
+		tracer:            newTraceRing(config.Config.TraceBufferSize),
+		sideEffects:       newSideEffectFailures(sideEffectFailuresSize),
+		stats:             newConnectionStats(time.Duration(config.Config.ConnectionStatsWindow) * time.Second),
+		watermarks:        newWatermarkTracker(),
+		idempotency:       newIdempotencyCache(time.Duration(config.Config.IdempotencyWindow) * time.Second),
+		storageName:       "unknown",
+		health:            newHealthTracker("storage"),
+		draining:          newDrainingClients(),
+		acked:             newConsumedMessages(ackPendingWindow),
+		transfered:        newTransferedCache(time.Duration(config.Config.MaxTTL)*time.Second, config.Config.TransferedCacheSize),
+		topClients:        newTopClients(time.Duration(config.Config.TopClientsWindow) * time.Second),
+		readOnly:          &readOnlyMode{},
+		receipts:          newDeliveryReceipts(),
+	}
+	h.ctx, h.stop = context.WithCancel(context.Background())
+	h.webhooks.failures = h.sideEffects
+	go h.stats.watcher(h.ctx.Done())
+	go h.acked.watcher(ackPendingWindow, h.ctx.Done())
+	go h.transfered.watcher(h.ctx.Done())
+	go h.receipts.watcher(h.ctx.Done())
+	if h.idempotency != nil {
+		go h.idempotency.watcher(h.ctx.Done())
+	}
+	h.readOnly.Set(config.Config.ReadOnly, "READ_ONLY is set", time.Now())
+	hooks, err := newMessageHooks(config.Config.MessageHooks, time.Duration(config.Config.MessageHooksTimeout)*time.Millisecond)
+	if err != nil {
+		log.Fatalf("message hooks: %v", err)
+	}
+	h.hooks = hooks
+	if config.Config.DeliveryMode == deliveryAtMostOnce {
+		h.delivered = newDeliveredMessages(config.Config.DeliveredCacheSize)
+	}
+	if config.Config.AffinityEventIds {
+		h.recent = newRecentMessages(config.Config.AffinityBufferSize, h._eventIDs)
+		go h.recent.watcher(h.ctx.Done())
+	}
+	go h.lagWatcher()
+	if config.Config.ConsumeOnRead {
+		remover, ok := db.(messageRemover)
+		if !ok {
+			log.Fatal("consume-on-read mode is not supported by the storage")
+		}
+		h.remover = remover
+		h.consumed = newConsumedMessages(time.Duration(longestTTL()) * time.Second)
+		go h.consumed.watcher(time.Duration(longestTTL())*time.Second, h.ctx.Done())
+	}
+	if o, ok := db.(expiredObserver); ok && h.topClients != nil {
+		o.OnExpired(func(clientId string, count int) {
+			h.topClients.Add(clientId, clientCountExpired, int64(count), time.Now())
+		})
+	}
+	if config.Config.CrossInstanceFanOut {
+		relay, ok := db.(messageRelay)
+		if !ok {
+			log.Fatal("cross-instance fan-out is not supported by the storage")
+		}
+		h.relay = relay
+		go h.relayWorker()
+	}
+	if config.Config.AuditRetentionDays > 0 {
+		audit, ok := db.(auditStorage)
+		if !ok {
+			log.Fatal("audit log is not supported by the storage")
+		}
+		h.audit = audit
+		go auditRetentionWorker(audit, time.Duration(config.Config.AuditRetentionDays)*24*time.Hour, h.ctx.Done())
+	}
+	if r, ok := db.(cleanupReporter); ok {
+		go h.cleanupWatcher(r)
+	}
+	if c, ok := db.(clockStorage); ok && config.Config.ClockSkewThreshold > 0 {
+		go h.clockSkewWorker(c, time.Duration(config.Config.ClockSkewThreshold)*time.Millisecond)
+	}
+	if config.Config.DigestInterval > 0 {
+		h.digests = newPendingDigests(time.Duration(config.Config.DigestAfter) * time.Second)
+		go h.digestWorker(time.Duration(config.Config.DigestInterval) * time.Second)
+	}
+	if config.Config.MetricsReconcile > 0 {
+		go h.metricsReconciler(time.Duration(config.Config.MetricsReconcile) * time.Second)
 	}
 	return &h
 }
 
+// Close stops the background workers of h and waits for the queued side effects, e.g. storage writes, to run.
+func (h *handler) Close() {
+	h.stop()
+	for _, pool := range []*workerPool{h.webhooks.pool, h.copyPool, h.storagePool, h.receiptPool} {
+		pool.Close()
+	}
+}
+
 func (h *handler) EventRegistrationHandler(c echo.Context) error {
 	log := log.WithField("prefix", "EventRegistrationHandler")
+	if sdk := countSdk(c.Request().Header.Get(sdkHeader), "events"); sdk != sdkUnknown {
+		log = log.WithField("sdk", sdk)
+	}
 	_, ok := c.Response().Writer.(http.Flusher)
 	if !ok {
 		http.Error(c.Response().Writer, "streaming unsupported", http.StatusInternalServerError)
 		return c.JSON(HttpResError("streaming unsupported", http.StatusBadRequest))
 	}
-	c.Response().Header().Set("Content-Type", "text/event-stream")
-	c.Response().Header().Set("Cache-Control", "no-cache")
-	c.Response().Header().Set("Connection", "keep-alive")
-	c.Response().Header().Set("Transfer-Encoding", "chunked")
-	c.Response().WriteHeader(http.StatusOK)
-	fmt.Fprint(c.Response(), "\n")
-	c.Response().Flush()
 	params := c.QueryParams()
 
 	var lastEventId int64
+	var epoch string
 	var err error
 	lastEventIDStr := c.Request().Header.Get("Last-Event-ID")
 	if lastEventIDStr != "" {
-		lastEventId, err = strconv.ParseInt(lastEventIDStr, 10, 64)
+		lastEventId, epoch, err = parseEventId(lastEventIDStr)
 		if err != nil {
 			badRequestMetric.Inc()
 			errorMsg := "Last-Event-ID should be int"
@@ -107,7 +283,7 @@ func (h *handler) EventRegistrationHandler(c echo.Context) error {
 	}
 	lastEventIdQuery, ok := params["last_event_id"]
 	if ok && lastEventId == 0 {
-		lastEventId, err = strconv.ParseInt(lastEventIdQuery[0], 10, 64)
+		lastEventId, epoch, err = parseEventId(lastEventIdQuery[0])
 		if err != nil {
 			badRequestMetric.Inc()
 			errorMsg := "last_event_id should be int"
@@ -115,7 +291,21 @@ func (h *handler) EventRegistrationHandler(c echo.Context) error {
 			return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
 		}
 	}
+	if since := params.Get("since"); since != "" && lastEventId == 0 {
+		lastEventId, err = sinceEventId(since, time.Now())
+		if err != nil {
+			badRequestMetric.Inc()
+			log.Error(err)
+			return c.JSON(HttpResError(err.Error(), http.StatusBadRequest))
+		}
+	}
 	clientId, ok := params["client_id"]
+	if !ok && c.Request().Method == http.MethodPost {
+		// long lists of client ids don't fit into the url, so they can be sent as a form body
+		if v := c.FormValue("client_id"); v != "" {
+			clientId, ok = []string{v}, true
+		}
+	}
 	if !ok {
 		badRequestMetric.Inc()
 		errorMsg := "param \"client_id\" not present"
@@ -124,51 +314,380 @@ func (h *handler) EventRegistrationHandler(c echo.Context) error {
 	}
 	clientIds := strings.Split(clientId[0], ",")
 	clientIdsPerConnectionMetric.Observe(float64(len(clientIds)))
+	if reason := h.checkLastEventId(c.Request().Context(), clientIds, lastEventId, time.Now()); reason != "" {
+		suspiciousLastEventIdsMetric.WithLabelValues(reason).Inc()
+		log.Warnf("suspicious last event id %v (%v) from %v for %v", lastEventId, reason, requestContext(c).IP, logIds(clientIds))
+	}
+	if until := h.draining.Draining(clientIds, time.Now()); !until.IsZero() {
+		return rejectDraining(c, until)
+	}
+
 	session := h.CreateSession(clientId[0], clientIds, lastEventId)
+	session.storage = h.resumeStorage(clientIds, lastEventId, epoch)
+	session.strict = params.Get("sse") == sseModeStrict
+	session.queueDone = params.Get("enable_queue_done_event") == "true"
+	replace := params.Get("replace") == "true"
+	if replace {
+		h.replaceSessions(session)
+	}
+	session.StopRecordingForwarded(replace)
+	// the session is subscribed before the client sees the response, messages sent after that aren't missed
+	c.Response().Header().Set("Content-Type", "text/event-stream")
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().Header().Set("Connection", "keep-alive")
+	c.Response().Header().Set("Transfer-Encoding", "chunked")
+	c.Response().WriteHeader(http.StatusOK)
+	fmt.Fprint(c.Response(), connectedEvent(session, time.Now()))
+	c.Response().Flush()
+
+	for _, change := range h.stats.OriginSeen(clientIds, requestContext(c).Origin, session.StartedAt) {
+		log.Warnf("client %v reconnected from origin %q, previously %q", logId(change.ClientId), change.Origin, change.PreviousOrigin)
+		if config.Config.OriginChangeWebhook {
+			h.webhooks.Send(change.ClientId, WebhookData{Topic: originChangedTopic, Origin: change.Origin, PreviousOrigin: change.PreviousOrigin})
+		}
+	}
 
 	ctx := c.Request().Context()
 	notify := ctx.Done()
 	go func() {
 		<-notify
-		close(session.Closer)
+		// the loop below records its reason before returning, otherwise the client has gone away
+		session.SetCloseReason(closeReasonClientDisconnect)
+		session.Close()
 		h.removeConnection(session)
-		log.Infof("connection: %v closed with error %v", session.ClientIds, ctx.Err())
+		h.stats.Disconnected(session.ClientIds, session.StartedAt, time.Now(), session.CloseReason())
+		log.Infof("connection: %v closed (%v) with error %v", logIds(session.ClientIds), session.CloseReason(), ctx.Err())
+	}()
+	defer func() {
+		// the session is unsubscribed by the goroutine above once the request context is canceled,
+		// here we only have to keep the gauges consistent and stop the panic from reaching echo.
+		if r := recover(); r != nil {
+			sessionPanicsMetric.Inc()
+			session.SetCloseReason(closeReasonInternalError)
+			log.Errorf("session %v panicked: %v\n%s", logIds(session.ClientIds), r, debug.Stack())
+		}
+		activeConnectionMetric.Dec()
 	}()
 	ticker := time.NewTicker(h.heartbeatInterval)
 	defer ticker.Stop()
+	deadline := newWriteDeadline(c.Request(), time.Duration(config.Config.SSEWriteTimeout)*time.Millisecond)
 	session.Start()
 loop:
 	for {
 		select {
-		case msg, ok := <-session.MessageCh:
-			if !ok {
-				log.Errorf("can't read from channel")
+		case <-session.Closer:
+			if session.CloseReason() == closeReasonReplaced {
+				err = h.closeStream(c.Response(), deadline, session, closeReasonReplaced)
+			}
+			break loop
+		case msg := <-session.MessageCh:
+			if session.Overflowed() {
+				// msg and the rest of the queue may be newer than the missed message, they are replayed
+				// from storage after the client reconnects
+				session.SetCloseReason(closeReasonQueueOverflow)
+				err = h.closeStream(c.Response(), deadline, session, closeReasonQueueOverflow)
 				break loop
 			}
-			_, err = fmt.Fprintf(c.Response(), "event: %v\nid: %v\ndata: %v\n\n", "message", msg.EventId, string(msg.Message))
+			err = h.deliver(ctx, c.Response(), deadline, session, clientId[0], nextBatch(session, msg))
 			if err != nil {
 				log.Errorf("msg can't write to connection: %v", err)
+				session.SetCloseReason(writeCloseReason(err))
 				break loop
 			}
-			c.Response().Flush()
-			deliveredMessagesMetric.Inc()
+		case reason := <-session.kick:
+			session.SetCloseReason(reason)
+			err = h.closeStream(c.Response(), deadline, session, reason)
+			break loop
 		case <-ticker.C:
-			_, err = fmt.Fprintf(c.Response(), "event: heartbeat\n\n")
+			heartbeat := h.heartbeat(session, time.Now())
+			deadline.Begin()
+			_, err = fmt.Fprint(c.Response(), heartbeat)
+			if err == nil {
+				c.Response().Flush()
+			}
+			if timeout := deadline.End(); timeout != nil {
+				err = timeout
+			}
 			if err != nil {
 				log.Errorf("ticker can't write to connection: %v", err)
+				session.SetCloseReason(writeCloseReason(err))
 				break loop
 			}
-			c.Response().Flush()
 		}
 	}
-	activeConnectionMetric.Dec()
 	log.Info("connection closed")
 	return nil
 }
 
+// closeStream hands the queued messages over to the successor of session, if any, and writes the final close event.
+func (h *handler) closeStream(res *echo.Response, deadline *writeDeadline, session *Session, reason string) error {
+	handedOverMessagesMetric.Add(float64(session.HandOver()))
+	var buf bytes.Buffer
+	encodeSseEvent(&buf, "", "close", []byte(fmt.Sprintf("{\"reason\":%q}", reason)))
+	deadline.Begin()
+	_, err := res.Write(buf.Bytes())
+	if err != nil {
+		deadline.End()
+		log.WithField("prefix", "EventRegistrationHandler").Errorf("close event can't write to connection: %v", err)
+		return err
+	}
+	res.Flush()
+	deadline.End()
+	closeEventsMetric.WithLabelValues(reason).Inc()
+	return nil
+}
+
+// writeCloseReason tells a stalled client from a broken connection.
+func writeCloseReason(err error) string {
+	if errors.Is(err, errWriteTimeout) {
+		writeTimeoutsMetric.Inc()
+		return closeReasonWriteTimeout
+	}
+	return closeReasonWriteError
+}
+
+// nextBatch collects up to SSE_BATCH_SIZE queued messages starting with first,
+// waiting at most SSE_BATCH_WINDOW_MS for more to arrive, so they can be flushed at once.
+func nextBatch(session *Session, first datatype.SseMessage) []datatype.SseMessage {
+	batch := []datatype.SseMessage{first}
+	var timeout <-chan time.Time
+	if window := config.Config.SSEBatchWindow; window > 0 && config.Config.SSEBatchSize > 1 {
+		timer := time.NewTimer(time.Duration(window) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for len(batch) < config.Config.SSEBatchSize {
+		if timeout == nil {
+			select {
+			case msg := <-session.MessageCh:
+				batch = append(batch, msg)
+				continue
+			default:
+				return batch
+			}
+		}
+		select {
+		case msg := <-session.MessageCh:
+			batch = append(batch, msg)
+		case <-timeout:
+			return batch
+		case <-session.Closer:
+			return batch
+		}
+	}
+	return batch
+}
+
+// deliver writes batch to the stream with a single flush.
+func (h *handler) deliver(ctx context.Context, res *echo.Response, deadline *writeDeadline, session *Session, clientId string, batch []datatype.SseMessage) error {
+	batch = h.delivered.suppressDuplicates(batch)
+	if len(batch) == 0 {
+		return nil
+	}
+	for i := range batch {
+		if batch[i].EventId != queueDoneEventId {
+			batch[i] = h.hooks.OnDeliver(ctx, batch[i])
+		}
+	}
+	// only the writes are limited by the deadline, the hooks and the bookkeeping below may take their time
+	deadline.Begin()
+	err := h.writeBatch(res, session, batch)
+	if timeout := deadline.End(); timeout != nil && err == nil {
+		err = timeout
+	}
+	if err != nil {
+		// messages stay in storage until their ttl expires and the client's Last-Event-ID
+		// still points before them, so they are replayed when the client reconnects.
+		for _, msg := range batch {
+			if msg.EventId == queueDoneEventId {
+				continue
+			}
+			undeliveredMessagesMetric.Inc()
+			h.tracer.Record(traceEvent{EventId: msg.EventId, Stage: traceStageUndelivered, ClientId: clientId, Details: err.Error()})
+		}
+		return err
+	}
+	now := time.Now()
+	for _, msg := range batch {
+		if msg.EventId == queueDoneEventId {
+			continue
+		}
+		deliveredMessagesMetric.Inc()
+		h.topClients.Add(msg.To, clientCountDelivered, 1, now)
+		h.watermarks.Delivered(msg.To, msg.EventId)
+		h.digests.Delivered(msg.To, msg.EventId)
+		if p, ok := h.receipts.Take(msg.To, msg.EventId); ok {
+			msg := msg
+			if !h.receiptPool.Submit(func() { h.sendReceipt(msg, p, now) }) {
+				log.WithField("prefix", "deliver").Warnf("delivery receipt for %v dropped, the queue is full", msg.EventId)
+			}
+		}
+		h.consume(msg.To, msg.EventId)
+		h.tracer.Record(traceEvent{EventId: msg.EventId, Stage: traceStageDelivered, ClientId: clientId})
+	}
+	return nil
+}
+
+// writeBatch writes the events of batch and flushes them.
+func (h *handler) writeBatch(res *echo.Response, session *Session, batch []datatype.SseMessage) error {
+	for _, msg := range batch {
+		if msg.EventId == queueDoneEventId {
+			if _, err := res.Write(queueDoneEvent()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeSseMessage(res, h.formatEventId(msg.EventId), msg, session.strict); err != nil {
+			return err
+		}
+	}
+	res.Flush()
+	return nil
+}
+
+// queueDoneEvent tells a client that asked for it with enable_queue_done_event
+// that the history is replayed and the following messages are live.
+func queueDoneEvent() []byte {
+	var buf bytes.Buffer
+	encodeSseEvent(&buf, "", "queue_done", []byte("{}"))
+	return buf.Bytes()
+}
+
+type heartbeatData struct {
+	Ts          int64 `json:"ts,omitempty"`
+	ServerTime  int64 `json:"server_time,omitempty"`
+	LastEventId int64 `json:"last_event_id,omitempty"`
+	Backlog     *int  `json:"backlog,omitempty"`
+}
+
+// heartbeat returns the heartbeat event for session.
+// It is a bare "heartbeat" event unless rtt measurement or heartbeat metadata are enabled.
+func (h *handler) heartbeat(session *Session, now time.Time) string {
+	var data heartbeatData
+	if config.Config.HeartbeatRTT {
+		data.Ts = now.UnixMicro()
+		if session.MarkHeartbeat(data.Ts) {
+			h.stats.HeartbeatMissed(session.ClientIds, now)
+		}
+	}
+	if config.Config.HeartbeatMetadata {
+		backlog := len(session.MessageCh)
+		data.ServerTime = now.UnixMilli()
+		data.LastEventId = h.watermarks.NewestStored(session.ClientIds)
+		data.Backlog = &backlog
+	}
+	var b []byte
+	if data != (heartbeatData{}) {
+		b, _ = json.Marshal(data)
+	}
+	if b == nil && !session.strict {
+		// legacy clients get a heartbeat without data, spec compliant parsers don't dispatch it
+		return "event: heartbeat\n\n"
+	}
+	var buf bytes.Buffer
+	encodeSseEvent(&buf, "", "heartbeat", b)
+	return buf.String()
+}
+
+// connectedData is the payload of the first event of a stream, it lets SDKs tune their reconnection logic.
+type connectedData struct {
+	Version           string   `json:"version"`
+	HeartbeatInterval int      `json:"heartbeat_interval"`
+	ClientIds         []string `json:"client_ids"`
+	ServerTime        int64    `json:"server_time"`
+}
+
+// connectedEvent returns the first event of a stream: the reconnection delay preferred by the bridge
+// in the retry field, unless SSE_RETRY_MS is 0, and connectedData.
+func connectedEvent(session *Session, now time.Time) string {
+	var buf bytes.Buffer
+	if config.Config.SSERetry > 0 {
+		writeSseField(&buf, "retry", strconv.Itoa(config.Config.SSERetry))
+	}
+	data, _ := json.Marshal(connectedData{
+		Version:           version,
+		HeartbeatInterval: config.Config.HeartbeatInterval,
+		ClientIds:         session.ClientIds,
+		ServerTime:        now.UnixMilli(),
+	})
+	encodeSseEvent(&buf, "", "connected", data)
+	return buf.String()
+}
+
+// copyToURL posts a copy of an accepted message to CopyToURL with the original query.
+func (h *handler) copyToURL(destination string, params url.Values, headers http.Header, message []byte) {
+	start := time.Now()
+	err := postCopy(h.copyClient, params, headers, message)
+	recordSideEffect(h.sideEffects, sideEffectCopy, destination, 0, time.Since(start), err, false)
+}
+
+func postCopy(client *http.Client, params url.Values, headers http.Header, message []byte) error {
+	u, err := url.Parse(config.Config.CopyToURL)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(message))
+	if err != nil {
+		return err
+	}
+	req.Header = headers
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("bad status code: %v", res.StatusCode)
+	}
+	return nil
+}
+
+// maxForwardedHeaderLength limits the size of original request headers forwarded to CopyToURL.
+const maxForwardedHeaderLength = 256
+
+// sanitizeHeader drops control and non-ascii characters from v and truncates it.
+func sanitizeHeader(v string) string {
+	var b strings.Builder
+	for _, r := range v {
+		if b.Len() >= maxForwardedHeaderLength {
+			break
+		}
+		if r >= 0x20 && r < 0x7f {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// writeSseMessage writes msg as a single SSE event with the given id, with canonical framing if strict is set.
+// The event is written with one call so a failed write never leaves a complete event with a wrong id behind:
+// SSE clients discard events that are not terminated by an empty line.
+func writeSseMessage(w io.Writer, id string, msg datatype.SseMessage, strict bool) error {
+	var buf bytes.Buffer
+	if strict {
+		encodeSseEvent(&buf, id, "message", msg.Message)
+	} else {
+		// the legacy order of fields, clients may depend on it
+		writeSseField(&buf, "event", "message")
+		writeSseField(&buf, "id", id)
+		writeSseData(&buf, msg.Message)
+		buf.WriteByte('\n')
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
 func (h *handler) SendMessageHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	log := log.WithContext(ctx).WithField("prefix", "SendMessageHandler")
+	sdk := countSdk(c.Request().Header.Get(sdkHeader), "message")
+	if sdk != sdkUnknown {
+		log = log.WithField("sdk", sdk)
+	}
+	if state := h.readOnly.State(); state.Enabled {
+		return rejectReadOnly(c, state)
+	}
 
 	params := c.QueryParams()
 	clientId, ok := params["client_id"]
@@ -179,6 +698,21 @@ func (h *handler) SendMessageHandler(c echo.Context) error {
 		return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
 	}
 
+	var idempotencyKey string
+	if key := c.Request().Header.Get("Idempotency-Key"); key != "" && h.idempotency != nil {
+		idempotencyKey = clientId[0] + ":" + key
+		prev, ok := h.idempotency.Begin(idempotencyKey)
+		if !ok {
+			if !prev.done {
+				return c.JSON(HttpResError("request with the same Idempotency-Key is in progress", http.StatusConflict))
+			}
+			idempotentReplaysMetric.Inc()
+			c.Response().Header().Set("Idempotent-Replayed", "true")
+			return c.JSON(http.StatusOK, prev.res)
+		}
+		defer h.idempotency.Abort(idempotencyKey)
+	}
+
 	toId, ok := params["to"]
 	if !ok {
 		badRequestMetric.Inc()
@@ -186,6 +720,17 @@ func (h *handler) SendMessageHandler(c echo.Context) error {
 		log.Error(errorMsg)
 		return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
 	}
+	if toId[0] == clientId[0] {
+		// real TON Connect flows never send to themselves, it's a broken or abusive client
+		selfSentMessagesMetric.Inc()
+		if config.Config.RejectSelfSend {
+			badRequestMetric.Inc()
+			errorMsg := "param \"to\" must differ from \"client_id\""
+			log.Error(errorMsg)
+			return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
+		}
+		log.Warnf("client %v sends a message to itself", logId(clientId[0]))
+	}
 
 	ttlParam, ok := params["ttl"]
 	if !ok {
@@ -200,78 +745,351 @@ func (h *handler) SendMessageHandler(c echo.Context) error {
 		log.Error(err)
 		return c.JSON(HttpResError(err.Error(), http.StatusBadRequest))
 	}
-	if ttl > 300 { // TODO: config
+	ttl, err = checkTTL(ttl, params.Get("topic"))
+	if err != nil {
 		badRequestMetric.Inc()
-		errorMsg := "param \"ttl\" too high"
-		log.Error(errorMsg)
-		return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
+		log.Error(err)
+		return c.JSON(HttpResError(err.Error(), http.StatusBadRequest))
 	}
 	message, err := io.ReadAll(c.Request().Body)
-	if err != nil {
+	if errors.Is(err, errBodyTooLarge) {
 		badRequestMetric.Inc()
 		log.Error(err)
-		return c.JSON(HttpResError(err.Error(), http.StatusBadRequest))
+		return c.JSON(HttpResError(err.Error(), http.StatusRequestEntityTooLarge))
 	}
-	mes, err := json.Marshal(datatype.BridgeMessage{
-		From:    clientId[0],
-		Message: string(message),
-	})
 	if err != nil {
 		badRequestMetric.Inc()
 		log.Error(err)
 		return c.JSON(HttpResError(err.Error(), http.StatusBadRequest))
 	}
-	if config.Config.CopyToURL != "" {
-		go func() {
-			u, err := url.Parse(config.Config.CopyToURL)
-			if err != nil {
-				return
-			}
-			u.RawQuery = params.Encode()
-			req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(message))
-			if err != nil {
-				return
+	ttl = disconnectTTL(ttl, params.Get("topic"), len(message))
+	senderVerified := false
+	if config.Config.SenderSignature != senderSignatureOff {
+		signature := c.Request().Header.Get("X-Signature")
+		if signature == "" && config.Config.SenderSignature == senderSignatureRequired {
+			badRequestMetric.Inc()
+			errorMsg := "header \"X-Signature\" not present"
+			log.Error(errorMsg)
+			return c.JSON(HttpResError(errorMsg, http.StatusUnauthorized))
+		}
+		if signature != "" {
+			if err := verifySenderSignature(clientId[0], toId[0], ttlParam[0], message, signature); err != nil {
+				badRequestMetric.Inc()
+				log.Error(err)
+				return c.JSON(HttpResError(err.Error(), http.StatusUnauthorized))
 			}
-			http.DefaultClient.Do(req)
-		}()
+			senderVerified = true
+		}
+	}
+	bridgeMessage := datatype.BridgeMessage{
+		From:           clientId[0],
+		Message:        string(message),
+		SenderVerified: senderVerified,
+	}
+	if params.Get("no_request_source") != "true" {
+		source, err := encryptRequestSource(requestContext(c), toId[0], time.Now())
+		if err != nil && !errors.Is(err, errNotWalletKey) {
+			log.Errorf("encrypt request source: %v", err)
+		}
+		bridgeMessage.RequestSource = source
+	}
+	mes, err := json.Marshal(h.hooks.OnSend(ctx, bridgeMessage))
+	if err != nil {
+		badRequestMetric.Inc()
+		log.Error(err)
+		return c.JSON(HttpResError(err.Error(), http.StatusBadRequest))
 	}
 	topic, ok := params["topic"]
-	if ok {
-		go func(clientID, topic, message string) {
-			SendWebhook(clientID, WebhookData{Topic: topic, Hash: message})
-		}(clientId[0], topic[0], string(message))
+	if ok && topic[0] == "connect" && config.Config.PayloadLint {
+		for _, problem := range lintConnectPayload(message) {
+			payloadLintWarningsMetric.WithLabelValues(problem).Inc()
+			log.Warnf("connect payload from %v violates spec: %v", logId(clientId[0]), problem)
+		}
 	}
 
 	sseMessage := datatype.SseMessage{
 		EventId: h.nextID(),
 		Message: mes,
+		To:      toId[0],
+	}
+	traceId := c.QueryParam("trace_id")
+	if traceId == "" {
+		traceId = newTraceId()
+	}
+	c.Response().Header().Set("X-Trace-Id", traceId)
+	h.tracer.Record(traceEvent{
+		TraceId:  traceId,
+		EventId:  sseMessage.EventId,
+		Stage:    traceStageReceived,
+		ClientId: toId[0],
+		Details:  fmt.Sprintf("from=%v ttl=%v size=%v sdk=%v", clientId[0], ttl, len(message), sdk),
+	})
+	// the receipt is wanted before dispatch, the message may be written to a stream before it returns
+	wantReceipt := params.Get("delivery_receipt") == "true"
+	if wantReceipt {
+		h.receipts.Want(toId[0], sseMessage.EventId, clientId[0], ttl, time.Now())
+	}
+	// messages of the conformance checks are synthetic, nobody outside of the bridge should hear about them
+	synthetic := isConformanceRequest(c.Request())
+	if synthetic {
+		ctx = withSynthetic(ctx)
+	}
+	dispatched, err := h.dispatch(ctx, toId[0], ttl, traceId, sseMessage)
+	if config.Config.ServerTiming {
+		c.Response().Header().Set(serverTimingHeader, serverTiming(dispatched))
+		c.Response().Header().Set("Timing-Allow-Origin", "*")
+	}
+	if errors.Is(err, errStorageUnavailable) {
+		if config.Config.StorageDownPolicy == storagePolicyFailClosed {
+			// the message doesn't exist, nothing may announce or copy it
+			if wantReceipt {
+				h.receipts.Take(toId[0], sseMessage.EventId)
+			}
+			log.Error(err)
+			return c.JSON(HttpResError(err.Error(), http.StatusServiceUnavailable))
+		}
+		c.Response().Header().Set(storedHeader, "false")
+	}
+	if topic, ok := params["topic"]; ok && !synthetic {
+		h.webhooks.Send(clientId[0], WebhookData{Topic: topic[0], Hash: string(message)})
+	}
+	if config.Config.CopyToURL != "" && !synthetic {
+		headers := http.Header{}
+		headers.Set("X-Bridge-Event-Id", strconv.FormatInt(sseMessage.EventId, 10))
+		headers.Set("X-Trace-Id", traceId)
+		rc := requestContext(c)
+		if rc.Origin != "" {
+			headers.Set("X-Original-Origin", rc.Origin)
+		}
+		if rc.UserAgent != "" {
+			headers.Set("X-Original-User-Agent", rc.UserAgent)
+		}
+		destination := sideEffectDestination(config.Config.CopyToURL)
+		if !h.copyPool.Submit(func() { h.copyToURL(destination, params, headers, message) }) {
+			sideEffectCallsMetric.WithLabelValues(sideEffectCopy, destination, sideEffectDropped).Inc()
+		}
+	}
+	warnSoftLimit(c, "queue", dispatched.Queued, sessionQueueSize)
+	if h.audit != nil && !synthetic {
+		record := datatype.AuditRecord{
+			EventId:   sseMessage.EventId,
+			FromHash:  hashClientId(clientId[0]),
+			ToHash:    hashClientId(toId[0]),
+			Size:      len(message),
+			TTL:       ttl,
+			CreatedAt: time.Now(),
+		}
+		if topic, ok := params["topic"]; ok {
+			record.Topic = topic[0]
+		}
+		h.storagePool.Submit(func() {
+			if err := h.audit.AddAuditRecord(context.Background(), record); err != nil {
+				log.Errorf("audit log: %v", err)
+			}
+		})
+	}
+
+	transferedMessagesNumMetric.Inc()
+	h.transfered.Count(clientId[0], toId[0], message, time.Now())
+	h.topClients.Add(clientId[0], clientCountSent, 1, time.Now())
+	if !synthetic {
+		h.digests.Pending(toId[0], sseMessage.EventId, params.Get("topic"), ttl, time.Now())
 	}
+	res := SendMessageRes{HttpRes: HttpResOk(), TTL: ttl, EventId: sseMessage.EventId}
+	if idempotencyKey != "" {
+		h.idempotency.Finish(idempotencyKey, res)
+	}
+	return c.JSON(http.StatusOK, res)
+
+}
+
+const serverTimingHeader = "Server-Timing"
+
+// serverTiming formats the durations of res as a Server-Timing header value in milliseconds.
+// persist is omitted when the message is stored in the background.
+func serverTiming(res dispatchResult) string {
+	timing := fmt.Sprintf("fanout;dur=%.3f", float64(res.FanOut)/float64(time.Millisecond))
+	if res.Persisted {
+		timing = fmt.Sprintf("persist;dur=%.3f, %v", float64(res.Persist)/float64(time.Millisecond), timing)
+	}
+	return timing
+}
+
+// dispatchResult describes how a message was dispatched.
+type dispatchResult struct {
+	// Queued is the number of messages waiting in the fullest session queue of the receiver.
+	Queued int
+	// Persisted reports whether the message was stored before dispatch returned, Persist is how long it took.
+	Persisted bool
+	Persist   time.Duration
+	// FanOut is how long handing the message to the connected sessions took.
+	FanOut time.Duration
+}
+
+// dispatch hands sseMessage to the connected sessions of to and persists it according to STORAGE_DOWN_POLICY.
+// The error is errStorageUnavailable if the message was rejected or only delivered live because storage failed.
+func (h *handler) dispatch(ctx context.Context, to string, ttl int64, traceId string, sseMessage datatype.SseMessage) (res dispatchResult, err error) {
+	persist := func(ctx context.Context) error {
+		start := time.Now()
+		err := h.persist(ctx, to, ttl, traceId, sseMessage)
+		res.Persisted, res.Persist = true, time.Since(start)
+		return err
+	}
+	fanOut := func() {
+		start := time.Now()
+		res.Queued = h.fanOut(ctx, to, sseMessage)
+		if h.recent != nil {
+			h.recent.Add(ctx, to, ttl, sseMessage)
+		}
+		if !isSynthetic(ctx) {
+			h.publish(ctx, sseMessage)
+		}
+		res.FanOut = time.Since(start)
+	}
+	switch config.Config.StorageDownPolicy {
+	case storagePolicyFailClosed:
+		if err := persist(ctx); err != nil {
+			storageWriteFailuresMetric.WithLabelValues(storagePolicyFailClosed).Inc()
+			return res, errStorageUnavailable
+		}
+		fanOut()
+	case storagePolicyLiveOnly:
+		if err := persist(ctx); err != nil {
+			storageWriteFailuresMetric.WithLabelValues(storagePolicyLiveOnly).Inc()
+			fanOut()
+			return res, errStorageUnavailable
+		}
+		fanOut()
+	case storagePolicyRetry:
+		fanOut()
+		deadline := time.Now().Add(time.Duration(ttl) * time.Second)
+		h.storagePool.Submit(func() {
+			h.persistWithRetry(to, ttl, traceId, sseMessage, 1, storageRetryBackoff, deadline)
+		})
+	default:
+		fanOut()
+		h.storagePool.Submit(func() {
+			if err := h.persist(context.Background(), to, ttl, traceId, sseMessage); err != nil {
+				storageWriteFailuresMetric.WithLabelValues(storagePolicyFailOpen).Inc()
+			}
+		})
+	}
+	return res, nil
+}
+
+// fanOut hands sseMessage to the connected sessions of to
+// and returns the number of messages waiting in the fullest session queue.
+func (h *handler) fanOut(ctx context.Context, to string, sseMessage datatype.SseMessage) (queued int) {
 	h.Mux.RLock()
-	s, ok := h.Connections[toId[0]]
+	s, ok := h.Connections[to]
 	h.Mux.RUnlock()
 	if ok {
 		s.mux.Lock()
 		for _, ses := range s.Sessions {
 			ses.AddMessageToQueue(ctx, sseMessage)
+			if l := len(ses.MessageCh); l > queued {
+				queued = l
+			}
 		}
 		s.mux.Unlock()
 	}
-	go func() {
-		log := log.WithField("prefix", "SendMessageHandler.storge.Add")
-		err = h.storage.Add(context.Background(), toId[0], ttl, sseMessage)
-		if err != nil {
-			log.Errorf("db error: %v", err)
+	return queued
+}
+
+// persist writes sseMessage to the storage and records the outcome.
+func (h *handler) persist(ctx context.Context, to string, ttl int64, traceId string, sseMessage datatype.SseMessage) error {
+	log := log.WithField("prefix", "SendMessageHandler.storge.Add")
+	err := h.storage.Add(ctx, to, jitterTTL(ttl), sseMessage)
+	if err != nil {
+		log.Errorf("db error: %v", err)
+		h.health.Failure("storage", err)
+		h.tracer.Record(traceEvent{TraceId: traceId, EventId: sseMessage.EventId, Stage: traceStageStoreFailed, ClientId: to, Details: err.Error()})
+		return err
+	}
+	h.health.Success("storage")
+	h.watermarks.Stored(to, sseMessage.EventId)
+	if h.remover != nil && h.consumed.Take(to, sseMessage.EventId) {
+		h.removeMessage(to, sseMessage.EventId)
+	}
+	if h.acked.Take(to, sseMessage.EventId) {
+		if remover, ok := h.storage.(messageRemover); ok {
+			if err := remover.Remove(ctx, to, sseMessage.EventId); err != nil {
+				log.Errorf("remove acknowledged %v: %v", sseMessage.EventId, err)
+			}
 		}
-	}()
+	}
+	h.tracer.Record(traceEvent{TraceId: traceId, EventId: sseMessage.EventId, Stage: traceStageStored, ClientId: to})
+	return nil
+}
 
-	transferedMessagesNumMetric.Inc()
-	return c.JSON(http.StatusOK, HttpResOk())
+// lagWatcher periodically exports delivery lag of connected clients.
+func (h *handler) lagWatcher() {
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+		maxLag, lagging := h.watermarks.Lag(func(clientId string) bool {
+			h.Mux.RLock()
+			defer h.Mux.RUnlock()
+			_, ok := h.Connections[clientId]
+			return ok
+		}, time.Now().Add(-10*time.Minute))
+		maxDeliveryLagMetric.Set(float64(maxLag))
+		laggingClientsMetric.Set(float64(lagging))
+	}
+}
 
+func (h *handler) HeartbeatAckHandler(c echo.Context) error {
+	log := log.WithField("prefix", "HeartbeatAckHandler")
+	params := c.QueryParams()
+	clientId, ok := params["client_id"]
+	if !ok {
+		badRequestMetric.Inc()
+		errorMsg := "param \"client_id\" not present"
+		log.Error(errorMsg)
+		return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
+	}
+	tsParam, ok := params["ts"]
+	if !ok {
+		badRequestMetric.Inc()
+		errorMsg := "param \"ts\" not present"
+		log.Error(errorMsg)
+		return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
+	}
+	ts, err := strconv.ParseInt(tsParam[0], 10, 64)
+	if err != nil {
+		badRequestMetric.Inc()
+		errorMsg := "param \"ts\" should be int"
+		log.Error(errorMsg)
+		return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
+	}
+
+	now := time.Now()
+	acked := false
+	h.Mux.RLock()
+	s, ok := h.Connections[clientId[0]]
+	h.Mux.RUnlock()
+	if ok {
+		s.mux.RLock()
+		for _, ses := range s.Sessions {
+			if rtt, ok := ses.AckHeartbeat(ts, now); ok {
+				heartbeatRTTMetric.Observe(rtt.Seconds())
+				acked = true
+			}
+		}
+		s.mux.RUnlock()
+	}
+	if !acked {
+		return c.JSON(HttpResError("heartbeat not found", http.StatusNotFound))
+	}
+	return c.JSON(http.StatusOK, HttpResOk())
 }
 
 func (h *handler) removeConnection(ses *Session) {
 	log := log.WithField("prefix", "removeConnection")
-	log.Infof("remove session: %v", ses.ClientIds)
+	log.Infof("remove session: %v", logIds(ses.ClientIds))
 	for _, id := range ses.ClientIds {
 		h.Mux.RLock()
 		s, ok := h.Connections[id]
@@ -280,15 +1098,21 @@ func (h *handler) removeConnection(ses *Session) {
 			log.Info("alredy removed")
 			continue
 		}
+		removed := false
 		s.mux.Lock()
 		for i := range s.Sessions {
 			if s.Sessions[i] == ses {
 				s.Sessions[i] = s.Sessions[len(s.Sessions)-1]
 				s.Sessions = s.Sessions[:len(s.Sessions)-1]
+				removed = true
 				break
 			}
 		}
 		s.mux.Unlock()
+		if !removed {
+			// the session has been replaced and unsubscribed already
+			continue
+		}
 
 		if len(s.Sessions) == 0 {
 			h.Mux.Lock()
@@ -299,11 +1123,55 @@ func (h *handler) removeConnection(ses *Session) {
 	}
 }
 
+// replaceSessions closes the other sessions subscribed only to client ids that next is also subscribed to
+// and unsubscribes them right away, so new messages go to next alone.
+// Sessions with client ids next doesn't cover are left alone not to cut their subscriptions.
+func (h *handler) replaceSessions(next *Session) {
+	covered := make(map[string]bool, len(next.ClientIds))
+	for _, id := range next.ClientIds {
+		covered[id] = true
+	}
+	var replaced []*Session
+	h.Mux.RLock()
+	for _, id := range next.ClientIds {
+		s, ok := h.Connections[id]
+		if !ok {
+			continue
+		}
+		s.mux.RLock()
+	sessions:
+		for _, ses := range s.Sessions {
+			if ses == next {
+				continue
+			}
+			for _, r := range replaced {
+				if r == ses {
+					continue sessions
+				}
+			}
+			for _, sid := range ses.ClientIds {
+				if !covered[sid] {
+					continue sessions
+				}
+			}
+			replaced = append(replaced, ses)
+		}
+		s.mux.RUnlock()
+	}
+	h.Mux.RUnlock()
+	for _, ses := range replaced {
+		h.removeConnection(ses)
+		ses.Replace(next)
+	}
+}
+
 func (h *handler) CreateSession(sessionId string, clientIds []string, lastEventId int64) *Session {
 	log := log.WithField("prefix", "CreateSession")
-	log.Infof("make new session with ids: %v", clientIds)
+	log.Infof("make new session with ids: %v", logIds(clientIds))
 	session := NewSession(h.storage, clientIds, lastEventId)
+	session.onReplayed = h.sessionReplayed
 	activeConnectionMetric.Inc()
+	h.stats.Connected(clientIds, session.StartedAt)
 	for _, id := range clientIds {
 		h.Mux.RLock()
 		s, ok := h.Connections[id]
@@ -326,6 +1194,44 @@ func (h *handler) CreateSession(sessionId string, clientIds []string, lastEventI
 	return session
 }
 
+// CloseAllSessions sends a close event with reason to every connected client.
+func (h *handler) CloseAllSessions(reason string) {
+	h.Mux.RLock()
+	defer h.Mux.RUnlock()
+	for _, s := range h.Connections {
+		s.mux.RLock()
+		for _, ses := range s.Sessions {
+			ses.Kick(reason)
+		}
+		s.mux.RUnlock()
+	}
+}
+
+// nextID returns a unique, increasing event id which is never less than the current unix time in microseconds,
+// so an id can be derived from a point in time (see sinceEventId). It is called for every message and doesn't allocate.
 func (h *handler) nextID() int64 {
-	return atomic.AddInt64(&h._eventIDs, 1)
+	for {
+		last := atomic.LoadInt64(&h._eventIDs)
+		id := last + 1
+		if now := time.Now().UnixMicro(); now > id {
+			id = now
+		}
+		if atomic.CompareAndSwapInt64(&h._eventIDs, last, id) {
+			return id
+		}
+	}
+}
+
+// sinceEventId converts since, either an RFC3339 time or a duration like "15m" back from now,
+// into a last event id that makes the storage replay every message created after that moment.
+func sinceEventId(since string, now time.Time) (int64, error) {
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		d, derr := time.ParseDuration(since)
+		if derr != nil || d < 0 {
+			return 0, fmt.Errorf("since should be RFC3339 time or positive duration")
+		}
+		t = now.Add(-d)
+	}
+	return t.UnixMicro() - 1, nil
 }
@@ -0,0 +1,1019 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tonkeeper/bridge/config"
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+type sseEvent struct {
+	name string
+	id   string
+	data string
+}
+
+// readEvents parses an SSE stream and sends every event but the initial "connected" one
+// to the returned channel until the stream ends.
+func readEvents(res *http.Response) <-chan sseEvent {
+	events := make(chan sseEvent, 100)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(res.Body)
+		var e sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if e.name != "" && e.name != "connected" {
+					events <- e
+				}
+				e = sseEvent{}
+			case strings.HasPrefix(line, "event: "):
+				e.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events
+}
+
+func subscribe(ctx context.Context, url, clientId, lastEventId string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/bridge/events?client_id="+clientId, nil)
+	if err != nil {
+		return nil, err
+	}
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func send(t *testing.T, url, from, to, message string) {
+	t.Helper()
+	res, err := http.Post(fmt.Sprintf("%v/bridge/message?client_id=%v&to=%v&ttl=60", url, from, to), "text/plain", strings.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("send: bad status code %v", res.StatusCode)
+	}
+}
+
+// TestDisconnectBetweenReplayAndLive kills the client socket right after the storage replay
+// and checks that messages sent during the gap are delivered after reconnecting with Last-Event-ID.
+func TestDisconnectBetweenReplayAndLive(t *testing.T) {
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	send(t, srv.URL, "dapp", "wallet", "before connect")
+	waitStored(t, storage, "wallet", 1)
+
+	ctx, disconnect := context.WithCancel(context.Background())
+	gap := make(chan struct{})
+	var once sync.Once
+	h.sessionReplayed = func(s *Session) {
+		once.Do(func() {
+			disconnect()
+			<-s.Closer
+			close(gap)
+		})
+	}
+
+	received := map[string]int{}
+	var lastEventId string
+	// the client may be disconnected even before it gets the response headers
+	if res, err := subscribe(ctx, srv.URL, "wallet", ""); err == nil {
+		for e := range readEvents(res) {
+			if e.name == "message" {
+				received[e.data]++
+				lastEventId = e.id
+			}
+		}
+	}
+	<-gap
+	send(t, srv.URL, "dapp", "wallet", "during gap")
+	waitStored(t, storage, "wallet", 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := subscribe(ctx, srv.URL, "wallet", lastEventId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := readEvents(res)
+	for received[`{"from":"dapp","message":"before connect"}`] == 0 || received[`{"from":"dapp","message":"during gap"}`] == 0 {
+		e, ok := <-events
+		if !ok {
+			t.Fatalf("messages lost after reconnect, received: %v", received)
+		}
+		if e.name == "message" {
+			received[e.data]++
+		}
+	}
+}
+
+func TestQueueDoneEvent(t *testing.T) {
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	send(t, srv.URL, "dapp", "wallet", "first")
+	send(t, srv.URL, "dapp", "wallet", "second")
+	waitStored(t, storage, "wallet", 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := subscribe(ctx, srv.URL, "wallet&enable_queue_done_event=true", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := readEvents(res)
+	var names []string
+	for len(names) < 3 {
+		e, ok := <-events
+		if !ok {
+			t.Fatalf("stream ended after %v", names)
+		}
+		if e.name != "heartbeat" {
+			names = append(names, e.name)
+		}
+	}
+	if want := []string{"message", "message", "queue_done"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("want %v, got %v", want, names)
+	}
+}
+
+func waitStored(t *testing.T, storage db, clientId string, count int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		messages, _ := storage.GetMessages(context.Background(), []string{clientId}, 0)
+		if len(messages) >= count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%v messages for %v were not stored", count, clientId)
+}
+
+func TestSendMessageHandler_IdempotencyKey(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	h.idempotency = newIdempotencyCache(time.Minute)
+	e := echo.New()
+	registerHandlers(e, h)
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/bridge/message?client_id=dapp&to=wallet&ttl=60", strings.NewReader("hello"))
+		req.Header.Set("Idempotency-Key", "retry-1")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	first, second := send(), send()
+	if first.Code != http.StatusOK || second.Code != http.StatusOK {
+		t.Fatalf("bad status codes: %v, %v", first.Code, second.Code)
+	}
+	if first.Body.String() != second.Body.String() {
+		t.Fatalf("retry returned a different result: %v != %v", first.Body.String(), second.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("retry must be marked as replayed")
+	}
+}
+
+// failingWriter accepts writes until the first message event and then fails in the middle of it.
+type failingWriter struct {
+	httptest.ResponseRecorder
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if strings.HasPrefix(string(b), "event: message") {
+		n, _ := w.ResponseRecorder.Write(b[:len(b)/2])
+		return n, io.ErrUnexpectedEOF
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestEventRegistrationHandler_PartialWrite(t *testing.T) {
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	send(t, srv.URL, "dapp", "wallet", "hello")
+	waitStored(t, storage, "wallet", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/bridge/events?client_id=wallet", nil).WithContext(ctx)
+	w := &failingWriter{ResponseRecorder: *httptest.NewRecorder()}
+	undelivered := counterValue(undeliveredMessagesMetric)
+	if err := h.EventRegistrationHandler(e.NewContext(req, w)); err != nil {
+		t.Fatal(err)
+	}
+	if got := counterValue(undeliveredMessagesMetric) - undelivered; got != 1 {
+		t.Fatalf("want 1 undelivered message, got %v", got)
+	}
+	if strings.Contains(w.Body.String(), "event: message") && strings.HasSuffix(w.Body.String(), "\n\n") {
+		t.Fatalf("partial write produced a complete event: %q", w.Body.String())
+	}
+	messages, err := storage.GetMessages(context.Background(), []string{"wallet"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("undelivered message must stay in storage, got %v messages", len(messages))
+	}
+
+	res, err := subscribe(ctx, srv.URL, "wallet", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2 := <-readEvents(res)
+	if e2.name != "message" || e2.id != strconv.FormatInt(messages[0].EventId, 10) {
+		t.Fatalf("message was not replayed after reconnect: %+v", e2)
+	}
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	c.Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func gaugeValue(g prometheus.Gauge) float64 {
+	m := &dto.Metric{}
+	g.Write(m)
+	return m.GetGauge().GetValue()
+}
+
+func TestWriteSseMessage(t *testing.T) {
+	var buf strings.Builder
+	err := writeSseMessage(&buf, "7", datatype.SseMessage{EventId: 7, Message: []byte(`{"from":"a"}`)}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "event: message\nid: 7\ndata: {\"from\":\"a\"}\n\n"; buf.String() != want {
+		t.Fatalf("want %q, got %q", want, buf.String())
+	}
+}
+
+func TestSinceEventId(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		since   string
+		want    int64
+		wantErr bool
+	}{
+		{since: "2023-05-01T11:00:00Z", want: now.Add(-time.Hour).UnixMicro() - 1},
+		{since: "15m", want: now.Add(-15*time.Minute).UnixMicro() - 1},
+		{since: "-15m", wantErr: true},
+		{since: "yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.since, func(t *testing.T) {
+			got, err := sinceEventId(tt.since, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNextID_NotBeforeNow(t *testing.T) {
+	h := &handler{}
+	before := time.Now().UnixMicro()
+	first := h.nextID()
+	if first < before {
+		t.Fatalf("id %v is older than %v", first, before)
+	}
+	if second := h.nextID(); second <= first {
+		t.Fatalf("ids must increase: %v, %v", first, second)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { h.nextID() }); allocs != 0 {
+		t.Fatalf("nextID allocates %v times", allocs)
+	}
+}
+
+func BenchmarkNextID(b *testing.B) {
+	h := &handler{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.nextID()
+	}
+}
+
+func BenchmarkNextID_Parallel(b *testing.B) {
+	h := &handler{}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h.nextID()
+		}
+	})
+}
+
+func TestSanitizeHeader(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{in: "https://app.example", want: "https://app.example"},
+		{in: "evil\r\nX-Injected: 1", want: "evilX-Injected: 1"},
+		{in: "тест ua", want: " ua"},
+		{in: strings.Repeat("a", 300), want: strings.Repeat("a", maxForwardedHeaderLength)},
+	}
+	for _, tt := range tests {
+		if got := sanitizeHeader(tt.in); got != tt.want {
+			t.Errorf("sanitizeHeader(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	defer func(c bool) { config.Config.HeartbeatMetadata = c }(config.Config.HeartbeatMetadata)
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	session := NewSession(h.storage, []string{"wallet", "other"}, 0)
+	now := time.UnixMilli(1682942400000)
+
+	config.Config.HeartbeatMetadata = false
+	if got := h.heartbeat(session, now); got != "event: heartbeat\n\n" {
+		t.Fatalf("unexpected default heartbeat %q", got)
+	}
+
+	config.Config.HeartbeatMetadata = true
+	h.watermarks.Stored("wallet", 42)
+	h.watermarks.Stored("other", 17)
+	want := "event: heartbeat\ndata: {\"server_time\":1682942400000,\"last_event_id\":42,\"backlog\":0}\n\n"
+	if got := h.heartbeat(session, now); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestDispatch_StoredWatermark(t *testing.T) {
+	defer func(p string) { config.Config.StorageDownPolicy = p }(config.Config.StorageDownPolicy)
+	config.Config.StorageDownPolicy = storagePolicyFailOpen
+	for name, storage := range map[string]db{
+		"stored": memory.NewStorage(),
+		"failed": failingStorage{db: memory.NewStorage()},
+	} {
+		h := newHandler(storage, time.Minute)
+		if _, err := h.dispatch(context.Background(), "wallet", 60, "", datatype.SseMessage{EventId: 42, To: "wallet"}); err != nil {
+			t.Fatal(err)
+		}
+		// waits for the background write
+		h.Close()
+		want := int64(42)
+		if name == "failed" {
+			want = 0
+		}
+		if got := h.watermarks.NewestStored([]string{"wallet"}); got != want {
+			t.Fatalf("%v: stored watermark = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestConnectedEvent(t *testing.T) {
+	defer func(retry int) { config.Config.SSERetry = retry }(config.Config.SSERetry)
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	session := NewSession(h.storage, []string{"wallet", "other"}, 0)
+	now := time.UnixMilli(1682942400000)
+
+	config.Config.SSERetry = 3000
+	want := fmt.Sprintf("retry: 3000\nevent: connected\ndata: {\"version\":%q,\"heartbeat_interval\":%v,\"client_ids\":[\"wallet\",\"other\"],\"server_time\":1682942400000}\n\n",
+		version, config.Config.HeartbeatInterval)
+	if got := connectedEvent(session, now); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	config.Config.SSERetry = 0
+	if got := connectedEvent(session, now); strings.Contains(got, "retry:") {
+		t.Fatalf("want no retry field, got %q", got)
+	}
+}
+
+func TestConsumeOnRead(t *testing.T) {
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	h.remover = storage
+	h.consumed = newConsumedMessages(time.Minute)
+	e := echo.New()
+	registerHandlers(e, h)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := subscribe(ctx, srv.URL, "wallet", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := readEvents(res)
+	send(t, srv.URL, "dapp", "wallet", "hello")
+	for ev := range events {
+		if ev.name == "message" {
+			break
+		}
+	}
+	for i := 0; i < 100; i++ {
+		stored := h.health.Report("").Dependencies["storage"].LastSuccess != nil
+		messages, _ := storage.GetMessages(context.Background(), []string{"wallet"}, 0)
+		if stored && len(messages) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("delivered message was not removed from storage")
+}
+
+// flushCounter is a ResponseWriter counting flushes.
+type flushCounter struct {
+	httptest.ResponseRecorder
+	flushes int
+}
+
+func (w *flushCounter) Flush() {
+	w.flushes++
+}
+
+func TestNextBatch(t *testing.T) {
+	defer func(size, window int) {
+		config.Config.SSEBatchSize, config.Config.SSEBatchWindow = size, window
+	}(config.Config.SSEBatchSize, config.Config.SSEBatchWindow)
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	session := NewSession(h.storage, []string{"wallet"}, 0)
+	for i := 2; i <= 5; i++ {
+		session.MessageCh <- datatype.SseMessage{EventId: int64(i)}
+	}
+
+	config.Config.SSEBatchSize, config.Config.SSEBatchWindow = 3, 0
+	batch := nextBatch(session, datatype.SseMessage{EventId: 1})
+	if len(batch) != 3 || batch[0].EventId != 1 || batch[2].EventId != 3 {
+		t.Fatalf("unexpected batch %v", batch)
+	}
+	batch = nextBatch(session, <-session.MessageCh)
+	if len(batch) != 2 {
+		t.Fatalf("batch must not wait without a window, got %v", batch)
+	}
+
+	config.Config.SSEBatchWindow = 20
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		session.MessageCh <- datatype.SseMessage{EventId: 7}
+	}()
+	batch = nextBatch(session, datatype.SseMessage{EventId: 6})
+	if len(batch) != 2 {
+		t.Fatalf("batch must wait for the window, got %v", batch)
+	}
+
+	rec := &flushCounter{ResponseRecorder: *httptest.NewRecorder()}
+	if err := h.deliver(context.Background(), echo.NewResponse(rec, echo.New()), nil, session, "wallet", batch); err != nil {
+		t.Fatal(err)
+	}
+	if rec.flushes != 1 || strings.Count(rec.Body.String(), "event: message") != 2 {
+		t.Fatalf("want 2 events in 1 flush, got %v flushes: %q", rec.flushes, rec.Body.String())
+	}
+}
+
+// BenchmarkDeliver streams b.N messages over a real connection with different batch sizes.
+func BenchmarkDeliver(b *testing.B) {
+	defer func(size int) { config.Config.SSEBatchSize = size }(config.Config.SSEBatchSize)
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	message := []byte(`{"from":"dapp","message":"` + strings.Repeat("a", 200) + `"}`)
+	for _, size := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("batch=%v", size), func(b *testing.B) {
+			config.Config.SSEBatchSize = size
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				res := echo.NewResponse(w, echo.New())
+				session := NewSession(h.storage, []string{"wallet"}, 0)
+				go func() {
+					for i := 0; i < b.N; i++ {
+						session.MessageCh <- datatype.SseMessage{EventId: int64(i), Message: message}
+					}
+				}()
+				for sent := 0; sent < b.N; {
+					batch := nextBatch(session, <-session.MessageCh)
+					if err := h.deliver(r.Context(), res, nil, session, "wallet", batch); err != nil {
+						return
+					}
+					sent += len(batch)
+				}
+			}))
+			defer srv.Close()
+			b.ResetTimer()
+			res, err := http.Get(srv.URL)
+			if err != nil {
+				b.Fatal(err)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		})
+	}
+}
+
+// failingStorage rejects every write.
+type failingStorage struct {
+	db
+}
+
+func (failingStorage) Add(ctx context.Context, key string, ttl int64, mes datatype.SseMessage) error {
+	return io.ErrClosedPipe
+}
+
+func TestSendMessageHandler_StorageDownPolicy(t *testing.T) {
+	defer func(p, hook string) {
+		config.Config.StorageDownPolicy, config.Config.WebhookURL = p, hook
+	}(config.Config.StorageDownPolicy, config.Config.WebhookURL)
+	config.Config.WebhookURL = "http://127.0.0.1:1/hook"
+	tests := []struct {
+		policy     string
+		wantCode   int
+		wantStored string
+	}{
+		{policy: storagePolicyFailOpen, wantCode: http.StatusOK},
+		{policy: storagePolicyFailClosed, wantCode: http.StatusServiceUnavailable},
+		{policy: storagePolicyLiveOnly, wantCode: http.StatusOK, wantStored: "false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			config.Config.StorageDownPolicy = tt.policy
+			h := newHandler(failingStorage{db: memory.NewStorage()}, time.Minute)
+			defer h.Close()
+			// without workers the webhook calls stay queued and can be counted
+			webhooks := newWorkerPool("webhook", 0, 10, dropWhenFull)
+			h.webhooks.pool.Close()
+			h.webhooks = newWebhookDispatcher(webhooks)
+			session := h.CreateSession("wallet", []string{"wallet"}, 0)
+			e := echo.New()
+			registerHandlers(e, h)
+
+			req := httptest.NewRequest(http.MethodPost, "/bridge/message?client_id=dapp&to=wallet&ttl=60&topic=connect&delivery_receipt=true", strings.NewReader("hello"))
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("want status %v, got %v", tt.wantCode, rec.Code)
+			}
+			if got := rec.Header().Get(storedHeader); got != tt.wantStored {
+				t.Fatalf("want %v header %q, got %q", storedHeader, tt.wantStored, got)
+			}
+			delivered := len(session.MessageCh) == 1
+			if delivered != (tt.wantCode == http.StatusOK) {
+				t.Fatalf("live delivery: got %v", delivered)
+			}
+			accepted := tt.wantCode == http.StatusOK
+			if called := len(webhooks.queue) == 1; called != accepted {
+				t.Fatalf("webhook called: %v", called)
+			}
+			if _, pending := h.receipts.Take("wallet", h._eventIDs); pending != accepted {
+				t.Fatalf("receipt pending: %v", pending)
+			}
+		})
+	}
+}
+
+// flakyStorage fails the first writes, as many as failures.
+type flakyStorage struct {
+	db
+	failures int32
+}
+
+func (s *flakyStorage) Add(ctx context.Context, key string, ttl int64, mes datatype.SseMessage) error {
+	if atomic.AddInt32(&s.failures, -1) >= 0 {
+		return io.ErrClosedPipe
+	}
+	return s.db.Add(ctx, key, ttl, mes)
+}
+
+func TestPersistWithRetry(t *testing.T) {
+	storage := &flakyStorage{db: memory.NewStorage(), failures: 1}
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	h.storagePool.Close()
+	h.storagePool = newWorkerPool("storage", 1, 10, runWhenFull)
+	h.storagePool.Submit(func() {
+		h.persistWithRetry("wallet", 60, "", datatype.SseMessage{EventId: 1, To: "wallet"}, 1, 500*time.Millisecond, time.Now().Add(time.Minute))
+	})
+	// the only worker is free while the write waits for its retry
+	done := make(chan struct{})
+	h.storagePool.Submit(func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(400 * time.Millisecond):
+		t.Fatal("the storage pool is blocked by a retry")
+	}
+	waitStored(t, storage, "wallet", 1)
+}
+
+func TestSendMessageHandler_SelfSend(t *testing.T) {
+	defer func(v bool) { config.Config.RejectSelfSend = v }(config.Config.RejectSelfSend)
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	for _, reject := range []bool{false, true} {
+		config.Config.RejectSelfSend = reject
+		req := httptest.NewRequest(http.MethodPost, "/bridge/message?client_id=dapp&to=dapp&ttl=60", strings.NewReader("hello"))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		want := http.StatusOK
+		if reject {
+			want = http.StatusBadRequest
+		}
+		if rec.Code != want {
+			t.Fatalf("reject=%v: want %v, got %v", reject, want, rec.Code)
+		}
+	}
+}
+
+func TestReplaceSessions(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	old := h.CreateSession("wallet", []string{"wallet"}, 0)
+	other := h.CreateSession("wallet", []string{"wallet", "other"}, 0)
+	old.MessageCh <- datatype.SseMessage{EventId: 5}
+	// a pending kick must not keep the replaced session open
+	old.Kick(closeReasonShutdown)
+
+	next := h.CreateSession("wallet", []string{"wallet"}, 0)
+	// sent while both sessions are subscribed, it's queued to both of them
+	h.fanOut(context.Background(), "wallet", datatype.SseMessage{EventId: 6})
+	h.replaceSessions(next)
+	next.StopRecordingForwarded(true)
+	next.Start()
+
+	select {
+	case <-old.Closer:
+		if reason := old.CloseReason(); reason != closeReasonReplaced {
+			t.Fatalf("want %q reason, got %q", closeReasonReplaced, reason)
+		}
+	default:
+		t.Fatal("replaced session is not closed")
+	}
+	select {
+	case <-other.Closer:
+		t.Fatal("session with other client ids must not be replaced")
+	default:
+	}
+	h.Connections["wallet"].mux.RLock()
+	for _, s := range h.Connections["wallet"].Sessions {
+		if s == old {
+			t.Fatal("replaced session is still subscribed")
+		}
+	}
+	h.Connections["wallet"].mux.RUnlock()
+
+	if n := old.HandOver(); n != 2 {
+		t.Fatalf("want 2 handed over messages, got %v", n)
+	}
+	var got []int64
+	for len(got) < 2 {
+		select {
+		case msg := <-next.MessageCh:
+			got = append(got, msg.EventId)
+		case <-time.After(time.Second):
+			t.Fatalf("want messages 6 and 5, got %v", got)
+		}
+	}
+	if got[0] != 6 || got[1] != 5 {
+		t.Fatalf("want messages 6 and 5, got %v", got)
+	}
+	select {
+	case msg := <-next.MessageCh:
+		t.Fatalf("message %v is queued twice", msg.EventId)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSession_CloseReason(t *testing.T) {
+	s := NewSession(memory.NewStorage(), []string{"wallet"}, 0)
+	s.SetCloseReason(closeReasonWriteError)
+	s.SetCloseReason(closeReasonClientDisconnect)
+	if got := s.CloseReason(); got != closeReasonWriteError {
+		t.Fatalf("want the first reason %q, got %q", closeReasonWriteError, got)
+	}
+}
+
+func TestSession_ReplayOrder(t *testing.T) {
+	storage := memory.NewStorage()
+	ctx := context.Background()
+	// the memory storage returns the messages grouped by client id
+	for i, to := range []string{"b", "a", "b"} {
+		storage.Add(ctx, to, 60, datatype.SseMessage{EventId: int64(i + 1), To: to})
+	}
+	defer func(order string) { config.Config.ReplayOrder = order }(config.Config.ReplayOrder)
+	for order, want := range map[string][]int64{replayOldestFirst: {1, 2, 3}, replayNewestFirst: {3, 2, 1}} {
+		config.Config.ReplayOrder = order
+		s := NewSession(storage, []string{"b", "a"}, 0)
+		s.Start()
+		<-s.replayed
+		var got []int64
+		for len(s.MessageCh) > 0 {
+			got = append(got, (<-s.MessageCh).EventId)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: want %v, got %v", order, want, got)
+		}
+	}
+}
+
+func TestSession_ReplayPages(t *testing.T) {
+	storage := memory.NewStorage()
+	ctx := context.Background()
+	var want []int64
+	for i := 1; i <= 25; i++ {
+		storage.Add(ctx, "wallet", 60, datatype.SseMessage{EventId: int64(i), To: "wallet"})
+		want = append(want, int64(i))
+	}
+	defer func(size int) { config.Config.ReplayPageSize = size }(config.Config.ReplayPageSize)
+	config.Config.ReplayPageSize = 4
+	pages := counterValue(replayPagesMetric)
+
+	// the history is longer than MessageCh, the worker waits for it to be read between pages
+	s := NewSession(storage, []string{"wallet"}, 0)
+	s.Start()
+	var got []int64
+	for len(got) < len(want) {
+		select {
+		case m := <-s.MessageCh:
+			got = append(got, m.EventId)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("replay stalled after %v", got)
+		}
+	}
+	<-s.replayed
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if got := counterValue(replayPagesMetric) - pages; got != 7 {
+		t.Fatalf("want 7 pages, got %v", got)
+	}
+}
+
+func histogramValue(h prometheus.Histogram) (count uint64, sum float64) {
+	m := &dto.Metric{}
+	h.(prometheus.Metric).Write(m)
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestSession_ReplayMetrics(t *testing.T) {
+	storage := memory.NewStorage()
+	ctx := context.Background()
+	for i, message := range []string{"hello", "bridge", "!"} {
+		storage.Add(ctx, "wallet", 60, datatype.SseMessage{EventId: int64(i + 1), Message: []byte(message), To: "wallet"})
+	}
+	messagesCount, messagesSum := histogramValue(replayMessagesMetric)
+	bytesCount, bytesSum := histogramValue(replayBytesMetric)
+	durationCount, _ := histogramValue(replayDurationMetric)
+
+	s := NewSession(storage, []string{"wallet"}, 0)
+	s.Start()
+	<-s.replayed
+	if count, _ := histogramValue(replayDurationMetric); count != durationCount+1 {
+		t.Fatalf("replay duration is not observed: %v samples, want %v", count, durationCount+1)
+	}
+	// the sizes are observed when the worker returns, right after the replay is done
+	for i := 0; i < 100; i++ {
+		if count, _ := histogramValue(replayBytesMetric); count > bytesCount {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count, sum := histogramValue(replayMessagesMetric); count != messagesCount+1 || sum-messagesSum != 3 {
+		t.Fatalf("replay_messages: %v samples summing to %v, want 1 sample of 3", count-messagesCount, sum-messagesSum)
+	}
+	if count, sum := histogramValue(replayBytesMetric); count != bytesCount+1 || sum-bytesSum != 12 {
+		t.Fatalf("replay_bytes: %v samples summing to %v, want 1 sample of 12", count-bytesCount, sum-bytesSum)
+	}
+}
+
+func TestSendMessageHandler_ServerTiming(t *testing.T) {
+	defer func(timing bool, policy string) {
+		config.Config.ServerTiming, config.Config.StorageDownPolicy = timing, policy
+	}(config.Config.ServerTiming, config.Config.StorageDownPolicy)
+	config.Config.ServerTiming = true
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	for policy, want := range map[string]string{storagePolicyFailOpen: "fanout;dur=", storagePolicyFailClosed: "persist;dur="} {
+		config.Config.StorageDownPolicy = policy
+		req := httptest.NewRequest(http.MethodPost, "/bridge/message?client_id=dapp&to=wallet&ttl=60", strings.NewReader("hello"))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if timing := rec.Header().Get(serverTimingHeader); !strings.HasPrefix(timing, want) {
+			t.Fatalf("%v: want Server-Timing starting with %q, got %q", policy, want, timing)
+		}
+	}
+}
+
+func TestHeartbeatAckHandler(t *testing.T) {
+	defer func(rtt bool) { config.Config.HeartbeatRTT = rtt }(config.Config.HeartbeatRTT)
+	config.Config.HeartbeatRTT = true
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	ack := func(query string) int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/bridge/heartbeat-ack?"+query, nil))
+		return rec.Code
+	}
+	wallet := h.CreateSession("wallet", []string{"wallet"}, 0)
+	stale := time.Now().Add(-time.Second).UnixMicro()
+	wallet.MarkHeartbeat(stale)
+	sent := time.Now().Add(-30 * time.Millisecond).UnixMicro()
+	wallet.MarkHeartbeat(sent)
+	count, _ := histogramValue(heartbeatRTTMetric)
+
+	if code := ack(fmt.Sprintf("client_id=wallet&ts=%v", sent)); code != http.StatusOK {
+		t.Fatalf("want 200, got %v", code)
+	}
+	if rtt := wallet.RTT(); rtt < 30*time.Millisecond || rtt > time.Second {
+		t.Fatalf("unexpected rtt %v", rtt)
+	}
+	if got, _ := histogramValue(heartbeatRTTMetric); got != count+1 {
+		t.Fatalf("rtt observed %v times, want once", got-count)
+	}
+
+	for name, query := range map[string]string{
+		"stale heartbeat":   fmt.Sprintf("client_id=wallet&ts=%v", stale),
+		"unknown heartbeat": fmt.Sprintf("client_id=wallet&ts=%v", sent+1),
+		"unknown client":    fmt.Sprintf("client_id=dapp&ts=%v", sent),
+	} {
+		if code := ack(query); code != http.StatusNotFound {
+			t.Fatalf("%v: want 404, got %v", name, code)
+		}
+	}
+	for name, query := range map[string]string{
+		"missing client_id": fmt.Sprintf("ts=%v", sent),
+		"missing ts":        "client_id=wallet",
+		"malformed ts":      "client_id=wallet&ts=x",
+	} {
+		if code := ack(query); code != http.StatusBadRequest {
+			t.Fatalf("%v: want 400, got %v", name, code)
+		}
+	}
+	if got, _ := histogramValue(heartbeatRTTMetric); got != count+1 {
+		t.Fatalf("rejected acks were observed, %v samples", got-count)
+	}
+}
+
+func TestSubscriptionsHandler(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	wallet := h.CreateSession("wallet", []string{"wallet"}, 0)
+	h.CreateSession("both", []string{"wallet", "dapp"}, 0)
+	wallet.MessageCh <- datatype.SseMessage{EventId: 1, To: "wallet"}
+	closed := h.CreateSession("wallet", []string{"wallet"}, 0)
+	closed.SetCloseReason(closeReasonWriteError)
+	h.removeConnection(closed)
+	h.stats.Disconnected(closed.ClientIds, closed.StartedAt, time.Now(), closed.CloseReason())
+	wallet.SetCloseReason(closeReasonShutdown)
+	sent := time.UnixMicro(time.Now().UnixMicro())
+	wallet.MarkHeartbeat(sent.UnixMicro())
+	wallet.AckHeartbeat(sent.UnixMicro(), sent.Add(25*time.Millisecond))
+	get := func(query string) (int, subscriptionsRes) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/admin/subscriptions?"+query, nil), rec)
+		if err := h.SubscriptionsHandler(c); err != nil {
+			t.Fatal(err)
+		}
+		var res subscriptionsRes
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return rec.Code, res
+	}
+
+	code, res := get("")
+	if code != http.StatusOK || res.TotalKeys != 2 || res.TotalSubscriptions != 3 || len(res.Subscriptions) != 2 {
+		t.Fatalf("unexpected snapshot %v: %+v", code, res)
+	}
+	if dapp := res.Subscriptions[0]; dapp.ClientId != "dapp" || dapp.Sessions != 1 {
+		t.Fatalf("want dapp first with 1 session, got %+v", dapp)
+	}
+	_, res = get("client_id=wallet")
+	if len(res.Subscriptions) != 1 {
+		t.Fatalf("want only wallet, got %+v", res)
+	}
+	info := res.Subscriptions[0]
+	sort.Ints(info.Buffered)
+	sort.Float64s(info.RTTMs)
+	if info.Sessions != 2 || !reflect.DeepEqual(info.Buffered, []int{0, 1}) || info.BufferCapacity != sessionQueueSize {
+		t.Fatalf("unexpected wallet subscription: %+v", info)
+	}
+	if !reflect.DeepEqual(info.RTTMs, []float64{0, 25}) {
+		t.Fatalf("want the measured rtt of one session, got %v", info.RTTMs)
+	}
+	sort.Strings(info.CloseReasons)
+	if !reflect.DeepEqual(info.CloseReasons, []string{"", closeReasonShutdown}) || info.LastCloseReason != closeReasonWriteError {
+		t.Fatalf("unexpected close reasons: %+v", info)
+	}
+	if _, res = get("limit=1"); res.TotalKeys != 2 || len(res.Subscriptions) != 1 {
+		t.Fatalf("want 1 of 2 keys, got %+v", res)
+	}
+	if code, _ := get("limit=0"); code != http.StatusBadRequest {
+		t.Fatalf("want 400 for a bad limit, got %v", code)
+	}
+}
+
+func TestAuditExportHandler(t *testing.T) {
+	export := func(h *handler, query string) (int, []map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/admin/audit?"+query, nil), rec)
+		if err := h.AuditExportHandler(c); err != nil {
+			t.Fatal(err)
+		}
+		var records []map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &records)
+		return rec.Code, records
+	}
+	disabled := newHandler(memory.NewStorage(), time.Minute)
+	defer disabled.Close()
+	if code, _ := export(disabled, ""); code != http.StatusNotFound {
+		t.Fatalf("disabled audit log: got %v", code)
+	}
+
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	h.audit = storage
+	e := echo.New()
+	registerHandlers(e, h)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/bridge/message?client_id=dapp&to=wallet&ttl=60&topic=connect", strings.NewReader("secret payload")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("send: bad status code %v", rec.Code)
+	}
+	for i := 0; i < 100; i++ {
+		if _, records := export(h, ""); len(records) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	code, records := export(h, "")
+	if code != http.StatusOK || len(records) != 1 {
+		t.Fatalf("want 1 record, got %v %v", code, records)
+	}
+	record := records[0]
+	if record["from_hash"] != hashClientId("dapp") || record["to_hash"] != hashClientId("wallet") ||
+		record["topic"] != "connect" || record["size"] != float64(len("secret payload")) || record["ttl"] != float64(60) {
+		t.Fatalf("unexpected record %v", record)
+	}
+	for _, v := range record {
+		if s, ok := v.(string); ok && (strings.Contains(s, "secret") || s == "dapp" || s == "wallet") {
+			t.Fatalf("record leaks the payload or client ids: %v", record)
+		}
+	}
+
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for i, at := range []time.Time{day.Add(-time.Hour), day, day.Add(time.Hour), day.Add(24 * time.Hour)} {
+		storage.AddAuditRecord(context.Background(), datatype.AuditRecord{EventId: int64(i + 1), CreatedAt: at})
+	}
+	code, records = export(h, "from=2024-01-02T00:00:00Z&to=2024-01-03T00:00:00Z")
+	if code != http.StatusOK || len(records) != 2 || records[0]["event_id"] != float64(2) || records[1]["event_id"] != float64(3) {
+		t.Fatalf("from is inclusive and to is exclusive, got %v %v", code, records)
+	}
+	if code, _ := export(h, "from=yesterday"); code != http.StatusBadRequest {
+		t.Fatalf("invalid from: got %v", code)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	healthStateOk       = "ok"
+	healthStateDegraded = "degraded"
+	healthStateUnknown  = "unknown"
+)
+
+type dependencyHealth struct {
+	State       string     `json:"state"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+type healthReport struct {
+	Status       string                      `json:"status"`
+	Degraded     bool                        `json:"degraded"`
+	Version      string                      `json:"version"`
+	Storage      string                      `json:"storage"`
+	Dependencies map[string]dependencyHealth `json:"dependencies"`
+}
+
+// healthTracker remembers the outcome of the last calls to each dependency.
+// A dependency is degraded when its last call failed.
+type healthTracker struct {
+	mu   sync.Mutex
+	deps map[string]*dependencyHealth
+}
+
+func newHealthTracker(deps ...string) *healthTracker {
+	t := &healthTracker{deps: make(map[string]*dependencyHealth, len(deps))}
+	for _, name := range deps {
+		t.deps[name] = &dependencyHealth{State: healthStateUnknown}
+	}
+	return t
+}
+
+func (t *healthTracker) dep(name string) *dependencyHealth {
+	d, ok := t.deps[name]
+	if !ok {
+		d = &dependencyHealth{}
+		t.deps[name] = d
+	}
+	return d
+}
+
+func (t *healthTracker) Success(name string) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.dep(name)
+	d.State = healthStateOk
+	d.LastSuccess = &now
+}
+
+func (t *healthTracker) Failure(name string, err error) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.dep(name)
+	d.State = healthStateDegraded
+	d.LastError = err.Error()
+	d.LastErrorAt = &now
+}
+
+// Healthy reports whether the last call to the dependency succeeded.
+func (t *healthTracker) Healthy(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.deps[name]
+	return ok && d.State == healthStateOk
+}
+
+func (t *healthTracker) Report(storage string) healthReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := healthReport{
+		Status:       healthStateOk,
+		Version:      version,
+		Storage:      storage,
+		Dependencies: make(map[string]dependencyHealth, len(t.deps)),
+	}
+	for name, d := range t.deps {
+		r.Dependencies[name] = *d
+		if d.State == healthStateDegraded {
+			r.Degraded = true
+			r.Status = healthStateDegraded
+		}
+	}
+	return r
+}
+
+// healthChecker is implemented by storages that can be probed without a client request, e.g. with a PING.
+type healthChecker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+const healthCheckTimeout = 2 * time.Second
+
+// HealthHandler always answers 200, probes should look at the degraded flag.
+func (h *handler) HealthHandler(c echo.Context) error {
+	if checker, ok := h.storage.(healthChecker); ok {
+		h.checkStorage(c.Request().Context(), checker)
+	}
+	return c.JSON(http.StatusOK, h.health.Report(h.storageName))
+}
+
+func (h *handler) checkStorage(ctx context.Context, checker healthChecker) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if err := checker.HealthCheck(ctx); err != nil {
+		h.health.Failure("storage", err)
+		return
+	}
+	h.health.Success("storage")
+}
+
+// cleanupReporter is implemented by storages that sweep expired messages in the background.
+type cleanupReporter interface {
+	CleanupStatus() (last time.Time, err error)
+}
+
+// cleanupStaleAfter is how long the storage may go without a successful sweep before cleanup is degraded,
+// a few missed sweeps of a minute each.
+const cleanupStaleAfter = 5 * time.Minute
+
+// cleanupWatcher reports the "cleanup" dependency as degraded while sweeps of expired messages fail,
+// otherwise the table silently grows until the disk is full.
+func (h *handler) cleanupWatcher(r cleanupReporter) {
+	started := time.Now()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+		h.checkCleanup(r, started, time.Now())
+	}
+}
+
+func (h *handler) checkCleanup(r cleanupReporter, started, now time.Time) {
+	last, err := r.CleanupStatus()
+	switch {
+	case err != nil:
+		h.health.Failure("cleanup", err)
+	case last.IsZero() && now.Sub(started) > cleanupStaleAfter, !last.IsZero() && now.Sub(last) > cleanupStaleAfter:
+		h.health.Failure("cleanup", fmt.Errorf("no successful cleanup for %v", cleanupStaleAfter))
+	case !last.IsZero():
+		h.health.Success("cleanup")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestHealthTracker_Report(t *testing.T) {
+	tr := newHealthTracker("storage")
+	if r := tr.Report("memory"); r.Degraded || r.Dependencies["storage"].State != healthStateUnknown {
+		t.Fatalf("unexpected initial report: %+v", r)
+	}
+	tr.Failure("storage", errors.New("connection refused"))
+	r := tr.Report("postgres")
+	if !r.Degraded || r.Status != healthStateDegraded || r.Dependencies["storage"].LastError != "connection refused" {
+		t.Fatalf("storage failure must degrade the report: %+v", r)
+	}
+	tr.Success("storage")
+	r = tr.Report("postgres")
+	if r.Degraded || r.Dependencies["storage"].LastError == "" || r.Dependencies["storage"].LastSuccess == nil {
+		t.Fatalf("storage success must recover the report and keep the last error: %+v", r)
+	}
+}
+
+type cleanupStatus struct {
+	last time.Time
+	err  error
+}
+
+func (s cleanupStatus) CleanupStatus() (time.Time, error) {
+	return s.last, s.err
+}
+
+func TestCheckCleanup(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		status  cleanupStatus
+		started time.Time
+		want    string
+	}{
+		{name: "ok", status: cleanupStatus{last: now.Add(-time.Minute)}, started: now.Add(-time.Hour), want: healthStateOk},
+		{name: "failed", status: cleanupStatus{last: now.Add(-time.Minute), err: errors.New("timeout")}, started: now.Add(-time.Hour), want: healthStateDegraded},
+		{name: "stale", status: cleanupStatus{last: now.Add(-time.Hour)}, started: now.Add(-time.Hour), want: healthStateDegraded},
+		{name: "never ran", started: now.Add(-time.Hour), want: healthStateDegraded},
+		{name: "not yet", started: now, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &handler{health: newHealthTracker()}
+			h.checkCleanup(tt.status, tt.started, now)
+			if got := h.health.Report("postgres").Dependencies["cleanup"].State; got != tt.want {
+				t.Fatalf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+type pingStorage struct {
+	db
+	err error
+}
+
+func (s pingStorage) HealthCheck(context.Context) error {
+	return s.err
+}
+
+func TestHealthHandler_ChecksStorage(t *testing.T) {
+	for _, err := range []error{nil, errors.New("connection refused")} {
+		h := &handler{storage: pingStorage{err: err}, health: newHealthTracker("storage")}
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/health", nil), rec)
+		if e := h.HealthHandler(c); e != nil {
+			t.Fatal(e)
+		}
+		var r healthReport
+		if e := json.Unmarshal(rec.Body.Bytes(), &r); e != nil {
+			t.Fatal(e)
+		}
+		if r.Degraded != (err != nil) {
+			t.Fatalf("health check error %v, got report %+v", err, r)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+var hookFailuresMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "number_of_message_hook_failures",
+	Help: "The total number of message hook calls that failed, panicked or timed out",
+}, []string{"hook", "stage"})
+
+// MessageHook transforms messages passing through the bridge.
+// Hooks get their own copy of the message and are skipped if they fail or don't finish in time.
+type MessageHook interface {
+	// OnSend is called before a message is stored and fanned out.
+	OnSend(ctx context.Context, msg *datatype.BridgeMessage) error
+	// OnDeliver is called before a message is written to an SSE stream.
+	OnDeliver(ctx context.Context, msg *datatype.SseMessage) error
+}
+
+// messageHookFactories is the compile-time registry of hooks that can be enabled with MESSAGE_HOOKS.
+var messageHookFactories = map[string]func() MessageHook{
+	"size_annotation": func() MessageHook { return sizeAnnotationHook{} },
+}
+
+type namedHook struct {
+	name string
+	hook MessageHook
+}
+
+type messageHooks struct {
+	hooks   []namedHook
+	timeout time.Duration
+}
+
+func newMessageHooks(names []string, timeout time.Duration) (*messageHooks, error) {
+	h := &messageHooks{timeout: timeout}
+	for _, name := range names {
+		factory, ok := messageHookFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown message hook %q", name)
+		}
+		h.hooks = append(h.hooks, namedHook{name: name, hook: factory()})
+	}
+	return h, nil
+}
+
+func (h *messageHooks) OnSend(ctx context.Context, msg datatype.BridgeMessage) datatype.BridgeMessage {
+	for _, nh := range h.hooks {
+		result := msg
+		result.Meta = copyMeta(msg.Meta)
+		if h.run(ctx, nh.name, "send", func(ctx context.Context) error { return nh.hook.OnSend(ctx, &result) }) {
+			msg = result
+		}
+	}
+	return msg
+}
+
+func (h *messageHooks) OnDeliver(ctx context.Context, msg datatype.SseMessage) datatype.SseMessage {
+	for _, nh := range h.hooks {
+		result := msg
+		result.Message = append([]byte(nil), msg.Message...)
+		if h.run(ctx, nh.name, "deliver", func(ctx context.Context) error { return nh.hook.OnDeliver(ctx, &result) }) {
+			msg = result
+		}
+	}
+	return msg
+}
+
+// run executes f with a timeout and reports whether it succeeded.
+func (h *messageHooks) run(ctx context.Context, name, stage string, f func(ctx context.Context) error) bool {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- f(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		hookFailuresMetric.WithLabelValues(name, stage).Inc()
+		log.WithField("prefix", "messageHooks").Errorf("hook %v failed on %v: %v", name, stage, err)
+		return false
+	}
+	return true
+}
+
+func copyMeta(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	c := make(map[string]string, len(meta))
+	for k, v := range meta {
+		c[k] = v
+	}
+	return c
+}
+
+// sizeAnnotationHook adds the payload size to the message meta.
+type sizeAnnotationHook struct{}
+
+func (sizeAnnotationHook) OnSend(ctx context.Context, msg *datatype.BridgeMessage) error {
+	if msg.Meta == nil {
+		msg.Meta = map[string]string{}
+	}
+	msg.Meta["size"] = strconv.Itoa(len(msg.Message))
+	return nil
+}
+
+func (sizeAnnotationHook) OnDeliver(ctx context.Context, msg *datatype.SseMessage) error {
+	return nil
+}
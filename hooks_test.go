@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+type funcHook struct {
+	onSend func(msg *datatype.BridgeMessage) error
+}
+
+func (f funcHook) OnSend(ctx context.Context, msg *datatype.BridgeMessage) error {
+	return f.onSend(msg)
+}
+
+func (f funcHook) OnDeliver(ctx context.Context, msg *datatype.SseMessage) error {
+	return nil
+}
+
+func TestMessageHooks_OnSend(t *testing.T) {
+	tests := []struct {
+		name string
+		hook MessageHook
+		want map[string]string
+	}{
+		{
+			name: "size annotation",
+			hook: sizeAnnotationHook{},
+			want: map[string]string{"size": "5"},
+		},
+		{
+			name: "panic is skipped",
+			hook: funcHook{onSend: func(msg *datatype.BridgeMessage) error {
+				msg.Meta = map[string]string{"x": "y"}
+				panic("boom")
+			}},
+		},
+		{
+			name: "timeout is skipped",
+			hook: funcHook{onSend: func(msg *datatype.BridgeMessage) error {
+				msg.Meta = map[string]string{"x": "y"}
+				time.Sleep(100 * time.Millisecond)
+				return nil
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &messageHooks{hooks: []namedHook{{name: "test", hook: tt.hook}}, timeout: 20 * time.Millisecond}
+			msg := h.OnSend(context.Background(), datatype.BridgeMessage{From: "a", Message: "hello"})
+			if len(msg.Meta) != len(tt.want) || msg.Meta["size"] != tt.want["size"] {
+				t.Fatalf("want meta %v, got %v", tt.want, msg.Meta)
+			}
+		})
+	}
+}
+
+func TestNewMessageHooks_Unknown(t *testing.T) {
+	if _, err := newMessageHooks([]string{"missing"}, time.Second); err == nil {
+		t.Fatal("expected error for unknown hook")
+	}
+}
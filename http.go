@@ -2,9 +2,39 @@ package main
 
 import (
 	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/config"
 )
 
 func registerHandlers(e *echo.Echo, h *handler) {
-	e.GET("/bridge/events", h.EventRegistrationHandler)
-	e.POST("/bridge/message", h.SendMessageHandler)
+	registerEventsHandlers(e, h)
+	registerMessageHandlers(e, h)
+}
+
+// registerEventsHandlers registers the long-lived SSE endpoints.
+func registerEventsHandlers(e *echo.Echo, h *handler) {
+	eventsLimit := bodyLimitMiddleware(config.Config.EventsBodyLimit)
+	e.GET("/bridge/events", h.EventRegistrationHandler, eventsLimit)
+	e.POST("/bridge/events", h.EventRegistrationHandler, eventsLimit)
+}
+
+// registerMessageHandlers registers the short request/response endpoints.
+func registerMessageHandlers(e *echo.Echo, h *handler) {
+	defaultLimit := bodyLimitMiddleware(config.Config.DefaultBodyLimit)
+	e.POST("/bridge/message", h.SendMessageHandler, bodyLimitMiddleware(config.Config.MessageBodyLimit))
+	e.POST("/bridge/report", h.ReportHandler, defaultLimit)
+	e.GET("/bridge/info", h.InfoHandler)
+	e.GET("/health", h.HealthHandler)
+	e.GET("/bridge/conformance", h.ConformanceHandler)
+	if config.Config.AckEnabled {
+		e.POST("/bridge/ack", h.AckHandler, defaultLimit)
+	}
+	if config.Config.HeartbeatRTT {
+		e.POST("/bridge/heartbeat-ack", h.HeartbeatAckHandler, defaultLimit)
+	}
+	if config.Config.DevMode {
+		registerDevHandlers(e.Group("/dev", bodyLimitMiddleware(config.Config.MessageBodyLimit)), h)
+	}
+	if config.Config.AdminToken != "" {
+		registerAdminHandlers(e.Group("/admin", adminAuthMiddleware(config.Config.AdminToken), defaultLimit), h)
+	}
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var idempotentReplaysMetric = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "number_of_idempotent_replays",
+	Help: "The total number of retried sends answered from the idempotency cache",
+})
+
+// idempotencyCache remembers the result of sends made with an Idempotency-Key for a configured window.
+// A nil *idempotencyCache disables the feature.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]*idempotentResult
+}
+
+type idempotentResult struct {
+	res      SendMessageRes
+	done     bool
+	expireAt time.Time
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	if window <= 0 {
+		return nil
+	}
+	c := &idempotencyCache{
+		window:  window,
+		entries: map[string]*idempotentResult{},
+	}
+	return c
+}
+
+func (c *idempotencyCache) watcher(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Minute):
+		}
+		now := time.Now()
+		c.mu.Lock()
+		for key, e := range c.entries {
+			if e.done && e.expireAt.Before(now) {
+				delete(c.entries, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Begin reserves key for a new request. If key is already known it returns the stored entry
+// and false; an entry that is not done yet belongs to a request still in progress.
+func (c *idempotencyCache) Begin(key string) (*idempotentResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok && (!e.done || e.expireAt.After(time.Now())) {
+		return e, false
+	}
+	c.entries[key] = &idempotentResult{}
+	return nil, true
+}
+
+// Finish stores the successful result for key.
+func (c *idempotencyCache) Finish(key string, res SendMessageRes) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &idempotentResult{res: res, done: true, expireAt: time.Now().Add(c.window)}
+}
+
+// Abort releases key reserved by Begin if the request failed, so it can be retried.
+func (c *idempotencyCache) Abort(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok && !e.done {
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/config"
+)
+
+// bridgeInfo is a machine-readable manifest letting SDKs feature-detect the bridge.
+type bridgeInfo struct {
+	Version           string         `json:"version"`
+	Protocols         []string       `json:"protocols"`
+	Features          []string       `json:"features"`
+	HeartbeatInterval int            `json:"heartbeat_interval"`
+	MaxTTL            int64          `json:"max_ttl"`
+	TopicMaxTTL       map[string]int `json:"topic_max_ttl,omitempty"`
+	TTLClamp          bool           `json:"ttl_clamp"`
+	MaxMessageSize    int64          `json:"max_message_size"`
+	VerifyTypes       []string       `json:"verify_types"`
+	Limits            limits         `json:"limits"`
+}
+
+// limits are the effective limits of the requesting client, zero means no limit.
+type limits struct {
+	RPS         int  `json:"rps"`
+	Connections int  `json:"connections"`
+	Unlimited   bool `json:"unlimited"`
+}
+
+func newBridgeInfo() bridgeInfo {
+	features := []string{"heartbeat", "close_event", "trace_id", "post_events", "connected_event", "queue_done_event"}
+	if config.Config.AckEnabled {
+		features = append(features, "ack")
+	}
+	if config.Config.HeartbeatRTT {
+		features = append(features, "heartbeat_rtt")
+	}
+	if config.Config.ConsumeOnRead {
+		features = append(features, "consume_on_read")
+	}
+	if config.Config.HeartbeatMetadata {
+		features = append(features, "heartbeat_metadata")
+	}
+	if config.Config.SenderSignature != senderSignatureOff {
+		features = append(features, "sender_signature")
+	}
+	if config.Config.IdempotencyWindow > 0 {
+		features = append(features, "idempotency_key")
+	}
+	if config.Config.AffinityEventIds {
+		features = append(features, "affinity_event_ids")
+	}
+	return bridgeInfo{
+		Version:           version,
+		Protocols:         []string{"sse"},
+		Features:          features,
+		HeartbeatInterval: config.Config.HeartbeatInterval,
+		MaxTTL:            int64(config.Config.MaxTTL),
+		TopicMaxTTL:       config.Config.TopicTTLs,
+		TTLClamp:          config.Config.TTLClamp,
+		MaxMessageSize:    config.Config.MessageBodyLimit,
+		VerifyTypes:       []string{},
+	}
+}
+
+// infoMaxAge is how long in seconds clients may use /bridge/info without asking again,
+// after that they revalidate it with the ETag.
+const infoMaxAge = 60
+
+func (h *handler) InfoHandler(c echo.Context) error {
+	info := newBridgeInfo()
+	if h.allowlist.unlimited(c.Request()) {
+		info.Limits = limits{Unlimited: true}
+	} else {
+		info.Limits = limits{RPS: config.Config.RPSLimit, Connections: config.Config.ConnectionsLimit}
+	}
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	header := c.Response().Header()
+	header.Set("ETag", etag)
+	// the limits depend on the client, shared caches must not keep the response
+	header.Set("Cache-Control", "private, max-age="+strconv.Itoa(infoMaxAge))
+	header.Set("Vary", "Authorization")
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSONBlob(http.StatusOK, body)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, weak validators match too.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == etag || v == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/config"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestInfoHandler_Limits(t *testing.T) {
+	defer func(rps, connections int) {
+		config.Config.RPSLimit, config.Config.ConnectionsLimit = rps, connections
+	}(config.Config.RPSLimit, config.Config.ConnectionsLimit)
+	config.Config.RPSLimit, config.Config.ConnectionsLimit = 1, 50
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	allowlist, err := newLimitsAllowlist([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.allowlist = allowlist
+	e := echo.New()
+	registerHandlers(e, h)
+
+	tests := []struct {
+		remoteAddr string
+		want       limits
+	}{
+		{remoteAddr: "1.2.3.4:1000", want: limits{RPS: 1, Connections: 50}},
+		{remoteAddr: "10.1.2.3:1000", want: limits{Unlimited: true}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/bridge/info", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var info bridgeInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		if info.Limits != tt.want {
+			t.Errorf("%v: want %+v, got %+v", tt.remoteAddr, tt.want, info.Limits)
+		}
+	}
+}
+
+func TestInfoHandler_ETag(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/bridge/info", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" || rec.Header().Get("Cache-Control") == "" {
+		t.Fatalf("want 200 with ETag and Cache-Control, got %v %v", rec.Code, rec.Header())
+	}
+	if rec := get(`"other", W/` + etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("want 304 for a matching ETag, got %v", rec.Code)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tonkeeper/bridge/config"
+)
+
+var suspiciousLastEventIdsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "number_of_suspicious_last_event_ids",
+	Help: "The total number of implausible Last-Event-ID values sent by clients",
+}, []string{"reason"})
+
+// lastEventIdSkew tolerates ids issued by other instances with slightly faster clocks.
+const lastEventIdSkew = time.Minute
+
+const (
+	lastEventIdNegative = "negative"
+	lastEventIdFuture   = "future"
+	lastEventIdUnknown  = "unknown"
+)
+
+// newestEventId is the largest event id that may have been issued by now, by this or another instance.
+func (h *handler) newestEventId(now time.Time) int64 {
+	newest := now.UnixMicro()
+	if last := atomic.LoadInt64(&h._eventIDs); last > newest {
+		newest = last
+	}
+	return newest + lastEventIdSkew.Microseconds()
+}
+
+// checkLastEventId returns why lastEventId is implausible for clientIds or an empty string.
+// Event ids are creation timestamps in microseconds (see nextID), so an id can't be from the future.
+// With LAST_EVENT_ID_CHECK_STORAGE an id young enough to still be stored must belong to one of clientIds.
+func (h *handler) checkLastEventId(ctx context.Context, clientIds []string, lastEventId int64, now time.Time) string {
+	if lastEventId == 0 {
+		return ""
+	}
+	if lastEventId < 0 {
+		return lastEventIdNegative
+	}
+	if lastEventId > h.newestEventId(now) {
+		return lastEventIdFuture
+	}
+	if !config.Config.LastEventIdCheck || lastEventId < now.Add(-time.Duration(longestTTL())*time.Second).UnixMicro() {
+		return ""
+	}
+	messages, err := h.storage.GetMessages(ctx, clientIds, lastEventId-1)
+	if err != nil {
+		return ""
+	}
+	for _, m := range messages {
+		if m.EventId == lastEventId {
+			return ""
+		}
+	}
+	return lastEventIdUnknown
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tonkeeper/bridge/config"
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestCheckLastEventId(t *testing.T) {
+	defer func(v bool) { config.Config.LastEventIdCheck = v }(config.Config.LastEventIdCheck)
+	config.Config.LastEventIdCheck = true
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	now := time.Now()
+	stored := now.Add(-time.Minute).UnixMicro()
+	if err := storage.Add(context.Background(), "wallet", 300, datatype.SseMessage{EventId: stored, To: "wallet"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		clientIds   []string
+		lastEventId int64
+		want        string
+	}{
+		{name: "empty", clientIds: []string{"wallet"}},
+		{name: "stored", clientIds: []string{"other", "wallet"}, lastEventId: stored},
+		{name: "negative", clientIds: []string{"wallet"}, lastEventId: -1, want: lastEventIdNegative},
+		{name: "future", clientIds: []string{"wallet"}, lastEventId: now.Add(time.Hour).UnixMicro(), want: lastEventIdFuture},
+		{name: "other client", clientIds: []string{"other"}, lastEventId: stored, want: lastEventIdUnknown},
+		{name: "older than retention", clientIds: []string{"other"}, lastEventId: now.Add(-time.Hour).UnixMicro()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.checkLastEventId(context.Background(), tt.clientIds, tt.lastEventId, now); got != tt.want {
+				t.Fatalf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
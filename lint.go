@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var payloadLintWarningsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "number_of_payload_lint_warnings",
+	Help: "The total number of spec violations found in plaintext connect payloads",
+}, []string{"problem"})
+
+const (
+	lintProblemNotJSON          = "not_json"
+	lintProblemNoFeatures       = "no_features"
+	lintProblemMixedFeatures    = "mixed_features"
+	lintProblemMalformedFeature = "malformed_feature"
+)
+
+type connectEvent struct {
+	Payload struct {
+		Device struct {
+			Features []json.RawMessage `json:"features"`
+		} `json:"device"`
+	} `json:"payload"`
+}
+
+// lintConnectPayload looks for DeviceInfo.features violations in a plaintext (optionally base64 encoded)
+// connect event. It is only useful on development bridges where wallets send unencrypted payloads.
+func lintConnectPayload(message []byte) []string {
+	if decoded, err := base64.StdEncoding.DecodeString(string(message)); err == nil {
+		message = decoded
+	}
+	var event connectEvent
+	if err := json.Unmarshal(message, &event); err != nil {
+		return []string{lintProblemNotJSON}
+	}
+	features := event.Payload.Device.Features
+	if len(features) == 0 {
+		return []string{lintProblemNoFeatures}
+	}
+
+	var problems []string
+	var strings, objects int
+	for _, f := range features {
+		var name string
+		if json.Unmarshal(f, &name) == nil {
+			strings++
+			continue
+		}
+		var feature struct {
+			Name string `json:"name"`
+		}
+		if json.Unmarshal(f, &feature) != nil || feature.Name == "" {
+			problems = append(problems, lintProblemMalformedFeature)
+			continue
+		}
+		objects++
+	}
+	if strings > 0 && objects > 0 {
+		problems = append(problems, lintProblemMixedFeatures)
+	}
+	return problems
+}
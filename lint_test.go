@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func Test_lintConnectPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    []string
+	}{
+		{
+			name:    "objects only",
+			message: `{"event":"connect","payload":{"device":{"features":[{"name":"SendTransaction","maxMessages":4}]}}}`,
+		},
+		{
+			name:    "mixed",
+			message: `{"payload":{"device":{"features":["SendTransaction",{"name":"SendTransaction","maxMessages":4}]}}}`,
+			want:    []string{lintProblemMixedFeatures},
+		},
+		{
+			name:    "malformed",
+			message: `{"payload":{"device":{"features":[42,{"maxMessages":4}]}}}`,
+			want:    []string{lintProblemMalformedFeature, lintProblemMalformedFeature},
+		},
+		{
+			name:    "no features",
+			message: `{"payload":{"device":{}}}`,
+			want:    []string{lintProblemNoFeatures},
+		},
+		{
+			name:    "encrypted",
+			message: "c29tZSBlbmNyeXB0ZWQgYnl0ZXM=",
+			want:    []string{lintProblemNotJSON},
+		},
+		{
+			name:    "base64 encoded",
+			message: base64.StdEncoding.EncodeToString([]byte(`{"payload":{"device":{"features":["SendTransaction",{"name":"SignData"}]}}}`)),
+			want:    []string{lintProblemMixedFeatures},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lintConnectPayload([]byte(tt.message)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lintConnectPayload() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
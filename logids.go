@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/tonkeeper/bridge/config"
+)
+
+const (
+	logIdsFull      = "full"
+	logIdsTruncated = "truncated"
+	logIdsHashed    = "hashed"
+)
+
+// requestLogFormat is the format of echo's default request log with the path instead of the uri:
+// the query carries client ids, which are only logged through logId.
+const requestLogFormat = `{"time":"${time_rfc3339_nano}","id":"${id}","remote_ip":"${remote_ip}",` +
+	`"host":"${host}","method":"${method}","path":"${path}","user_agent":"${user_agent}",` +
+	`"status":${status},"error":"${error}","latency":${latency},"latency_human":"${latency_human}"` +
+	`,"bytes_in":${bytes_in},"bytes_out":${bytes_out}}` + "\n"
+
+var requestLoggerConfig = middleware.LoggerConfig{Format: requestLogFormat}
+
+// logIdLength is the number of characters of an id kept in truncated and hashed modes.
+const logIdLength = 8
+
+// logId formats a client id or trace id for logs according to LOG_IDS:
+// as is, truncated to its first characters or replaced with the prefix of its sha256 hash,
+// which stays the same across log lines so a single client can still be followed.
+func logId(id string) string {
+	switch config.Config.LogIds {
+	case logIdsTruncated:
+		if len(id) > logIdLength {
+			return id[:logIdLength] + "…"
+		}
+		return id
+	case logIdsHashed:
+		return "h:" + hashClientId(id)[:logIdLength*2]
+	}
+	return id
+}
+
+func logIds(ids []string) []string {
+	if config.Config.LogIds == "" || config.Config.LogIds == logIdsFull {
+		return ids
+	}
+	res := make([]string, len(ids))
+	for i, id := range ids {
+		res[i] = logId(id)
+	}
+	return res
+}
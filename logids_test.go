@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/tonkeeper/bridge/config"
+)
+
+func TestLogId(t *testing.T) {
+	defer func(mode string) { config.Config.LogIds = mode }(config.Config.LogIds)
+	id := "0123456789abcdef"
+	tests := []struct {
+		mode string
+		id   string
+		want string
+	}{
+		{mode: "full", id: id, want: id},
+		{mode: "", id: id, want: id},
+		{mode: "truncated", id: id, want: "01234567…"},
+		{mode: "truncated", id: "0123", want: "0123"},
+		{mode: "hashed", id: id, want: "h:" + hashClientId(id)[:16]},
+	}
+	for _, tt := range tests {
+		config.Config.LogIds = tt.mode
+		if got := logId(tt.id); got != tt.want {
+			t.Errorf("logId(%q) in %q mode = %q, want %q", tt.id, tt.mode, got, tt.want)
+		}
+	}
+	config.Config.LogIds = "hashed"
+	if got := logIds([]string{id, id}); got[0] != got[1] || got[0] == id {
+		t.Errorf("logIds() = %v", got)
+	}
+}
+
+func TestRequestLogger_NoQuery(t *testing.T) {
+	var out bytes.Buffer
+	cfg := requestLoggerConfig
+	cfg.Output = &out
+	e := echo.New()
+	e.Use(middleware.LoggerWithConfig(cfg))
+	e.GET("/bridge/events", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/bridge/events?client_id=0123456789abcdef&to=fedcba9876543210", nil))
+	if strings.Contains(out.String(), "0123456789abcdef") || strings.Contains(out.String(), "fedcba9876543210") {
+		t.Fatalf("client ids are logged: %v", out.String())
+	}
+	if !strings.Contains(out.String(), `"path":"/bridge/events"`) {
+		t.Fatalf("want the path logged, got %v", out.String())
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/labstack/echo-contrib/prometheus"
 	"github.com/tonkeeper/bridge/storage/memory"
 	"github.com/tonkeeper/bridge/storage/pg"
+	"github.com/tonkeeper/bridge/storage/valkey"
 	"golang.org/x/exp/slices"
 	"golang.org/x/time/rate"
 
@@ -23,76 +29,201 @@ import (
 func main() {
 	log.Info("Bridge is running")
 	config.LoadConfig()
+	if config.Config.DevMode {
+		log.Warn("DEV_MODE is enabled: /dev/inspect exposes plaintext messages, never use it in production")
+	}
 	var (
-		dbConn db
-		err    error
+		dbConn      db
+		err         error
+		storageName string
+		dbPassword  rotatingSecret
 	)
 	if config.Config.DbURI != "" {
-		dbConn, err = pg.NewStorage(config.Config.DbURI)
+		dbConn, err = pg.NewStorage(config.Config.DbURI, pg.Options{
+			QueryTimeout:     time.Duration(config.Config.PgQueryTimeout) * time.Millisecond,
+			AcquireWaitAlarm: time.Duration(config.Config.PgAcquireAlarm) * time.Millisecond,
+			Password:         dbPassword.Get,
+		})
 		if err != nil {
 			log.Fatalf("db connection %v", err)
 		}
+		storageName = "postgres"
+	} else if config.Config.ValkeyURI != "" {
+		dbConn, err = valkey.NewStorage(config.Config.ValkeyURI, valkey.Options{
+			MaxTTL:     time.Duration(longestTTL()) * time.Second,
+			Mode:       config.Config.ValkeyMode,
+			MasterName: config.Config.ValkeyMasterName,
+		})
+		if err != nil {
+			log.Fatalf("valkey connection %v", err)
+		}
+		storageName = "valkey"
 	} else {
 		dbConn = memory.NewStorage()
+		storageName = "memory"
+	}
+
+	if !logPreflight(runPreflight(preflightChecks, dbConn, 5*time.Second), storageName) && config.Config.PreflightFailFast {
+		log.Fatal("mandatory preflight checks failed")
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		if !printSelfTestReport(os.Stdout, runSelfTests(dbConn)) {
+			os.Exit(1)
+		}
+		return
 	}
 
 	http.Handle("/metrics", promhttp.Handler())
 	go func() {
-		log.Fatal(http.ListenAndServe(":9103", nil))
+		log.Fatal(http.ListenAndServe(":9103", bodyLimitHandler(http.DefaultServeMux, config.Config.DefaultBodyLimit)))
 	}()
 
-	e := echo.New()
-	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{
-		Skipper:           nil,
-		DisableStackAll:   true,
-		DisablePrintStack: false,
-	}))
-	e.Use(middleware.Logger())
-	e.Use(middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
-		Skipper: func(c echo.Context) bool {
-			if skipRateLimitsByToken(c.Request()) || c.Path() != "/bridge/message" {
-				return true
-			}
-			return false
-		},
-		Store: middleware.NewRateLimiterMemoryStore(rate.Limit(config.Config.RPSLimit)),
-	}))
-	e.Use(connectionsLimitMiddleware(newConnectionLimiter(config.Config.ConnectionsLimit), func(c echo.Context) bool {
-		if skipRateLimitsByToken(c.Request()) || c.Path() != "/bridge/events" {
+	ipExtractor, err = newIPExtractor(config.Config.TrustedProxies)
+	if err != nil {
+		log.Fatalf("trusted proxies: %v", err)
+	}
+	allowlist, err := newLimitsAllowlist(config.Config.LimitsAllowlistCIDRs, config.Config.LimitsAllowlistTokens)
+	if err != nil {
+		log.Fatalf("limits allowlist: %v", err)
+	}
+	rateLimitSkipper := func(c echo.Context) bool {
+		if skipRateLimitsByToken(c.Request()) || c.Path() != "/bridge/message" {
 			return true
 		}
-		return false
-	}))
-
+		return allowlist.Skip(c.Request(), "rate")
+	}
+	clientLimitSkipper := func(c echo.Context) bool {
+		return allowlist.unlimited(c.Request())
+	}
+	middlewares := []echo.MiddlewareFunc{
+		middleware.RecoverWithConfig(middleware.RecoverConfig{
+			Skipper:           nil,
+			DisableStackAll:   true,
+			DisablePrintStack: false,
+		}),
+		middleware.LoggerWithConfig(requestLoggerConfig),
+		urlLengthLimitMiddleware(config.Config.MaxURLLength),
+		rateLimitHeadersMiddleware(config.Config.RPSLimit, rateLimitSkipper),
+		middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+			Skipper: rateLimitSkipped,
+			Store:   middleware.NewRateLimiterMemoryStore(rate.Limit(config.Config.RPSLimit)),
+		}),
+		connectionsLimitMiddleware(newConnectionLimiter(config.Config.ConnectionsLimit), func(c echo.Context) bool {
+			if skipRateLimitsByToken(c.Request()) || c.Path() != "/bridge/events" {
+				return true
+			}
+			return allowlist.Skip(c.Request(), "connections")
+		}),
+		shedMiddleware(config.Config.ShedWatermark, func(c echo.Context) bool {
+			return allowlist.authenticated(c.Request())
+		}),
+		clientRateLimitMiddleware("/bridge/message", config.Config.ClientMessageRPSLimit, clientLimitSkipper),
+		clientRateLimitMiddleware("/bridge/events", config.Config.ClientEventsRPSLimit, clientLimitSkipper),
+	}
 	if config.Config.CorsEnable {
 		corsConfig := middleware.CORSWithConfig(middleware.CORSConfig{
 			AllowOrigins:     []string{"*"},
 			AllowMethods:     []string{echo.GET, echo.POST, echo.OPTIONS},
-			AllowHeaders:     []string{"DNT", "X-CustomHeader", "Keep-Alive", "User-Agent", "X-Requested-With", "If-Modified-Since", "Cache-Control", "Content-Type", "Authorization"},
+			AllowHeaders:     []string{"DNT", "X-CustomHeader", "Keep-Alive", "User-Agent", "X-Requested-With", "If-Modified-Since", "Cache-Control", "Content-Type", "Authorization", sdkHeader},
 			AllowCredentials: true,
 			MaxAge:           86400,
 		})
-		e.Use(corsConfig)
+		middlewares = append(middlewares, corsConfig)
 	}
 
 	h := newHandler(dbConn, time.Duration(config.Config.HeartbeatInterval)*time.Second)
+	h.storageName = storageName
+	h.allowlist = allowlist
+	if config.Config.AdminToken != "" {
+		http.Handle("/status", newStatusPage(config.Config.AdminToken, storageName, h.health))
+	}
+	if config.Config.SecretsRefresh > 0 {
+		go config.WatchSecrets(time.Duration(config.Config.SecretsRefresh)*time.Second, func(key, value string) {
+			h.applySecret(&dbPassword, key, value)
+		})
+	}
+	if config.Config.ConformanceInterval > 0 {
+		h.conformance = &conformanceResults{}
+		go h.conformanceWorker(time.Duration(config.Config.ConformanceInterval) * time.Second)
+	}
+
+	var listeners []listener
+	if config.Config.EventsPort == 0 || config.Config.EventsPort == config.Config.Port {
+		e := newEcho(middlewares)
+		registerHandlers(e, h)
+		listeners = append(listeners, listener{e: e, addr: fmt.Sprintf("%v:%v", config.Config.Host, config.Config.Port), selfSignedTLS: config.Config.SelfSignedTLS})
+	} else {
+		api := newEcho(middlewares)
+		registerMessageHandlers(api, h)
+		events := newEcho(middlewares)
+		registerEventsHandlers(events, h)
+		listeners = append(listeners,
+			listener{e: api, addr: fmt.Sprintf("%v:%v", config.Config.Host, config.Config.Port), selfSignedTLS: config.Config.SelfSignedTLS},
+			listener{e: events, addr: fmt.Sprintf("%v:%v", config.Config.EventsHost, config.Config.EventsPort), selfSignedTLS: config.Config.EventsSelfSignedTLS},
+		)
+	}
 
-	registerHandlers(e, h)
 	var existedPaths []string
-	for _, r := range e.Routes() {
-		existedPaths = append(existedPaths, r.Path)
+	for _, l := range listeners {
+		for _, r := range l.e.Routes() {
+			existedPaths = append(existedPaths, r.Path)
+		}
 	}
 	p := prometheus.NewPrometheus("http", func(c echo.Context) bool {
 		return !slices.Contains(existedPaths, c.Path())
 	})
-	e.Use(p.HandlerFunc)
-	if config.Config.SelfSignedTLS {
-		cert, key, err := generateSelfSignedCertificate()
-		if err != nil {
-			log.Fatalf("failed to generate self signed certificate: %v", err)
+	for _, l := range listeners {
+		l.e.Use(p.HandlerFunc)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for _, l := range listeners {
+		go l.start()
+	}
+
+	<-ctx.Done()
+	log.Info("shutting down")
+	h.CloseAllSessions(closeReasonShutdown)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, l := range listeners {
+		if err := l.e.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("shutdown %v: %v", l.addr, err)
 		}
-		log.Fatal(e.StartTLS(fmt.Sprintf(":%v", config.Config.Port), cert, key))
+	}
+	// the storage writes queued by the last requests are flushed before exiting
+	h.Close()
+}
+
+func newEcho(middlewares []echo.MiddlewareFunc) *echo.Echo {
+	e := echo.New()
+	e.IPExtractor = ipExtractor
+	e.Server.MaxHeaderBytes = config.Config.MaxHeaderBytes
+	e.Server.ConnContext = withConn
+	e.TLSServer.ConnContext = withConn
+	e.Use(middlewares...)
+	return e
+}
+
+type listener struct {
+	e             *echo.Echo
+	addr          string
+	selfSignedTLS bool
+}
+
+func (l listener) start() {
+	var err error
+	if l.selfSignedTLS {
+		cert, key, certErr := generateSelfSignedCertificate()
+		if certErr != nil {
+			log.Fatalf("failed to generate self signed certificate: %v", certErr)
+		}
+		err = l.e.StartTLS(l.addr, cert, key)
 	} else {
-		log.Fatal(e.Start(fmt.Sprintf(":%v", config.Config.Port)))
+		err = l.e.Start(l.addr)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/tonkeeper/bridge/config"
+)
+
+// TestMain runs the tests with the default configuration, tests change single values on top of it.
+func TestMain(m *testing.M) {
+	if err := config.Load(nil); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
@@ -1,23 +1,109 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	connectionsLimitHeader     = "X-Connections-Limit"
+	connectionsRemainingHeader = "X-Connections-Remaining"
+)
+
 func connectionsLimitMiddleware(counter *ConnectionsLimiter, skipper func(c echo.Context) bool) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			if skipper(c) {
 				return next(c)
 			}
-			release, err := counter.leaseConnection(c.Request())
+			release, used, err := counter.leaseConnection(c.Request())
+			c.Response().Header().Set(connectionsLimitHeader, strconv.Itoa(counter.max))
 			if err != nil {
 				return c.JSON(HttpResError(err.Error(), http.StatusTooManyRequests))
 			}
+			c.Response().Header().Set(connectionsRemainingHeader, strconv.Itoa(counter.max-used))
+			warnSoftLimit(c, "connections", used, counter.max)
 			defer release()
 			return next(c)
 		}
 	}
 }
+
+// urlLengthLimitMiddleware rejects requests whose URL is longer than max with a structured 414 error
+// instead of letting them fail somewhere deeper in the stack.
+func urlLengthLimitMiddleware(max int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if max > 0 && len(c.Request().RequestURI) > max {
+				badRequestMetric.Inc()
+				errorMsg := fmt.Sprintf("url is longer than %v bytes, pass client_id in the POST body instead", max)
+				return c.JSON(HttpResError(errorMsg, http.StatusRequestURITooLong))
+			}
+			return next(c)
+		}
+	}
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// bodyLimitMiddleware rejects requests with bodies larger than limit bytes with a structured 413 error.
+// Bodies without Content-Length are cut off while being read and the handler sees errBodyTooLarge.
+func bodyLimitMiddleware(limit int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if limit <= 0 {
+				return next(c)
+			}
+			req := c.Request()
+			if req.ContentLength > limit {
+				badRequestMetric.Inc()
+				return c.JSON(HttpResError(fmt.Sprintf("%v: limit is %v bytes", errBodyTooLarge, limit), http.StatusRequestEntityTooLarge))
+			}
+			req.Body = &limitedBody{ReadCloser: req.Body, remaining: limit}
+			return next(c)
+		}
+	}
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// bodyLimitHandler is bodyLimitMiddleware for plain net/http handlers such as the metrics listener.
+func bodyLimitHandler(next http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limit > 0 && r.ContentLength > limit {
+			code, res := HttpResError(fmt.Sprintf("%v: limit is %v bytes", errBodyTooLarge, limit), http.StatusRequestEntityTooLarge)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		if limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
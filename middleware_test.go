@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/config"
+)
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantCode      int
+	}{
+		{name: "under limit", body: "12345", contentLength: 5, wantCode: http.StatusOK},
+		{name: "declared too large", body: "123456", contentLength: 6, wantCode: http.StatusRequestEntityTooLarge},
+		{name: "chunked under limit", body: "12345", contentLength: -1, wantCode: http.StatusOK},
+		{name: "chunked too large", body: "123456789", contentLength: -1, wantCode: http.StatusRequestEntityTooLarge},
+	}
+	handler := bodyLimitMiddleware(5)(func(c echo.Context) error {
+		_, err := io.ReadAll(c.Request().Body)
+		if errors.Is(err, errBodyTooLarge) {
+			return c.JSON(HttpResError(err.Error(), http.StatusRequestEntityTooLarge))
+		}
+		return c.JSON(http.StatusOK, HttpResOk())
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/bridge/message", strings.NewReader(tt.body))
+			req.ContentLength = tt.contentLength
+			rec := httptest.NewRecorder()
+			if err := handler(echo.New().NewContext(req, rec)); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %v, want %v", rec.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestURLLengthLimitMiddleware(t *testing.T) {
+	prefix := "/bridge/events?client_id="
+	tests := []struct {
+		name     string
+		max      int
+		uri      string
+		wantCode int
+	}{
+		{name: "under limit", max: 30, uri: prefix + "abcd", wantCode: http.StatusOK},
+		{name: "at limit", max: 30, uri: prefix + "abcde", wantCode: http.StatusOK},
+		{name: "over limit", max: 30, uri: prefix + "abcdef", wantCode: http.StatusRequestURITooLong},
+		{name: "disabled", max: 0, uri: prefix + strings.Repeat("a", 20000), wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := urlLengthLimitMiddleware(tt.max)(func(c echo.Context) error {
+				return c.JSON(http.StatusOK, HttpResOk())
+			})
+			rec := httptest.NewRecorder()
+			if err := handler(echo.New().NewContext(httptest.NewRequest(http.MethodGet, tt.uri, nil), rec)); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %v, want %v", rec.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusRequestURITooLong && !strings.Contains(rec.Body.String(), "longer than 30 bytes") {
+				t.Fatalf("unexpected body %v", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestWarnSoftLimit(t *testing.T) {
+	defer func(r float64) { config.Config.SoftLimitRatio = r }(config.Config.SoftLimitRatio)
+	tests := []struct {
+		ratio     float64
+		used, max int
+		want      string
+	}{
+		{ratio: 0.8, used: 3, max: 5},
+		{ratio: 0.8, used: 4, max: 5, want: "rate=4/5"},
+		{ratio: 0, used: 5, max: 5},
+	}
+	for _, tt := range tests {
+		config.Config.SoftLimitRatio = tt.ratio
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/bridge/message", nil), httptest.NewRecorder())
+		warnSoftLimit(c, "rate", tt.used, tt.max)
+		if got := c.Response().Header().Get(limitWarningHeader); got != tt.want {
+			t.Errorf("ratio %v, %v/%v: want %q, got %q", tt.ratio, tt.used, tt.max, tt.want, got)
+		}
+	}
+}
+
+func TestRequestRateTracker(t *testing.T) {
+	tr := newRequestRateTracker()
+	now := time.Now()
+	tr.Hit("a", now)
+	if got := tr.Hit("a", now.Add(500*time.Millisecond)); got != 2 {
+		t.Fatalf("want 2 hits in the window, got %v", got)
+	}
+	if got := tr.Hit("a", now.Add(time.Second)); got != 1 {
+		t.Fatalf("want the window to reset, got %v", got)
+	}
+}
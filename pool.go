@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	sideEffectQueueDepthMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "side_effect_queue_depth",
+		Help: "The number of side-effect tasks waiting for a worker",
+	}, []string{"pool"})
+	sideEffectDroppedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_dropped_side_effects",
+		Help: "The total number of side-effect tasks dropped because the pool was saturated",
+	}, []string{"pool"})
+)
+
+// saturationPolicy defines what workerPool.Submit does when the queue is full.
+type saturationPolicy int
+
+const (
+	// dropWhenFull discards the task.
+	dropWhenFull saturationPolicy = iota
+	// runWhenFull executes the task in the caller's goroutine.
+	runWhenFull
+)
+
+// workerPool runs side-effect tasks (webhooks, copies, storage writes)
+// on a fixed number of goroutines fed from a bounded queue.
+type workerPool struct {
+	name   string
+	queue  chan func()
+	policy saturationPolicy
+	// mu guards closed, Submit holds it for reading while it enqueues.
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+func newWorkerPool(name string, workers, queueSize int, policy saturationPolicy) *workerPool {
+	p := &workerPool{
+		name:   name,
+		queue:  make(chan func(), queueSize),
+		policy: policy,
+	}
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *workerPool) worker() {
+	defer p.workers.Done()
+	for task := range p.queue {
+		sideEffectQueueDepthMetric.WithLabelValues(p.name).Dec()
+		task()
+	}
+}
+
+// Close runs the queued tasks and stops the workers. Tasks submitted afterwards are handled
+// as if the queue was full.
+func (p *workerPool) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	p.workers.Wait()
+}
+
+// Submit enqueues task and reports whether it was accepted by the pool.
+// If the queue is full the task is either dropped or run synchronously, depending on the pool's policy.
+func (p *workerPool) Submit(task func()) bool {
+	depth := sideEffectQueueDepthMetric.WithLabelValues(p.name)
+	p.mu.RLock()
+	if !p.closed {
+		depth.Inc()
+		select {
+		case p.queue <- task:
+			p.mu.RUnlock()
+			return true
+		default:
+			depth.Dec()
+		}
+	}
+	p.mu.RUnlock()
+	if p.policy == runWhenFull {
+		task()
+		return true
+	}
+	sideEffectDroppedMetric.WithLabelValues(p.name).Inc()
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWorkerPool_Submit(t *testing.T) {
+	block := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	p := newWorkerPool("test", 1, 1, dropWhenFull)
+	p.Submit(func() {
+		wg.Done()
+		<-block
+	})
+	wg.Wait()
+	if !p.Submit(func() {}) {
+		t.Fatal("queued task must be accepted")
+	}
+	if p.Submit(func() {}) {
+		t.Fatal("task must be dropped when the queue is full")
+	}
+	close(block)
+
+	ran := false
+	p = newWorkerPool("test-run", 0, 0, runWhenFull)
+	if !p.Submit(func() { ran = true }) || !ran {
+		t.Fatal("task must run in the caller when the queue is full")
+	}
+}
+
+func TestWorkerPool_Close(t *testing.T) {
+	block := make(chan struct{})
+	var ran int32
+	p := newWorkerPool("test-close", 1, 10, runWhenFull)
+	p.Submit(func() { <-block })
+	for i := 0; i < 5; i++ {
+		p.Submit(func() { atomic.AddInt32(&ran, 1) })
+	}
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+	close(block)
+	<-closed
+	if got := atomic.LoadInt32(&ran); got != 5 {
+		t.Fatalf("queued tasks must run before Close returns, %v of 5 ran", got)
+	}
+	// the pool is closed, runWhenFull runs the task in the caller
+	if !p.Submit(func() { atomic.AddInt32(&ran, 1) }) || atomic.LoadInt32(&ran) != 6 {
+		t.Fatal("task submitted after Close must run in the caller")
+	}
+	drop := newWorkerPool("test-drop", 1, 1, dropWhenFull)
+	drop.Close()
+	if drop.Submit(func() {}) {
+		t.Fatal("task submitted after Close must be dropped")
+	}
+}
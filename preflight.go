@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/config"
+)
+
+// maxClockOffset is the largest clock offset from the NTP server that passes the preflight check,
+// event ids are creation times and replicas with skewed clocks break their ordering.
+const maxClockOffset = time.Second
+
+// errPreflightSkipped is returned by checks of dependencies that aren't configured.
+var errPreflightSkipped = errors.New("skipped")
+
+// migrationChecker is implemented by storages with a versioned schema.
+type migrationChecker interface {
+	CheckMigrations(ctx context.Context) error
+}
+
+type preflightCheck struct {
+	Name string
+	// Mandatory checks stop the bridge with PREFLIGHT_FAIL_FAST.
+	Mandatory bool
+	Run       func(ctx context.Context, storage db) (details string, err error)
+}
+
+type preflightResult struct {
+	selfTestResult
+	Mandatory bool   `json:"mandatory"`
+	Details   string `json:"details,omitempty"`
+}
+
+var preflightChecks = []preflightCheck{
+	{Name: "storage", Mandatory: true, Run: preflightStorage},
+	{Name: "migrations", Mandatory: true, Run: preflightMigrations},
+	{Name: "ntp", Run: preflightNTP},
+	{Name: "endpoints", Run: preflightEndpoints},
+}
+
+// runPreflight runs checks concurrently with a timeout each and returns their results in order.
+func runPreflight(checks []preflightCheck, storage db, timeout time.Duration) []preflightResult {
+	results := make([]preflightResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		i, check := i, check
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			details, err := check.Run(ctx, storage)
+			res := preflightResult{
+				selfTestResult: selfTestResult{Name: check.Name, Passed: err == nil, Duration: time.Since(start)},
+				Mandatory:      check.Mandatory,
+				Details:        details,
+			}
+			switch {
+			case errors.Is(err, errPreflightSkipped):
+				res.Passed, res.Skipped = true, true
+			case err != nil:
+				res.Error = err.Error()
+			}
+			results[i] = res
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// logPreflight writes the startup banner and a line per check, it returns false if a mandatory check failed.
+func logPreflight(results []preflightResult, storageName string) bool {
+	log := log.WithField("prefix", "preflight")
+	log.WithFields(map[string]interface{}{
+		"version":             version,
+		"storage":             storageName,
+		"port":                config.Config.Port,
+		"events_port":         config.Config.EventsPort,
+		"storage_down_policy": config.Config.StorageDownPolicy,
+		"max_ttl":             config.Config.MaxTTL,
+	}).Info("bridge starting")
+	ok := true
+	for _, r := range results {
+		entry := log.WithFields(map[string]interface{}{
+			"check":     r.Name,
+			"mandatory": r.Mandatory,
+			"duration":  r.Duration.Round(time.Millisecond).String(),
+		})
+		if r.Details != "" {
+			entry = entry.WithField("details", r.Details)
+		}
+		switch {
+		case r.Skipped:
+			entry.Info("skipped")
+		case r.Passed:
+			entry.Info("ok")
+		default:
+			if r.Mandatory {
+				ok = false
+			}
+			entry.WithField("error", r.Error).Warn("failed")
+		}
+	}
+	return ok
+}
+
+func preflightStorage(ctx context.Context, storage db) (string, error) {
+	_, err := storage.GetMessages(ctx, []string{"preflight-" + newTraceId()}, 0)
+	return "", err
+}
+
+func preflightMigrations(ctx context.Context, storage db) (string, error) {
+	checker, ok := storage.(migrationChecker)
+	if !ok {
+		return "", errPreflightSkipped
+	}
+	return "", checker.CheckMigrations(ctx)
+}
+
+func preflightNTP(ctx context.Context, storage db) (string, error) {
+	if config.Config.NTPServer == "" {
+		return "", errPreflightSkipped
+	}
+	offset, err := ntpOffset(ctx, config.Config.NTPServer)
+	if err != nil {
+		return "", err
+	}
+	details := fmt.Sprintf("offset %v", offset.Round(time.Millisecond))
+	if offset > maxClockOffset || offset < -maxClockOffset {
+		return details, fmt.Errorf("clock is off by %v", offset)
+	}
+	return details, nil
+}
+
+// preflightEndpoints resolves the hosts of the webhook and copy urls.
+func preflightEndpoints(ctx context.Context, storage db) (string, error) {
+	var urls []string
+	if config.Config.WebhookURL != "" {
+		urls = append(urls, strings.Split(config.Config.WebhookURL, ",")...)
+	}
+	for _, v := range config.Config.WebhookTopicURLs {
+		_, u, _ := strings.Cut(v, ":")
+		urls = append(urls, u)
+	}
+	if config.Config.CopyToURL != "" {
+		urls = append(urls, config.Config.CopyToURL)
+	}
+	if len(urls) == 0 {
+		return "", errPreflightSkipped
+	}
+	var failed []string
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", raw, err))
+			continue
+		}
+		if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", u.Hostname(), err))
+		}
+	}
+	if len(failed) > 0 {
+		return "", errors.New(strings.Join(failed, "; "))
+	}
+	return fmt.Sprintf("%v urls", len(urls)), nil
+}
+
+// ntpEpochOffset is the number of seconds between 1900-01-01, the NTP epoch, and the unix epoch.
+const ntpEpochOffset = 2208988800
+
+// ntpOffset asks server for the time with a single SNTP request and returns how far the local clock is behind it.
+func ntpOffset(ctx context.Context, server string) (time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := make([]byte, 48)
+	req[0] = 0x1b // no leap indicator, version 3, client mode
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	res := make([]byte, 48)
+	n, err := conn.Read(res)
+	if err != nil {
+		return 0, err
+	}
+	received := time.Now()
+	if n < 48 {
+		return 0, fmt.Errorf("short ntp response of %v bytes", n)
+	}
+	if res[1] == 0 {
+		return 0, fmt.Errorf("ntp server refused the request")
+	}
+	// the transmit timestamp of the server
+	secs := binary.BigEndian.Uint32(res[40:44])
+	frac := binary.BigEndian.Uint32(res[44:48])
+	serverTime := time.Unix(int64(secs)-ntpEpochOffset, int64((uint64(frac)*1e9)>>32))
+	return serverTime.Sub(sent.Add(received.Sub(sent) / 2)), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestRunPreflight(t *testing.T) {
+	checks := []preflightCheck{
+		{Name: "slow", Mandatory: true, Run: func(ctx context.Context, storage db) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}},
+		{Name: "storage", Mandatory: true, Run: preflightStorage},
+		{Name: "skipped", Run: func(ctx context.Context, storage db) (string, error) {
+			return "", errPreflightSkipped
+		}},
+		{Name: "optional", Run: func(ctx context.Context, storage db) (string, error) {
+			return "details", errors.New("unavailable")
+		}},
+	}
+	start := time.Now()
+	results := runPreflight(checks, memory.NewStorage(), 50*time.Millisecond)
+	if time.Since(start) > time.Second {
+		t.Fatalf("checks are not limited by the timeout")
+	}
+	want := []struct {
+		name            string
+		passed, skipped bool
+	}{
+		{name: "slow"}, {name: "storage", passed: true}, {name: "skipped", passed: true, skipped: true}, {name: "optional"},
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.Name != w.name || r.Passed != w.passed || r.Skipped != w.skipped {
+			t.Errorf("result %v: want %+v, got %+v", i, w, r)
+		}
+	}
+	if logPreflight(results, "memory") {
+		t.Fatal("a failed mandatory check must fail the preflight")
+	}
+	if !logPreflight(results[1:], "memory") {
+		t.Fatal("a failed optional check must not fail the preflight")
+	}
+}
+
+func TestNTPOffset(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	skew := 3 * time.Second
+	go func() {
+		req := make([]byte, 48)
+		_, addr, err := conn.ReadFrom(req)
+		if err != nil {
+			return
+		}
+		res := make([]byte, 48)
+		res[0], res[1] = 0x1c, 1
+		now := time.Now().Add(skew)
+		binary.BigEndian.PutUint32(res[40:], uint32(now.Unix()+ntpEpochOffset))
+		binary.BigEndian.PutUint32(res[44:], uint32((uint64(now.Nanosecond())<<32)/1e9))
+		conn.WriteTo(res, addr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	offset, err := ntpOffset(ctx, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := offset - skew; diff > 100*time.Millisecond || diff < -100*time.Millisecond {
+		t.Fatalf("want offset about %v, got %v", skew, offset)
+	}
+}
@@ -2,52 +2,208 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
 	"github.com/tonkeeper/bridge/config"
 )
 
+var (
+	webhookDeliveriesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_webhook_deliveries",
+		Help: "The total number of webhook calls by result: success, retry, failure or dropped",
+	}, []string{"result"})
+	webhookDurationMetric = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "webhook_duration_seconds",
+		Help: "How long webhook calls take",
+	})
+)
+
+const (
+	webhookTimestampHeader = "X-Bridge-Timestamp"
+	webhookSignatureHeader = "X-Bridge-Signature"
+	// webhookMaxBackoff caps the exponential backoff between retries.
+	webhookMaxBackoff = time.Minute
+)
+
 type WebhookData struct {
-	Topic string `json:"topic"`
-	Hash  string `json:"hash"`
+	Topic          string `json:"topic"`
+	Hash           string `json:"hash"`
+	Origin         string `json:"origin,omitempty"`
+	PreviousOrigin string `json:"previous_origin,omitempty"`
+	// Count, OldestSeconds and Topics describe the pending messages in a digest.
+	Count         int      `json:"count,omitempty"`
+	OldestSeconds int64    `json:"oldest_seconds,omitempty"`
+	Topics        []string `json:"topics,omitempty"`
 }
 
-func SendWebhook(clientID string, body WebhookData) {
-	if config.Config.WebhookURL == "" {
+// originChangedTopic is the webhook topic sent when a client_id reconnects from another Origin.
+const originChangedTopic = "origin_changed"
+
+// webhookDispatcher calls the webhooks configured for a topic on the webhook worker pool,
+// retrying failed calls with exponential backoff.
+type webhookDispatcher struct {
+	pool   *workerPool
+	client *http.Client
+	// urls are called for every topic, topicURLs only for their topic.
+	urls      []string
+	topicURLs map[string][]string
+	secretMu  sync.RWMutex
+	secret    []byte
+	retries   int
+	backoff   time.Duration
+	// failures is nil unless the dispatcher belongs to a handler, see sideEffectFailures.
+	failures *sideEffectFailures
+}
+
+type webhookCall struct {
+	url         string
+	destination string
+	payload     []byte
+	attempt     int
+}
+
+func newWebhookDispatcher(pool *workerPool) *webhookDispatcher {
+	d := &webhookDispatcher{
+		pool:      pool,
+		client:    newSideEffectClient(),
+		topicURLs: map[string][]string{},
+		secret:    []byte(config.Config.WebhookSecret),
+		retries:   config.Config.WebhookRetries,
+		backoff:   time.Duration(config.Config.WebhookBackoff) * time.Millisecond,
+	}
+	if config.Config.WebhookURL != "" {
+		d.urls = strings.Split(config.Config.WebhookURL, ",")
+	}
+	for _, v := range config.Config.WebhookTopicURLs {
+		topic, url, _ := strings.Cut(v, ":")
+		d.topicURLs[topic] = append(d.topicURLs[topic], url)
+	}
+	return d
+}
+
+// Send queues a call of every webhook of body's topic with clientID appended to its url.
+func (d *webhookDispatcher) Send(clientID string, body WebhookData) {
+	urls := append(d.urls[:len(d.urls):len(d.urls)], d.topicURLs[body.Topic]...)
+	if len(urls) == 0 {
+		return
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		log.Errorf("failed to marshal webhook body: %v", err)
 		return
 	}
-	webhooks := strings.Split(config.Config.WebhookURL, ",")
-	for _, webhook := range webhooks {
-		go func(webhook string) {
-			err := sendWebhook(clientID, body, webhook)
-			if err != nil {
-				log.Errorf("failed to trigger webhook '%s': %v", webhook, err)
-			}
-		}(webhook)
+	for _, url := range urls {
+		d.submit(webhookCall{url: url + "/" + clientID, destination: sideEffectDestination(url), payload: payload})
 	}
 }
 
+// SetSecret replaces the secret signing webhook payloads, e.g. after it's rotated in a secret manager.
+func (d *webhookDispatcher) SetSecret(secret []byte) {
+	d.secretMu.Lock()
+	defer d.secretMu.Unlock()
+	d.secret = secret
+}
+
+func (d *webhookDispatcher) submit(call webhookCall) {
+	if !d.pool.Submit(func() { d.call(call) }) {
+		webhookDeliveriesMetric.WithLabelValues("dropped").Inc()
+		sideEffectCallsMetric.WithLabelValues(sideEffectWebhook, call.destination, sideEffectDropped).Inc()
+	}
+}
+
+func (d *webhookDispatcher) call(call webhookCall) {
+	start := time.Now()
+	d.secretMu.RLock()
+	secret := d.secret
+	d.secretMu.RUnlock()
+	err := postWebhook(d.client, call.url, call.payload, secret)
+	webhookDurationMetric.Observe(time.Since(start).Seconds())
+	retry := err != nil && call.attempt < d.retries && retryableWebhookError(err)
+	recordSideEffect(d.failures, sideEffectWebhook, call.destination, call.attempt, time.Since(start), err, retry)
+	if err == nil {
+		webhookDeliveriesMetric.WithLabelValues("success").Inc()
+		return
+	}
+	if !retry {
+		webhookDeliveriesMetric.WithLabelValues("failure").Inc()
+		log.Errorf("failed to trigger webhook '%s' after %v attempts: %v", call.url, call.attempt+1, err)
+		return
+	}
+	webhookDeliveriesMetric.WithLabelValues("retry").Inc()
+	backoff := d.backoff << call.attempt
+	if backoff > webhookMaxBackoff || backoff <= 0 {
+		backoff = webhookMaxBackoff
+	}
+	call.attempt++
+	time.AfterFunc(backoff, func() { d.submit(call) })
+}
+
+type webhookStatusError struct {
+	code int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("bad status code: %v", e.code)
+}
+
+// retryableWebhookError reports whether a call may succeed later: network errors, 429 and 5xx are retried.
+func retryableWebhookError(err error) bool {
+	var statusErr *webhookStatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	return statusErr.code == http.StatusTooManyRequests || statusErr.code >= 500
+}
+
+// webhookSignature is the hex encoded HMAC-SHA256 of timestamp, a dot and payload.
+func webhookSignature(secret []byte, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 func sendWebhook(clientID string, body WebhookData, webhook string) error {
 	postBody, err := json.Marshal(body)
 	if err != nil {
 		return fmt.Errorf("failed to marshal body: %w", err)
 	}
-	req, err := http.NewRequest(http.MethodPost, webhook+"/"+clientID, bytes.NewReader(postBody))
+	return postWebhook(newSideEffectClient(), webhook+"/"+clientID, postBody, []byte(config.Config.WebhookSecret))
+}
+
+// postWebhook posts payload to url with client, signed with secret unless it's empty.
+func postWebhook(client *http.Client, url string, payload, secret []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
 	if err != nil {
 		return fmt.Errorf("failed to init request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	res, err := http.DefaultClient.Do(req)
+	if len(secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(secret, timestamp, payload))
+	}
+	res, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed send request: %w", err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status code: %v", res.StatusCode)
+		return &webhookStatusError{code: res.StatusCode}
 	}
 	return nil
 }
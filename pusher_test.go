@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/tonkeeper/bridge/config"
 )
@@ -41,7 +42,7 @@ func TestSendWebhook(t *testing.T) {
 	}
 	config.Config.WebhookURL = fmt.Sprintf("%s/webhook,%s/callback", hook1.URL, hook2.URL)
 
-	SendWebhook("SOME-CLIENT-ID", data)
+	newWebhookDispatcher(newWorkerPool("webhook", 2, 10, dropWhenFull)).Send("SOME-CLIENT-ID", data)
 	wg.Wait()
 	close(urls)
 
@@ -57,3 +58,69 @@ func TestSendWebhook(t *testing.T) {
 		t.Fatalf("bad urls: %v", calledUrls)
 	}
 }
+
+func TestWebhookDispatcher_RetriesAndSignature(t *testing.T) {
+	defer func(url string, topicURLs []string, secret string, retries, backoff int) {
+		config.Config.WebhookURL, config.Config.WebhookTopicURLs, config.Config.WebhookSecret = url, topicURLs, secret
+		config.Config.WebhookRetries, config.Config.WebhookBackoff = retries, backoff
+	}(config.Config.WebhookURL, config.Config.WebhookTopicURLs, config.Config.WebhookSecret, config.Config.WebhookRetries, config.Config.WebhookBackoff)
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+	done := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := "sha256=" + webhookSignature([]byte("secret"), r.Header.Get(webhookTimestampHeader), body)
+		if r.Header.Get(webhookSignatureHeader) != want {
+			t.Errorf("bad signature %q, want %q", r.Header.Get(webhookSignatureHeader), want)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		calls[r.URL.Path]++
+		if r.URL.Path == "/connect/wallet" && calls[r.URL.Path] < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.URL.Path == "/connect/wallet" {
+			close(done)
+		}
+	}))
+	defer hook.Close()
+	config.Config.WebhookURL = ""
+	config.Config.WebhookTopicURLs = []string{"connect:" + hook.URL + "/connect", "other:" + hook.URL + "/other"}
+	config.Config.WebhookSecret = "secret"
+	config.Config.WebhookRetries, config.Config.WebhookBackoff = 3, 1
+
+	newWebhookDispatcher(newWorkerPool("webhook", 2, 10, dropWhenFull)).Send("wallet", WebhookData{Topic: "connect"})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook is not retried")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := map[string]int{"/connect/wallet": 3}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("want calls %v, got %v", want, calls)
+	}
+}
+
+func TestPostWebhook_Timeout(t *testing.T) {
+	defer func(timeout int) { config.Config.SideEffectTimeout = timeout }(config.Config.SideEffectTimeout)
+	config.Config.SideEffectTimeout = 50
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	d := newWebhookDispatcher(newWorkerPool("test", 0, 0, dropWhenFull))
+	start := time.Now()
+	if err := postWebhook(d.client, srv.URL, []byte("{}"), nil); err == nil {
+		t.Fatal("want an error from a webhook that doesn't answer")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the call took %v, want it to give up after the timeout", elapsed)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	readOnlyMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "read_only",
+		Help: "1 while /bridge/message is rejected for maintenance, 0 otherwise",
+	})
+	readOnlyRejectedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_read_only_rejections",
+		Help: "The total number of messages rejected in read-only mode",
+	})
+)
+
+// maintenanceCode is the code of errors returned in read-only mode.
+const maintenanceCode = "maintenance"
+
+// maintenanceRes is returned by /bridge/message in read-only mode.
+type maintenanceRes struct {
+	HttpRes
+	Code   string `json:"code" example:"maintenance"`
+	Reason string `json:"reason,omitempty"`
+	Since  int64  `json:"since"`
+}
+
+// readOnlyMode stops new messages while streams keep delivering the queued and stored ones,
+// e.g. during a storage incident.
+type readOnlyMode struct {
+	mu      sync.RWMutex
+	enabled bool
+	reason  string
+	since   time.Time
+}
+
+type readOnlyState struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+	Since   int64  `json:"since,omitempty"`
+}
+
+func (m *readOnlyMode) Set(enabled bool, reason string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if enabled == m.enabled && reason == m.reason {
+		return
+	}
+	if enabled != m.enabled {
+		m.since = now
+	}
+	m.enabled, m.reason = enabled, reason
+	if enabled {
+		readOnlyMetric.Set(1)
+		log.WithField("prefix", "readOnlyMode").Warnf("read-only mode enabled: %v", reason)
+	} else {
+		readOnlyMetric.Set(0)
+		log.WithField("prefix", "readOnlyMode").Info("read-only mode disabled")
+	}
+}
+
+func (m *readOnlyMode) State() readOnlyState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.enabled {
+		return readOnlyState{}
+	}
+	return readOnlyState{Enabled: true, Reason: m.reason, Since: m.since.Unix()}
+}
+
+// rejectReadOnly answers a message sent in read-only mode with 503 and a maintenance error.
+func rejectReadOnly(c echo.Context, state readOnlyState) error {
+	readOnlyRejectedMetric.Inc()
+	code := http.StatusServiceUnavailable
+	return c.JSON(code, maintenanceRes{
+		HttpRes: HttpRes{Message: "bridge is in read-only mode, messages are not accepted", StatusCode: code},
+		Code:    maintenanceCode,
+		Reason:  state.Reason,
+		Since:   state.Since,
+	})
+}
+
+// ReadOnlyHandler returns the read-only mode state, a POST with enabled=true|false and an optional reason changes it.
+func (h *handler) ReadOnlyHandler(c echo.Context) error {
+	if c.Request().Method == http.MethodPost {
+		enabled, err := strconv.ParseBool(c.QueryParam("enabled"))
+		if err != nil {
+			return c.JSON(HttpResError("param \"enabled\" should be bool", http.StatusBadRequest))
+		}
+		h.readOnly.Set(enabled, c.QueryParam("reason"), time.Now())
+	}
+	return c.JSON(http.StatusOK, h.readOnly.State())
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	setReadOnly := func(query string) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/read-only?"+query, nil)
+		rec := httptest.NewRecorder()
+		if err := h.ReadOnlyHandler(e.NewContext(req, rec)); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%v: %v %v", query, rec.Code, err)
+		}
+	}
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/bridge/message?client_id=dapp&to=wallet&ttl=60", strings.NewReader("hello"))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	setReadOnly("enabled=true&reason=storage+failover")
+	rec := send()
+	var res maintenanceRes
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || res.Code != maintenanceCode || res.Reason != "storage failover" || res.Since == 0 {
+		t.Fatalf("want a maintenance error, got %v %v", rec.Code, rec.Body.String())
+	}
+
+	setReadOnly("enabled=false")
+	if rec := send(); rec.Code != http.StatusOK {
+		t.Fatalf("want 200 after read-only mode is disabled, got %v", rec.Code)
+	}
+}
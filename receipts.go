@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+var deliveryReceiptsMetric = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "number_of_delivery_receipts",
+	Help: "The total number of delivery receipts sent back to senders that asked for them with delivery_receipt=true",
+})
+
+type pendingReceipt struct {
+	from     string
+	ttl      int64
+	expireAt time.Time
+}
+
+// deliveryReceipts remembers the messages whose senders asked for a receipt
+// until they are written to a stream of this instance or expire.
+type deliveryReceipts struct {
+	mu      sync.Mutex
+	pending map[consumedKey]pendingReceipt
+}
+
+func newDeliveryReceipts() *deliveryReceipts {
+	r := &deliveryReceipts{pending: map[consumedKey]pendingReceipt{}}
+	return r
+}
+
+// Want asks for a receipt to from once the message eventId is written to a stream of to.
+// The receipt is kept as long as the message, ttl seconds.
+func (r *deliveryReceipts) Want(to string, eventId int64, from string, ttl int64, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[consumedKey{to, eventId}] = pendingReceipt{from: from, ttl: ttl, expireAt: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// Take returns the receipt wanted for the message and forgets it, so a message written
+// to several streams is acknowledged once.
+func (r *deliveryReceipts) Take(to string, eventId int64) (pendingReceipt, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := consumedKey{to, eventId}
+	p, ok := r.pending[key]
+	delete(r.pending, key)
+	return p, ok
+}
+
+// watcher forgets the receipts of messages that expired undelivered.
+func (r *deliveryReceipts) watcher(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Minute):
+		}
+		now := time.Now()
+		r.mu.Lock()
+		for key, p := range r.pending {
+			if now.After(p.expireAt) {
+				delete(r.pending, key)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// sendReceipt sends the sender of msg a message from its recipient telling msg was written to a stream.
+// It is called outside of the stream goroutine, the receipt may go to a stream of the same session.
+func (h *handler) sendReceipt(msg datatype.SseMessage, p pendingReceipt, now time.Time) {
+	mes, err := json.Marshal(datatype.BridgeMessage{
+		From:    msg.To,
+		Receipt: &datatype.DeliveryReceipt{EventId: msg.EventId, DeliveredAt: now.UnixMilli()},
+	})
+	if err != nil {
+		log.Errorf("delivery receipt: %v", err)
+		return
+	}
+	receipt := datatype.SseMessage{EventId: h.nextID(), Message: mes, To: p.from}
+	if _, err := h.dispatch(context.Background(), p.from, p.ttl, newTraceId(), receipt); err != nil {
+		log.Errorf("delivery receipt for %v: %v", msg.EventId, err)
+		return
+	}
+	deliveryReceiptsMetric.Inc()
+}
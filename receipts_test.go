@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestDeliveryReceipt(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	res, err := http.Post(fmt.Sprintf("%v/bridge/message?client_id=dapp&to=wallet&ttl=60&delivery_receipt=true", srv.URL), "text/plain", strings.NewReader("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent SendMessageRes
+	json.NewDecoder(res.Body).Decode(&sent)
+	res.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	wallet, err := subscribe(ctx, srv.URL, "wallet", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for e := range readEvents(wallet) {
+		if e.name == "message" {
+			break
+		}
+	}
+	dapp, err := subscribe(ctx, srv.URL, "dapp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for e := range readEvents(dapp) {
+		if e.name != "message" {
+			continue
+		}
+		var msg datatype.BridgeMessage
+		if err := json.Unmarshal([]byte(e.data), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.From != "wallet" || msg.Receipt == nil || msg.Receipt.EventId != sent.EventId {
+			t.Fatalf("unexpected receipt %q for event %v", e.data, sent.EventId)
+		}
+		if _, ok := h.receipts.Take("wallet", sent.EventId); ok {
+			t.Fatal("want the receipt sent once")
+		}
+		return
+	}
+	t.Fatal("no receipt")
+}
+
+func TestDeliveryReceipt_QueueFull(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	// no workers and no room in the queue, every receipt is dropped
+	h.receiptPool.Close()
+	h.receiptPool = newWorkerPool("receipt", 0, 0, dropWhenFull)
+	before := counterValue(sideEffectDroppedMetric.WithLabelValues("receipt"))
+
+	msg := datatype.SseMessage{EventId: h.nextID(), Message: []byte("request"), To: "wallet"}
+	h.receipts.Want("wallet", msg.EventId, "dapp", 60, time.Now())
+	session := NewSession(h.storage, []string{"wallet"}, 0)
+	rec := httptest.NewRecorder()
+	if err := h.deliver(context.Background(), echo.NewResponse(rec, echo.New()), nil, session, "wallet", []datatype.SseMessage{msg}); err != nil {
+		t.Fatal(err)
+	}
+	if got := counterValue(sideEffectDroppedMetric.WithLabelValues("receipt")) - before; got != 1 {
+		t.Fatalf("want 1 dropped receipt, got %v", got)
+	}
+}
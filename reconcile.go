@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+var metricDriftMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "number_of_metric_drifts",
+	Help: "The total number of times a gauge differed from the actual handler state and was reset",
+}, []string{"metric"})
+
+// metricsReconciler periodically recounts sessions and subscriptions from the handler maps
+// and resets the gauges that drifted from the truth.
+// The gauges and the maps are updated at different points of a session's lifecycle,
+// e.g. a replaced session leaves the maps while its handler is still running,
+// so a gauge is only reset when the same difference is seen on two passes in a row.
+func (h *handler) metricsReconciler(interval time.Duration) {
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		h.reconcileMetrics()
+	}
+}
+
+func (h *handler) reconcileMetrics() {
+	log := log.WithField("prefix", "reconcileMetrics")
+	sessions := map[*Session]struct{}{}
+	subscriptions := 0
+	h.Mux.RLock()
+	for _, s := range h.Connections {
+		s.mux.RLock()
+		for _, ses := range s.Sessions {
+			sessions[ses] = struct{}{}
+		}
+		subscriptions += len(s.Sessions)
+		s.mux.RUnlock()
+	}
+	h.Mux.RUnlock()
+
+	if h.drifts == nil {
+		h.drifts = map[string]float64{}
+	}
+	for name, m := range map[string]struct {
+		gauge prometheus.Gauge
+		value float64
+	}{
+		"active_connections":   {activeConnectionMetric, float64(len(sessions))},
+		"active_subscriptions": {activeSubscriptionsMetric, float64(subscriptions)},
+	} {
+		var current dto.Metric
+		if err := m.gauge.Write(&current); err != nil {
+			log.Errorf("read %v: %v", name, err)
+			continue
+		}
+		diff := current.GetGauge().GetValue() - m.value
+		previous := h.drifts[name]
+		h.drifts[name] = diff
+		if diff != 0 && diff == previous {
+			delete(h.drifts, name)
+			log.Warnf("%v drifted: gauge %v, actual %v", name, current.GetGauge().GetValue(), m.value)
+			metricDriftMetric.WithLabelValues(name).Inc()
+			m.gauge.Set(m.value)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestReconcileMetrics(t *testing.T) {
+	defer func(connections, subscriptions float64) {
+		activeConnectionMetric.Set(connections)
+		activeSubscriptionsMetric.Set(subscriptions)
+	}(gaugeValue(activeConnectionMetric), gaugeValue(activeSubscriptionsMetric))
+
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	multi := NewSession(storage, []string{"a", "b"}, 0)
+	single := NewSession(storage, []string{"c"}, 0)
+	h.Connections["a"] = &stream{Sessions: []*Session{multi}}
+	h.Connections["b"] = &stream{Sessions: []*Session{multi}}
+	h.Connections["c"] = &stream{Sessions: []*Session{single}}
+
+	activeConnectionMetric.Set(10)
+	activeSubscriptionsMetric.Set(3)
+	connectionsDrift := counterValue(metricDriftMetric.WithLabelValues("active_connections"))
+	subscriptionsDrift := counterValue(metricDriftMetric.WithLabelValues("active_subscriptions"))
+
+	h.reconcileMetrics()
+	if got := gaugeValue(activeConnectionMetric); got != 10 {
+		t.Fatalf("active connections reset after one pass, got %v", got)
+	}
+	if got := counterValue(metricDriftMetric.WithLabelValues("active_connections")) - connectionsDrift; got != 0 {
+		t.Fatalf("drift reported after one pass, got %v drifts", got)
+	}
+
+	h.reconcileMetrics()
+	if got := gaugeValue(activeConnectionMetric); got != 2 {
+		t.Fatalf("active connections = %v, want 2", got)
+	}
+	if got := gaugeValue(activeSubscriptionsMetric); got != 3 {
+		t.Fatalf("active subscriptions = %v, want 3", got)
+	}
+	if got := counterValue(metricDriftMetric.WithLabelValues("active_connections")) - connectionsDrift; got != 1 {
+		t.Fatalf("connections drifts = %v, want 1", got)
+	}
+	if got := counterValue(metricDriftMetric.WithLabelValues("active_subscriptions")) - subscriptionsDrift; got != 0 {
+		t.Fatalf("subscriptions didn't drift, got %v drifts", got)
+	}
+
+	h.reconcileMetrics()
+	if got := counterValue(metricDriftMetric.WithLabelValues("active_connections")) - connectionsDrift; got != 1 {
+		t.Fatalf("reconciled gauge drifted again, got %v drifts", got)
+	}
+}
+
+func TestReconcileMetrics_TransientDifference(t *testing.T) {
+	defer func(connections, subscriptions float64) {
+		activeConnectionMetric.Set(connections)
+		activeSubscriptionsMetric.Set(subscriptions)
+	}(gaugeValue(activeConnectionMetric), gaugeValue(activeSubscriptionsMetric))
+
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	next := NewSession(storage, []string{"a"}, 0)
+	activeConnectionMetric.Set(1)
+	activeSubscriptionsMetric.Set(0)
+	drifts := counterValue(metricDriftMetric.WithLabelValues("active_connections"))
+
+	// a replaced session has left the maps, but its handler is still running
+	h.reconcileMetrics()
+	// its handler returns and a new session connects before the next pass
+	activeConnectionMetric.Dec()
+	h.Connections["a"] = &stream{Sessions: []*Session{next}}
+	activeConnectionMetric.Inc()
+	activeSubscriptionsMetric.Inc()
+	h.reconcileMetrics()
+
+	if got := gaugeValue(activeConnectionMetric); got != 1 {
+		t.Fatalf("active connections = %v, want 1", got)
+	}
+	if got := counterValue(metricDriftMetric.WithLabelValues("active_connections")) - drifts; got != 0 {
+		t.Fatalf("transient difference reported as %v drifts", got)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+var (
+	relayedMessagesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_relayed_messages",
+		Help: "The total number of messages passed to or received from other bridge instances",
+	}, []string{"direction"})
+	relayFailuresMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_relay_failures",
+		Help: "The total number of messages that couldn't be passed to other bridge instances",
+	})
+	relayGapsMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_relay_gaps",
+		Help: "The total number of relay gaps announced by other instances after they failed to publish messages",
+	})
+	droppedRelayedMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_dropped_relayed_messages",
+		Help: "The total number of relayed messages not queued to a session because its queue was full or it was closed",
+	})
+)
+
+// messageRelay is implemented by storages shared by several bridge instances
+// that can pass live messages between them.
+type messageRelay interface {
+	// Publish passes mes to the other instances sharing the storage.
+	Publish(ctx context.Context, mes datatype.SseMessage) error
+	// Subscribe calls deliver for every message published by the other instances until ctx is done.
+	// deliver may be called from several goroutines. A message without a receiver announces a gap, see publish.
+	Subscribe(ctx context.Context, deliver func(datatype.SseMessage)) error
+}
+
+// publish passes sseMessage to the other instances, so it reaches sessions connected to them.
+// The other instances can't tell they missed a message this instance failed to publish,
+// so the first successful publish after a failure announces the gap, see relayGap.
+func (h *handler) publish(ctx context.Context, sseMessage datatype.SseMessage) {
+	if h.relay == nil {
+		return
+	}
+	if gap := atomic.LoadInt64(&h.relayGap); gap != 0 {
+		if err := h.relay.Publish(ctx, datatype.SseMessage{EventId: gap}); err == nil {
+			atomic.CompareAndSwapInt64(&h.relayGap, gap, 0)
+		}
+	}
+	if err := h.relay.Publish(ctx, sseMessage); err != nil {
+		relayFailuresMetric.Inc()
+		h.health.Failure("relay", err)
+		h.markRelayGap(sseMessage.EventId)
+		log.WithField("prefix", "publish").Errorf("relay message %v: %v", sseMessage.EventId, err)
+		return
+	}
+	relayedMessagesMetric.WithLabelValues("sent").Inc()
+	h.relaySuccess()
+}
+
+// markRelayGap remembers eventId as the newest message the other instances may have missed.
+func (h *handler) markRelayGap(eventId int64) {
+	for {
+		gap := atomic.LoadInt64(&h.relayGap)
+		if gap >= eventId || atomic.CompareAndSwapInt64(&h.relayGap, gap, eventId) {
+			return
+		}
+	}
+}
+
+// relayHealthy reports whether this instance sees the messages of the other instances, i.e. the relay is enabled,
+// its subscription is running and the last relay call succeeded.
+func (h *handler) relayHealthy() bool {
+	return h.relay != nil && atomic.LoadInt32(&h.relayStopped) == 0 && h.health.Healthy("relay")
+}
+
+// relaySuccess marks the relay healthy. Messages of other instances may have been lost while it wasn't,
+// so resumes from before that take the slow path.
+func (h *handler) relaySuccess() {
+	if atomic.LoadInt32(&h.relayStopped) != 0 {
+		return
+	}
+	if !h.health.Healthy("relay") && h.recent != nil {
+		h.recent.Invalidate(atomic.LoadInt64(&h._eventIDs))
+	}
+	h.health.Success("relay")
+}
+
+// relayWorker hands messages sent through the other instances to the sessions connected to this one.
+func (h *handler) relayWorker() {
+	err := h.relay.Subscribe(h.ctx, func(mes datatype.SseMessage) {
+		if mes.To == "" {
+			// another instance failed to publish the messages up to mes, resumes from before it replay from storage
+			relayGapsMetric.Inc()
+			if h.recent != nil {
+				h.recent.Invalidate(mes.EventId)
+			}
+			return
+		}
+		relayedMessagesMetric.WithLabelValues("received").Inc()
+		h.relaySuccess()
+		if h.recent != nil {
+			// the ttl isn't relayed, resumes after this message replay it from storage
+			h.recent.Missed(mes.To, mes.EventId)
+		}
+		h.relayFanOut(mes)
+	})
+	if h.ctx.Err() != nil {
+		return
+	}
+	atomic.StoreInt32(&h.relayStopped, 1)
+	h.health.Failure("relay", fmt.Errorf("subscription stopped: %v", err))
+	log.WithField("prefix", "relayWorker").Errorf("relay subscription stopped: %v", err)
+}
+
+// relayFanOut queues a relayed message to the sessions of its receiver without waiting for them,
+// one slow session must not hold up the messages of every other client. A session with a full queue
+// misses the message and is closed, see Session.Overflow.
+func (h *handler) relayFanOut(mes datatype.SseMessage) {
+	h.Mux.RLock()
+	s, ok := h.Connections[mes.To]
+	h.Mux.RUnlock()
+	if !ok {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, ses := range s.Sessions {
+		if !ses.TryAddMessageToQueue(mes) {
+			droppedRelayedMessagesMetric.Inc()
+			ses.Overflow()
+		}
+	}
+}
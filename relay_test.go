@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+// relayHub passes messages published by one of its relays to the subscribers of the others.
+type relayHub struct {
+	mu          sync.Mutex
+	subscribers map[*hubRelay]func(datatype.SseMessage)
+}
+
+type hubRelay struct {
+	hub *relayHub
+}
+
+func (r *hubRelay) Publish(ctx context.Context, mes datatype.SseMessage) error {
+	r.hub.mu.Lock()
+	defer r.hub.mu.Unlock()
+	for relay, deliver := range r.hub.subscribers {
+		if relay != r {
+			deliver(mes)
+		}
+	}
+	return nil
+}
+
+func (r *hubRelay) Subscribe(ctx context.Context, deliver func(datatype.SseMessage)) error {
+	r.hub.mu.Lock()
+	r.hub.subscribers[r] = deliver
+	r.hub.mu.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCrossInstanceFanOut(t *testing.T) {
+	hub := &relayHub{subscribers: map[*hubRelay]func(datatype.SseMessage){}}
+	var urls []string
+	for i := 0; i < 2; i++ {
+		// every instance has its own storage, so the message can only come through the relay
+		h := newHandler(memory.NewStorage(), time.Minute)
+		defer h.Close()
+		h.relay = &hubRelay{hub: hub}
+		go h.relayWorker()
+		e := echo.New()
+		registerHandlers(e, h)
+		srv := httptest.NewServer(e)
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := subscribe(ctx, urls[1], "wallet", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := readEvents(res)
+	for {
+		hub.mu.Lock()
+		subscribed := len(hub.subscribers) == 2
+		hub.mu.Unlock()
+		if subscribed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	send(t, urls[0], "dapp", "wallet", "relayed")
+	for e := range events {
+		if e.name == "message" {
+			if e.data != `{"from":"dapp","message":"relayed"}` {
+				t.Fatalf("unexpected message %q", e.data)
+			}
+			return
+		}
+	}
+	t.Fatal("message sent through another instance is not delivered")
+}
+
+func TestDispatch_SyntheticNotRelayed(t *testing.T) {
+	hub := &relayHub{subscribers: map[*hubRelay]func(datatype.SseMessage){}}
+	var (
+		mu      sync.Mutex
+		relayed []int64
+	)
+	hub.subscribers[&hubRelay{hub: hub}] = func(mes datatype.SseMessage) {
+		mu.Lock()
+		relayed = append(relayed, mes.EventId)
+		mu.Unlock()
+	}
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	h.relay = &hubRelay{hub: hub}
+
+	ctx := context.Background()
+	if _, err := h.dispatch(withSynthetic(ctx), "wallet", 60, "trace", datatype.SseMessage{EventId: 1, To: "wallet"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.dispatch(ctx, "wallet", 60, "trace", datatype.SseMessage{EventId: 2, To: "wallet"}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(relayed, []int64{2}) {
+		t.Fatalf("relayed %v, want only the regular message", relayed)
+	}
+}
+
+// stoppedRelay publishes fine, but its subscription fails, so messages of other instances are never received.
+type stoppedRelay struct{}
+
+func (stoppedRelay) Publish(ctx context.Context, mes datatype.SseMessage) error {
+	return nil
+}
+
+func (stoppedRelay) Subscribe(ctx context.Context, deliver func(datatype.SseMessage)) error {
+	return errors.New("connection lost")
+}
+
+func TestStickyResumeAcrossReplicas(t *testing.T) {
+	for name, relay := range map[string]func(hub *relayHub) messageRelay{
+		"no relay":      func(hub *relayHub) messageRelay { return nil },
+		"stopped relay": func(hub *relayHub) messageRelay { return stoppedRelay{} },
+		"running relay": func(hub *relayHub) messageRelay { return &hubRelay{hub: hub} },
+	} {
+		relay := relay
+		t.Run(name, func(t *testing.T) {
+			hub := &relayHub{subscribers: map[*hubRelay]func(datatype.SseMessage){}}
+			storage := memory.NewStorage()
+			var urls []string
+			for i := 0; i < 2; i++ {
+				h := newHandler(storage, time.Minute)
+				defer h.Close()
+				h.recent = newRecentMessages(10, h._eventIDs)
+				if h.relay = relay(hub); h.relay != nil {
+					go h.relayWorker()
+				}
+				e := echo.New()
+				registerHandlers(e, h)
+				srv := httptest.NewServer(e)
+				defer srv.Close()
+				urls = append(urls, srv.URL)
+			}
+
+			for _, ok := relay(hub).(*hubRelay); ok; {
+				hub.mu.Lock()
+				ok = len(hub.subscribers) < 2
+				hub.mu.Unlock()
+				time.Sleep(time.Millisecond)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			send(t, urls[0], "dapp", "wallet", "first")
+			waitStored(t, storage, "wallet", 1)
+			res, err := subscribe(ctx, urls[0], "wallet", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			first := <-readEvents(res)
+			res.Body.Close()
+			if first.data != `{"from":"dapp","message":"first"}` {
+				t.Fatalf("unexpected message %q", first.data)
+			}
+
+			// stored by the other replica, the resume on the first one must replay it
+			send(t, urls[1], "dapp", "wallet", "second")
+			waitStored(t, storage, "wallet", 2)
+			res, err = subscribe(ctx, urls[0], "wallet", first.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if e := <-readEvents(res); e.data != `{"from":"dapp","message":"second"}` {
+				t.Fatalf("message stored by another replica is not replayed, got %q", e.data)
+			}
+		})
+	}
+}
+
+// failingRelay fails the next failures publishes and passes the rest to the hub.
+type failingRelay struct {
+	*hubRelay
+	failures int
+}
+
+func (r *failingRelay) Publish(ctx context.Context, mes datatype.SseMessage) error {
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("connection lost")
+	}
+	return r.hubRelay.Publish(ctx, mes)
+}
+
+func TestRelayGap(t *testing.T) {
+	hub := &relayHub{subscribers: map[*hubRelay]func(datatype.SseMessage){}}
+	receiver := newHandler(memory.NewStorage(), time.Minute)
+	defer receiver.Close()
+	receiver.recent = newRecentMessages(10, receiver._eventIDs)
+	receiver.relay = &hubRelay{hub: hub}
+	go receiver.relayWorker()
+	sender := newHandler(memory.NewStorage(), time.Minute)
+	defer sender.Close()
+	sender.relay = &failingRelay{hubRelay: &hubRelay{hub: hub}, failures: 1}
+	for {
+		hub.mu.Lock()
+		subscribed := len(hub.subscribers) == 1
+		hub.mu.Unlock()
+		if subscribed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	receiver.health.Success("relay")
+	ctx := context.Background()
+	last := receiver.nextID()
+	receiver.recent.Add(ctx, "wallet", 60, datatype.SseMessage{EventId: last, To: "wallet"})
+	gaps := counterValue(relayGapsMetric)
+
+	sender.publish(ctx, datatype.SseMessage{EventId: last + 10, To: "wallet"})
+	// the receiver can't know about the lost message until the sender publishes again
+	if got := receiver.resumeStorage([]string{"wallet"}, last, receiver.recent.epoch); got != receiver.recent {
+		t.Fatal("resume takes the slow path before the gap is announced")
+	}
+	sender.publish(ctx, datatype.SseMessage{EventId: last + 20, To: "other"})
+	if got := counterValue(relayGapsMetric) - gaps; got != 1 {
+		t.Fatalf("gaps = %v, want 1", got)
+	}
+	if got := receiver.resumeStorage([]string{"wallet"}, last, receiver.recent.epoch); got != receiver.storage {
+		t.Fatal("resume from before the gap isn't replayed from storage")
+	}
+	if gap := atomic.LoadInt64(&sender.relayGap); gap != 0 {
+		t.Fatalf("announced gap %v is kept", gap)
+	}
+}
+
+func TestRelayFanOut_FullQueue(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	slow := h.CreateSession("slow", []string{"wallet"}, 0)
+	other := h.CreateSession("other", []string{"wallet"}, 0)
+	for i := 0; i < cap(slow.MessageCh); i++ {
+		slow.MessageCh <- datatype.SseMessage{EventId: int64(i + 1), To: "wallet"}
+	}
+	before := counterValue(droppedRelayedMessagesMetric)
+
+	done := make(chan struct{})
+	go func() {
+		h.relayFanOut(datatype.SseMessage{EventId: h.nextID(), Message: []byte("relayed"), To: "wallet"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("relayed message waits for a session with a full queue")
+	}
+	if got := counterValue(droppedRelayedMessagesMetric) - before; got != 1 {
+		t.Fatalf("want 1 dropped message, got %v", got)
+	}
+	if len(other.MessageCh) != 1 {
+		t.Fatal("relayed message is not queued to the other session")
+	}
+	if !slow.Overflowed() || other.Overflowed() {
+		t.Fatal("only the session with a full queue must overflow")
+	}
+}
+
+// blockingDeliverHook holds up deliveries until release is closed, entered receives every held up delivery.
+type blockingDeliverHook struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (blockingDeliverHook) OnSend(ctx context.Context, msg *datatype.BridgeMessage) error {
+	return nil
+}
+
+func (h blockingDeliverHook) OnDeliver(ctx context.Context, msg *datatype.SseMessage) error {
+	select {
+	case h.entered <- struct{}{}:
+	default:
+	}
+	<-h.release
+	return nil
+}
+
+func TestRelayFanOut_OverflowLosesNothing(t *testing.T) {
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	h.hooks = &messageHooks{hooks: []namedHook{{name: "blocking", hook: blockingDeliverHook{entered: entered, release: release}}}, timeout: 10 * time.Second}
+	e := echo.New()
+	registerHandlers(e, h)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res, err := subscribe(ctx, srv.URL, "wallet", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := readEvents(res)
+	h.Mux.RLock()
+	session := h.Connections["wallet"].Sessions[0]
+	h.Mux.RUnlock()
+	<-session.replayed
+
+	// messages relayed from another instance are in the shared storage already
+	var want []string
+	relay := func() {
+		mes := datatype.SseMessage{EventId: h.nextID(), Message: []byte("relayed"), To: "wallet"}
+		storage.Add(context.Background(), "wallet", 60, mes)
+		want = append(want, strconv.FormatInt(mes.EventId, 10))
+		h.relayFanOut(mes)
+	}
+	relay()
+	// the first message is taken by the stream and held up by the hook, the next ones fill the queue
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first message is not delivered")
+	}
+	for i := 0; i < cap(session.MessageCh)+2; i++ {
+		relay()
+	}
+	if !session.Overflowed() {
+		t.Fatal("session with a full queue must overflow")
+	}
+	close(release)
+
+	var got []string
+	read := func(events <-chan sseEvent) string {
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return ""
+				}
+				if event.name == "close" {
+					return event.data
+				}
+				got = append(got, event.id)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("stream stalled after %v", got)
+			}
+		}
+	}
+	if reason := read(events); reason != `{"reason":"queue_overflow"}` || len(got) == 0 {
+		t.Fatalf("want messages and the queue_overflow close event, got %v and %q", got, reason)
+	}
+	res, err = subscribe(ctx, srv.URL, "wallet", got[len(got)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = readEvents(res)
+	for len(got) < len(want) {
+		select {
+		case event := <-events:
+			got = append(got, event.id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("messages are lost: want %v, got %v", want, got)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+var abuseReportsMetric = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "number_of_abuse_reports",
+	Help: "The total number of messages reported as suspicious by their receivers",
+})
+
+// ReportHandler lets a wallet report a suspicious message it received, e.g. a phishing request.
+// The message must still be stored for the reporting client_id, so only its receiver can report it.
+// Reports are counted per sender in the connection stats, next to the Origin the sender connects from.
+func (h *handler) ReportHandler(c echo.Context) error {
+	log := log.WithField("prefix", "ReportHandler")
+	params := c.QueryParams()
+	clientId := params.Get("client_id")
+	if clientId == "" {
+		badRequestMetric.Inc()
+		errorMsg := "param \"client_id\" not present"
+		log.Error(errorMsg)
+		return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
+	}
+	eventId, _, err := parseEventId(params.Get("event_id"))
+	if err != nil {
+		badRequestMetric.Inc()
+		errorMsg := "param \"event_id\" should be int"
+		log.Error(errorMsg)
+		return c.JSON(HttpResError(errorMsg, http.StatusBadRequest))
+	}
+	messages, err := h.storage.GetMessages(c.Request().Context(), []string{clientId}, eventId-1)
+	if err != nil {
+		log.Errorf("get messages: %v", err)
+		h.health.Failure("storage", err)
+		return c.JSON(HttpResError("failed to read the message", http.StatusInternalServerError))
+	}
+	var from string
+	for _, m := range messages {
+		if m.EventId != eventId {
+			continue
+		}
+		var msg datatype.BridgeMessage
+		if err := json.Unmarshal(m.Message, &msg); err == nil {
+			from = msg.From
+		}
+		break
+	}
+	if from == "" {
+		return c.JSON(HttpResError("message not found, it may have expired or been acknowledged", http.StatusNotFound))
+	}
+	if h.stats.Reported(from, abuseReport{at: time.Now(), reporter: clientId, eventId: eventId}) {
+		abuseReportsMetric.Inc()
+		stats := h.stats.Get(from, time.Now())
+		log.Warnf("message %v from %v (origin %q, %v reports) reported by %v: %q", eventId, logId(from), stats.Origin,
+			stats.Reports, logId(clientId), sanitizeHeader(params.Get("reason")))
+		h.tracer.Record(traceEvent{EventId: eventId, Stage: traceStageReported, ClientId: clientId, Details: sanitizeHeader(params.Get("reason"))})
+	}
+	return c.JSON(http.StatusOK, HttpResOk())
+}
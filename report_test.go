@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestReportHandler(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	e := echo.New()
+	registerHandlers(e, h)
+	report := func(query string) int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/bridge/report?"+query, nil))
+		return rec.Code
+	}
+	h.stats.OriginSeen([]string{"dapp"}, "https://phishing.example", time.Now())
+	mes := datatype.SseMessage{EventId: h.nextID(), Message: []byte(`{"from":"dapp","message":"x"}`), To: "wallet"}
+	if err := h.persist(context.Background(), "wallet", 60, "", mes); err != nil {
+		t.Fatal(err)
+	}
+
+	before := counterValue(abuseReportsMetric)
+	query := fmt.Sprintf("client_id=wallet&event_id=%v&reason=phishing", mes.EventId)
+	for i := 0; i < 2; i++ {
+		if code := report(query); code != http.StatusOK {
+			t.Fatalf("want 200, got %v", code)
+		}
+	}
+	if got := counterValue(abuseReportsMetric) - before; got != 1 {
+		t.Fatalf("a repeated report must be counted once, got %v", got)
+	}
+	if stats := h.stats.Get("dapp", time.Now()); stats.Reports != 1 || stats.Origin != "https://phishing.example" {
+		t.Fatalf("unexpected sender stats: %+v", stats)
+	}
+
+	// only the receiver of a message can report it
+	if code := report(fmt.Sprintf("client_id=other&event_id=%v", mes.EventId)); code != http.StatusNotFound {
+		t.Fatalf("want 404, got %v", code)
+	}
+	for _, query := range []string{"event_id=1", "client_id=wallet&event_id=x"} {
+		if code := report(query); code != http.StatusBadRequest {
+			t.Fatalf("%v: want 400, got %v", query, code)
+		}
+	}
+}
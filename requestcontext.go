@@ -0,0 +1,99 @@
+package main
+
+import (
+	"container/list"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	requestContextKey = "request_context"
+	// originCacheSize is the number of distinct Origin/Referer values whose parsed origin is kept.
+	originCacheSize = 1024
+)
+
+// RequestContext holds the caller attributes handlers and middlewares need,
+// parsed once per request.
+type RequestContext struct {
+	// Origin is the scheme and host of the page the request came from, taken from Origin or Referer.
+	Origin    string
+	IP        string
+	UserAgent string
+}
+
+// requestContext returns the RequestContext of c, parsing the request on the first call.
+func requestContext(c echo.Context) *RequestContext {
+	if rc, ok := c.Get(requestContextKey).(*RequestContext); ok {
+		return rc
+	}
+	req := c.Request()
+	raw := req.Header.Get("Origin")
+	if raw == "" {
+		raw = req.Referer()
+	}
+	rc := &RequestContext{
+		Origin:    origins.Extract(raw),
+		IP:        realIP(req),
+		UserAgent: sanitizeHeader(req.UserAgent()),
+	}
+	c.Set(requestContextKey, rc)
+	return rc
+}
+
+var origins = newOriginCache(originCacheSize)
+
+// originCache is an LRU of raw Origin/Referer header values to extracted origins,
+// there are few distinct dapps so almost every request is a hit.
+type originCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type originEntry struct {
+	raw    string
+	origin string
+}
+
+func newOriginCache(size int) *originCache {
+	return &originCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+// Extract returns the origin of raw, see extractOrigin.
+func (c *originCache) Extract(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[raw]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*originEntry).origin
+	}
+	origin := extractOrigin(raw)
+	c.items[raw] = c.ll.PushFront(&originEntry{raw: raw, origin: origin})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*originEntry).raw)
+	}
+	return origin
+}
+
+// extractOrigin reduces an Origin or Referer value to a lower-cased "scheme://host[:port]".
+// Values that are not urls, like "null", are returned sanitized as is.
+func extractOrigin(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return sanitizeHeader(raw)
+	}
+	return sanitizeHeader(strings.ToLower(u.Scheme + "://" + u.Host))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestExtractOrigin(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{raw: "https://app.example.com", want: "https://app.example.com"},
+		{raw: "HTTPS://App.Example.com:8443/path?q=1", want: "https://app.example.com:8443"},
+		{raw: "null", want: "null"},
+		{raw: "bad\norigin", want: "badorigin"},
+	}
+	for _, tt := range tests {
+		if got := extractOrigin(tt.raw); got != tt.want {
+			t.Errorf("extractOrigin(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestOriginCache_Evicts(t *testing.T) {
+	c := newOriginCache(2)
+	c.Extract("https://a.com/1")
+	c.Extract("https://b.com/1")
+	c.Extract("https://a.com/1")
+	c.Extract("https://c.com/1")
+	if _, ok := c.items["https://b.com/1"]; ok {
+		t.Fatal("least recently used origin is not evicted")
+	}
+	if _, ok := c.items["https://a.com/1"]; !ok {
+		t.Fatal("recently used origin is evicted")
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/bridge/events", nil)
+	req.Header.Set("Referer", "https://dapp.example.com/connect")
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+	req.Header.Set("User-Agent", "wallet/1.0")
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	rc := requestContext(c)
+	if rc.Origin != "https://dapp.example.com" || rc.IP != "1.2.3.4" || rc.UserAgent != "wallet/1.0" {
+		t.Fatalf("unexpected request context %+v", rc)
+	}
+	if requestContext(c) != rc {
+		t.Fatal("request context is parsed twice")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/tonkeeper/bridge/datatype"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// errNotWalletKey is returned when the recipient's client id isn't a public key, e.g. in tests and tools.
+var errNotWalletKey = errors.New("client id is not a 32 byte hex public key")
+
+// encryptRequestSource seals the origin, ip and user agent of the sender's request to clientId,
+// the public key of the recipient's session, so only the wallet can show them to the user to help
+// spot phishing dapps. The bridge can't read them back.
+func encryptRequestSource(rc *RequestContext, clientId string, now time.Time) (string, error) {
+	key, err := hex.DecodeString(clientId)
+	if err != nil || len(key) != 32 {
+		return "", errNotWalletKey
+	}
+	var recipient [32]byte
+	copy(recipient[:], key)
+	source, err := json.Marshal(datatype.BridgeRequestSource{
+		Origin:    rc.Origin,
+		IP:        rc.IP,
+		Time:      now.Unix(),
+		UserAgent: rc.UserAgent,
+	})
+	if err != nil {
+		return "", err
+	}
+	sealed, err := box.SealAnonymous(nil, source, &recipient, rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
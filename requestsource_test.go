@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tonkeeper/bridge/datatype"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestEncryptRequestSource(t *testing.T) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &RequestContext{Origin: "https://dapp.example", IP: "203.0.113.7", UserAgent: "Mozilla/5.0"}
+	now := time.Unix(1682942400, 0)
+	sealed, err := encryptRequestSource(rc, hex.EncodeToString(public[:]), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, ok := box.OpenAnonymous(nil, raw, public, private)
+	if !ok {
+		t.Fatal("the wallet can't open the request source")
+	}
+	var source datatype.BridgeRequestSource
+	if err := json.Unmarshal(opened, &source); err != nil {
+		t.Fatal(err)
+	}
+	want := datatype.BridgeRequestSource{Origin: rc.Origin, IP: rc.IP, Time: now.Unix(), UserAgent: rc.UserAgent}
+	if source != want {
+		t.Fatalf("want %+v, got %+v", want, source)
+	}
+	if _, err := encryptRequestSource(rc, "wallet", now); !errors.Is(err, errNotWalletKey) {
+		t.Fatalf("want errNotWalletKey, got %v", err)
+	}
+}
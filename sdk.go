@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var sdkRequestsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "number_of_requests_by_sdk",
+	Help: "The total number of requests by the client SDK from the X-TonConnect-SDK header",
+}, []string{"sdk", "endpoint"})
+
+const (
+	sdkHeader = "X-TonConnect-SDK"
+	// maxSdkLabels caps the number of distinct sdk label values, the rest is counted as "other".
+	maxSdkLabels   = 200
+	maxSdkLength   = 64
+	sdkUnknown     = "unknown"
+	sdkOther       = "other"
+	sdkAllowedChar = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./@+"
+)
+
+// sdkLabels keeps the sdk label values seen so far to bound the metric cardinality.
+var sdkLabels = struct {
+	sync.Mutex
+	seen map[string]struct{}
+}{seen: map[string]struct{}{}}
+
+// parseSdk normalizes a "name/version" X-TonConnect-SDK header value into a metric label.
+func parseSdk(header string) string {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return sdkUnknown
+	}
+	if len(header) > maxSdkLength {
+		header = header[:maxSdkLength]
+	}
+	for _, r := range header {
+		if !strings.ContainsRune(sdkAllowedChar, r) {
+			return sdkOther
+		}
+	}
+	sdkLabels.Lock()
+	defer sdkLabels.Unlock()
+	if _, ok := sdkLabels.seen[header]; !ok {
+		if len(sdkLabels.seen) >= maxSdkLabels {
+			return sdkOther
+		}
+		sdkLabels.seen[header] = struct{}{}
+	}
+	return header
+}
+
+// countSdk records the sdk of a request to endpoint and returns its label.
+func countSdk(header, endpoint string) string {
+	sdk := parseSdk(header)
+	sdkRequestsMetric.WithLabelValues(sdk, endpoint).Inc()
+	return sdk
+}
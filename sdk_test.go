@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSdk(t *testing.T) {
+	tests := []struct {
+		header, want string
+	}{
+		{header: "", want: sdkUnknown},
+		{header: "@tonconnect/sdk/3.0.0", want: "@tonconnect/sdk/3.0.0"},
+		{header: " tonkeeper/4.1 ", want: "tonkeeper/4.1"},
+		{header: "evil\"} 1\n", want: sdkOther},
+		{header: strings.Repeat("a", 100), want: strings.Repeat("a", maxSdkLength)},
+	}
+	for _, tt := range tests {
+		if got := parseSdk(tt.header); got != tt.want {
+			t.Errorf("parseSdk(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
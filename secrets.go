@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/storage/pg"
+)
+
+// rotatingSecret holds the latest value of a secret re-fetched from a secret manager.
+type rotatingSecret struct {
+	mu    sync.RWMutex
+	value string
+}
+
+func (s *rotatingSecret) Get() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+func (s *rotatingSecret) Set(v string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.value = v
+}
+
+// applySecret is called by config.WatchSecrets with a rotated secret. The webhook secret and the postgres password
+// take effect right away, the password for new connections; the other secrets need a restart.
+func (h *handler) applySecret(dbPassword *rotatingSecret, key, value string) {
+	log := log.WithField("prefix", "applySecret")
+	switch key {
+	case "WEBHOOK_SECRET":
+		h.webhooks.SetSecret([]byte(value))
+	case "POSTGRES_URI":
+		password, err := pg.URIPassword(value)
+		if err != nil {
+			log.Errorf("rotated %v: %v", key, err)
+			return
+		}
+		dbPassword.Set(password)
+	default:
+		log.Warnf("%v changed in the secret manager, restart the bridge to apply it", key)
+		return
+	}
+	log.Infof("%v rotated", key)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tonkeeper/bridge/config"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+type selfTest struct {
+	Name string
+	Run  func(ctx context.Context, storage db) error
+}
+
+type selfTestResult struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Skipped  bool          `json:"skipped,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+var selfTests = []selfTest{
+	{Name: "storage round trip", Run: selfTestStorage},
+	{Name: "message delivery", Run: selfTestDelivery},
+	{Name: "webhook", Run: selfTestWebhook},
+	{Name: "self signed certificate", Run: selfTestCertificate},
+	{Name: "ntp", Run: selfTestNTP},
+	{Name: "analytics", Run: selfTestAnalytics},
+}
+
+// errSelfTestSkipped is wrapped by tests that can't run, the rest of the error tells why.
+var errSelfTestSkipped = errors.New("skipped")
+
+// runSelfTests runs every self test against storage with a timeout per test.
+func runSelfTests(storage db) []selfTestResult {
+	results := make([]selfTestResult, 0, len(selfTests))
+	for _, t := range selfTests {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		start := time.Now()
+		err := t.Run(ctx, storage)
+		cancel()
+		res := selfTestResult{Name: t.Name, Passed: err == nil, Duration: time.Since(start)}
+		if errors.Is(err, errSelfTestSkipped) {
+			res.Passed, res.Skipped = true, true
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// printSelfTestReport writes a human-readable report and returns true if all tests passed.
+func printSelfTestReport(w io.Writer, results []selfTestResult) bool {
+	passed := true
+	for _, r := range results {
+		if r.Skipped {
+			fmt.Fprintf(w, "skip %-25s %v\n", r.Name, r.Error)
+			continue
+		}
+		if r.Passed {
+			fmt.Fprintf(w, "ok   %-25s %v\n", r.Name, r.Duration.Round(time.Millisecond))
+			continue
+		}
+		passed = false
+		fmt.Fprintf(w, "FAIL %-25s %v: %v\n", r.Name, r.Duration.Round(time.Millisecond), r.Error)
+	}
+	return passed
+}
+
+func selfTestStorage(ctx context.Context, storage db) error {
+	key := "selftest-" + newTraceId()
+	mes := datatype.SseMessage{EventId: time.Now().UnixMicro(), Message: []byte("selftest")}
+	if err := storage.Add(ctx, key, 5, mes); err != nil {
+		return fmt.Errorf("add: %w", err)
+	}
+	messages, err := storage.GetMessages(ctx, []string{key}, mes.EventId-1)
+	if err != nil {
+		return fmt.Errorf("get messages: %w", err)
+	}
+	for _, m := range messages {
+		if m.EventId == mes.EventId && string(m.Message) == string(mes.Message) {
+			return nil
+		}
+	}
+	return fmt.Errorf("stored message not found")
+}
+
+// selfTestDelivery sends a message through the http handlers and waits for it on an SSE stream.
+// The message is sent as a conformance check's, so it has no side effects outside of the bridge.
+func selfTestDelivery(ctx context.Context, storage db) error {
+	e := echo.New()
+	h := newHandler(storage, time.Second)
+	defer h.Close()
+	registerHandlers(e, h)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	receiver, sender := "selftest-"+newTraceId(), "selftest-"+newTraceId()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/bridge/events?client_id="+receiver, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("subscribe: %w", err)
+	}
+	defer res.Body.Close()
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost,
+		fmt.Sprintf("%v/bridge/message?client_id=%v&to=%v&ttl=5", srv.URL, sender, receiver), strings.NewReader("selftest"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(conformanceHeader, conformanceToken)
+	sendRes, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	sendRes.Body.Close()
+	if sendRes.StatusCode != http.StatusOK {
+		return fmt.Errorf("send: bad status code %v", sendRes.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "data: ") && strings.Contains(scanner.Text(), sender) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read stream: %w", err)
+	}
+	return fmt.Errorf("stream closed before the message arrived")
+}
+
+func selfTestWebhook(ctx context.Context, storage db) error {
+	received := make(chan string, 1)
+	mock := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mock.Close()
+
+	if err := sendWebhook("selftest", WebhookData{Topic: "selftest", Hash: "selftest"}, mock.URL); err != nil {
+		return err
+	}
+	select {
+	case path := <-received:
+		if path != "/selftest" {
+			return fmt.Errorf("webhook called with unexpected path %v", path)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func selfTestCertificate(ctx context.Context, storage db) error {
+	if !config.Config.SelfSignedTLS {
+		return nil
+	}
+	_, _, err := generateSelfSignedCertificate()
+	return err
+}
+
+func selfTestNTP(ctx context.Context, storage db) error {
+	if config.Config.NTPServer == "" {
+		return fmt.Errorf("%w: NTP_SERVER is empty", errSelfTestSkipped)
+	}
+	_, err := preflightNTP(ctx, storage)
+	return err
+}
+
+// selfTestAnalytics is listed so the report tells the check is missing rather than omitting it.
+func selfTestAnalytics(ctx context.Context, storage db) error {
+	return fmt.Errorf("%w: the bridge doesn't send analytics", errSelfTestSkipped)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tonkeeper/bridge/config"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestRunSelfTests(t *testing.T) {
+	defer func(server string) { config.Config.NTPServer = server }(config.Config.NTPServer)
+	config.Config.NTPServer = ""
+
+	results := runSelfTests(memory.NewStorage())
+	if len(results) != len(selfTests) {
+		t.Fatalf("got %v results, want %v", len(results), len(selfTests))
+	}
+	var report bytes.Buffer
+	if !printSelfTestReport(&report, results) {
+		t.Fatalf("self tests failed:\n%v", report.String())
+	}
+	if strings.Contains(report.String(), "FAIL") {
+		t.Fatalf("unexpected report:\n%v", report.String())
+	}
+	for _, name := range []string{"ntp", "analytics"} {
+		if !strings.Contains(report.String(), "skip "+name) {
+			t.Fatalf("%v isn't reported as skipped:\n%v", name, report.String())
+		}
+	}
+}
+
+func TestSelfTestDelivery_Synthetic(t *testing.T) {
+	defer func(url string) { config.Config.CopyToURL = url }(config.Config.CopyToURL)
+	copied := make(chan struct{}, 1)
+	mock := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		copied <- struct{}{}
+	}))
+	defer mock.Close()
+	config.Config.CopyToURL = mock.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := selfTestDelivery(ctx, memory.NewStorage()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-copied:
+		t.Fatal("self test message was copied to COPY_TO_URL")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRunSelfTests_FailingStorage(t *testing.T) {
+	defer func(server string) { config.Config.NTPServer = server }(config.Config.NTPServer)
+	config.Config.NTPServer = ""
+
+	results := runSelfTests(failingStorage{db: memory.NewStorage()})
+	var storage selfTestResult
+	for _, r := range results {
+		if r.Name == "storage round trip" {
+			storage = r
+		}
+	}
+	if storage.Passed || !strings.Contains(storage.Error, "add:") {
+		t.Fatalf("storage round trip must fail: %+v", storage)
+	}
+	var report bytes.Buffer
+	if printSelfTestReport(&report, results) {
+		t.Fatal("report must fail when a self test fails")
+	}
+	if !strings.Contains(report.String(), "FAIL storage round trip") {
+		t.Fatalf("failed test is missing in the report:\n%v", report.String())
+	}
+}
@@ -2,12 +2,71 @@ package main
 
 import (
 	"context"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/config"
 	"github.com/tonkeeper/bridge/datatype"
 )
 
+var (
+	droppedSessionMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_messages_dropped_on_closed_session",
+		Help: "The total number of messages not written to a stream because it was closed, they are left for replay",
+	})
+	replayMessagesMetric = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "replay_messages",
+		Help:    "The number of messages read from storage for a new connection",
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+	})
+	replayBytesMetric = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "replay_bytes",
+		Help:    "The size of messages read from storage for a new connection",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 9),
+	})
+	replayPagesMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_replay_pages",
+		Help: "The total number of history pages read from storage for new connections, see REPLAY_PAGE_SIZE",
+	})
+	replayDurationMetric = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "replay_duration_seconds",
+		Help:    "How long reading the history from storage and queueing it for a new connection takes",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	})
+)
+
+// Orders of the storage replay, see REPLAY_ORDER.
+const (
+	replayOldestFirst = "oldest_first"
+	replayNewestFirst = "newest_first"
+)
+
+// sortReplay puts the replayed messages in order, storages return them in the order that suits their layout:
+// the memory storage in insertion order per client id, postgres in no particular order.
+func sortReplay(queue []datatype.SseMessage, order string) {
+	if order == replayNewestFirst {
+		sort.SliceStable(queue, func(i, j int) bool { return queue[i].EventId > queue[j].EventId })
+		return
+	}
+	sort.SliceStable(queue, func(i, j int) bool { return queue[i].EventId < queue[j].EventId })
+}
+
+// pagedStorage is implemented by storages that can read the history in pages ordered by event id.
+// The worker reads it page by page, so a client offline for long doesn't make a single huge query.
+type pagedStorage interface {
+	// GetMessagesPage returns up to limit messages after lastEventId and the event id to continue from, 0 after the last page.
+	GetMessagesPage(ctx context.Context, keys []string, lastEventId int64, limit int) ([]datatype.SseMessage, int64, error)
+}
+
+// sessionQueueSize is the number of messages buffered for a connection that doesn't keep up.
+const sessionQueueSize = 10
+
 type Session struct {
 	mux         sync.RWMutex
 	ClientIds   []string
@@ -15,47 +74,346 @@ type Session struct {
 	storage     db
 	Closer      chan interface{}
 	lastEventId int64
+	// heartbeatTs is the timestamp (unix microseconds) carried by the last heartbeat sent to the client.
+	heartbeatTs    int64
+	heartbeatAcked int32
+	rtt            int64
+	StartedAt      time.Time
+	// kick receives the reason code when the bridge decides to close the stream itself.
+	kick chan string
+	// overflowed is set once a message couldn't be queued, accessed atomically, see Overflow.
+	overflowed int32
+	// onReplayed is called after the history from storage has been queued.
+	onReplayed func(*Session)
+	// replayed is closed once the history from storage has been queued, replayedUpTo is the last id in it.
+	replayed     chan struct{}
+	replayedUpTo int64
+	// successor is the session that replaced this one, it receives the messages left in MessageCh.
+	successor *Session
+	// forwarded are the ids of live messages queued while the sessions this one replaces were still subscribed,
+	// their queues may hold the same messages, see HandOver. Ids are recorded until forwardedDone is set.
+	forwarded     map[int64]bool
+	forwardedDone bool
+	closeOnce     sync.Once
+	// closeReason is why the stream ended, see SetCloseReason.
+	closeReason string
+	// strict selects canonical SSE framing, see sseModeStrict.
+	strict bool
+	// queueDone makes the worker queue queueDoneMessage after the history, see enable_queue_done_event.
+	queueDone bool
 }
 
+// queueDoneEventId marks queueDoneMessage, real event ids are never negative.
+const queueDoneEventId = -1
+
+// queueDoneMessage goes through MessageCh after the replayed history, so the "queue_done" event
+// is written right after the last replayed message even when live messages are queued in between.
+var queueDoneMessage = datatype.SseMessage{EventId: queueDoneEventId}
+
+// Reason codes sent in the data of the final "close" event.
+const (
+	// closeReasonShutdown means the bridge instance is stopping; clients should reconnect right away.
+	closeReasonShutdown = "shutdown"
+	// closeReasonInternalError means the session failed on the bridge side; clients should reconnect with backoff.
+	closeReasonInternalError = "internal_error"
+	// closeReasonReplaced means a newer session for the same client ids took over; clients should not reconnect.
+	closeReasonReplaced = "replaced"
+	// closeReasonQueueOverflow means the session missed a message because its queue was full;
+	// clients should reconnect right away with Last-Event-ID to get it from storage.
+	closeReasonQueueOverflow = "queue_overflow"
+)
+
+// Reasons a stream may end for besides the ones above, they are only used in metrics and stats.
+const (
+	// closeReasonClientDisconnect means the client closed the connection.
+	closeReasonClientDisconnect = "client_disconnect"
+	// closeReasonWriteError means writing a message or a heartbeat to the connection failed.
+	closeReasonWriteError = "write_error"
+	// closeReasonWriteTimeout means writing an event took longer than SSE_WRITE_TIMEOUT_MS.
+	closeReasonWriteTimeout = "write_timeout"
+)
+
 func NewSession(s db, clientIds []string, lastEventId int64) *Session {
 	session := Session{
 		mux:         sync.RWMutex{},
 		ClientIds:   clientIds,
 		storage:     s,
-		MessageCh:   make(chan datatype.SseMessage, 10),
+		MessageCh:   make(chan datatype.SseMessage, sessionQueueSize),
 		Closer:      make(chan interface{}),
 		lastEventId: lastEventId,
+		StartedAt:   time.Now(),
+		kick:        make(chan string, 1),
+		replayed:    make(chan struct{}),
+		forwarded:   map[int64]bool{},
 	}
 	return &session
 }
 
 func (s *Session) worker() {
 	log := log.WithField("prefix", "Session.worker")
-	queue, err := s.storage.GetMessages(context.TODO(), s.ClientIds, s.lastEventId)
-	if err != nil {
-		log.Info("get queue error: ", err)
+	defer func() {
+		if r := recover(); r != nil {
+			sessionPanicsMetric.Inc()
+			log.Errorf("session %v panicked: %v\n%s", logIds(s.ClientIds), r, debug.Stack())
+			// the history may be incomplete, make the client reconnect and replay it again
+			s.Kick(closeReasonInternalError)
+		}
+	}()
+	started := time.Now()
+	var count, size int
+	// queue hands the messages to the connection, blocking while it is full,
+	// and reports false if the session was closed meanwhile
+	queue := func(messages []datatype.SseMessage) bool {
+		for i, m := range messages {
+			select {
+			case <-s.Closer:
+				droppedSessionMessagesMetric.Add(float64(len(messages) - i))
+				return false
+			case s.MessageCh <- m:
+			}
+			if m.EventId > s.replayedUpTo {
+				s.replayedUpTo = m.EventId
+			}
+		}
+		return true
 	}
-	for _, m := range queue {
+	read := func(messages []datatype.SseMessage) {
+		count += len(messages)
+		for _, m := range messages {
+			size += len(m.Message)
+		}
+	}
+	defer func() {
+		replayMessagesMetric.Observe(float64(count))
+		replayBytesMetric.Observe(float64(size))
+	}()
+	pager, paged := s.storage.(pagedStorage)
+	if paged && config.Config.ReplayPageSize > 0 && config.Config.ReplayOrder != replayNewestFirst {
+		// the next page is only read once the connection took the previous one
+		for after := s.lastEventId; ; {
+			page, next, err := pager.GetMessagesPage(context.TODO(), s.ClientIds, after, config.Config.ReplayPageSize)
+			if err != nil {
+				log.Info("get queue page error: ", err)
+				break
+			}
+			replayPagesMetric.Inc()
+			read(page)
+			if !queue(page) {
+				return
+			}
+			if next == 0 {
+				break
+			}
+			after = next
+		}
+	} else {
+		messages, err := s.storage.GetMessages(context.TODO(), s.ClientIds, s.lastEventId)
+		if err != nil {
+			log.Info("get queue error: ", err)
+		}
+		sortReplay(messages, config.Config.ReplayOrder)
+		read(messages)
+		if !queue(messages) {
+			return
+		}
+	}
+	if s.queueDone {
 		select {
 		case <-s.Closer:
-			break
-		default:
-			s.MessageCh <- m
+			return
+		case s.MessageCh <- queueDoneMessage:
 		}
 	}
-
-	<-s.Closer
-	close(s.MessageCh)
+	// the duration includes waiting for the client to read the queue when it's longer than MessageCh
+	replayDurationMetric.Observe(time.Since(started).Seconds())
+	close(s.replayed)
+	if s.onReplayed != nil {
+		s.onReplayed(s)
+	}
 }
 
+// AddMessageToQueue hands mes to the connection. Messages sent to a closed session are dropped,
+// the client gets them from storage after reconnecting with Last-Event-ID.
 func (s *Session) AddMessageToQueue(ctx context.Context, mes datatype.SseMessage) {
+	if s.Overflowed() {
+		droppedSessionMessagesMetric.Inc()
+		return
+	}
+	select {
+	case <-s.Closer:
+		droppedSessionMessagesMetric.Inc()
+	case s.MessageCh <- mes:
+		s.recordForwarded(mes.EventId)
+	}
+}
+
+// TryAddMessageToQueue queues mes unless the queue is full or the session is closed or overflowed.
+func (s *Session) TryAddMessageToQueue(mes datatype.SseMessage) bool {
+	if s.Overflowed() {
+		return false
+	}
 	select {
 	case <-s.Closer:
+		return false
+	default:
+	}
+	select {
+	case s.MessageCh <- mes:
+		s.recordForwarded(mes.EventId)
+		return true
+	default:
+		return false
+	}
+}
+
+// Overflow is called when a message couldn't be queued. Nothing is queued to the session afterwards and
+// the connection handler closes the stream before writing the messages already queued, so the client's
+// Last-Event-ID stays before the missed message and it's replayed from storage after reconnecting.
+func (s *Session) Overflow() {
+	atomic.StoreInt32(&s.overflowed, 1)
+	s.Kick(closeReasonQueueOverflow)
+}
+
+// Overflowed reports whether the session missed a message, see Overflow.
+func (s *Session) Overflowed() bool {
+	return atomic.LoadInt32(&s.overflowed) == 1
+}
+
+func (s *Session) recordForwarded(eventId int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.forwardedDone {
+		s.forwarded[eventId] = true
+	}
+}
+
+// StopRecordingForwarded is called once the sessions this one replaces are unsubscribed, later live messages
+// only reach this session. Without replaced sessions the recorded ids are dropped.
+func (s *Session) StopRecordingForwarded(replaced bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.forwardedDone = true
+	if !replaced {
+		s.forwarded = nil
+	}
+}
+
+// queued reports whether the session already has the message eventId, read from storage or forwarded live.
+// It may only be called after the history was replayed.
+func (s *Session) queued(eventId int64) bool {
+	if eventId <= s.replayedUpTo {
+		return true
+	}
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.forwarded[eventId]
+}
+
+// Close ends the stream of the session, it may be called several times.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() { close(s.Closer) })
+}
+
+// Kick asks the connection handler to send a close event with reason and end the stream.
+func (s *Session) Kick(reason string) {
+	select {
+	case s.kick <- reason:
 	default:
-		s.MessageCh <- mes
 	}
 }
 
+// Replace closes the session with the "replaced" reason, messages it hasn't written yet go to next.
+// Unlike Kick it can't be missed: the connection handler sees the closed Closer and sends the close event.
+func (s *Session) Replace(next *Session) {
+	s.mux.Lock()
+	s.successor = next
+	s.mux.Unlock()
+	s.SetCloseReason(closeReasonReplaced)
+	s.Close()
+}
+
+// HandOver moves the messages still queued in the session to its successor, if it has one.
+// The successor gets them after its own replay, skipping the ones it has already read from storage
+// or got live while both sessions were subscribed.
+func (s *Session) HandOver() int {
+	s.mux.RLock()
+	next := s.successor
+	s.mux.RUnlock()
+	if next == nil {
+		return 0
+	}
+	var queue []datatype.SseMessage
+	for {
+		select {
+		case m := <-s.MessageCh:
+			if m.EventId != queueDoneEventId {
+				queue = append(queue, m)
+			}
+			continue
+		default:
+		}
+		break
+	}
+	if len(queue) == 0 {
+		return 0
+	}
+	go func() {
+		select {
+		case <-next.Closer:
+			droppedSessionMessagesMetric.Add(float64(len(queue)))
+			return
+		case <-next.replayed:
+		}
+		for _, m := range queue {
+			if !next.queued(m.EventId) {
+				next.AddMessageToQueue(context.TODO(), m)
+			}
+		}
+	}()
+	return len(queue)
+}
+
+// SetCloseReason records why the stream ended, only the first reason is kept.
+func (s *Session) SetCloseReason(reason string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+}
+
+// CloseReason returns the reason recorded by SetCloseReason.
+func (s *Session) CloseReason() string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.closeReason
+}
+
 func (s *Session) Start() {
 	go s.worker()
 }
+
+// MarkHeartbeat remembers the timestamp of the heartbeat that is about to be sent
+// and reports whether the previous heartbeat was never echoed back.
+func (s *Session) MarkHeartbeat(ts int64) (missed bool) {
+	missed = atomic.LoadInt64(&s.heartbeatTs) != 0 && atomic.LoadInt32(&s.heartbeatAcked) == 0
+	atomic.StoreInt32(&s.heartbeatAcked, 0)
+	atomic.StoreInt64(&s.heartbeatTs, ts)
+	return missed
+}
+
+// AckHeartbeat records the round trip time if ts matches the last heartbeat sent to the session.
+func (s *Session) AckHeartbeat(ts int64, now time.Time) (time.Duration, bool) {
+	if ts == 0 || atomic.LoadInt64(&s.heartbeatTs) != ts {
+		return 0, false
+	}
+	rtt := now.Sub(time.UnixMicro(ts))
+	atomic.StoreInt32(&s.heartbeatAcked, 1)
+	atomic.StoreInt64(&s.rtt, int64(rtt))
+	return rtt, true
+}
+
+// RTT returns the last measured round trip time or zero if it was never measured.
+func (s *Session) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	shedConnectionsMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_shed_connections",
+		Help: "The total number of anonymous /bridge/events requests rejected above the shedding watermark",
+	})
+	sheddingMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "connection_shedding",
+		Help: "1 while new anonymous /bridge/events requests are shed, 0 otherwise",
+	})
+)
+
+// shedRetryAfter is the Retry-After in seconds sent to shed clients.
+const shedRetryAfter = 10
+
+// connectionShedder counts streaming connections of the instance and, once there are watermark of them,
+// rejects new ones unless they are prioritized, e.g. authenticated with a token.
+type connectionShedder struct {
+	mu        sync.Mutex
+	active    int
+	watermark int
+	shedding  bool
+}
+
+func newConnectionShedder(watermark int) *connectionShedder {
+	return &connectionShedder{watermark: watermark}
+}
+
+// lease registers a new connection and returns a release function,
+// it returns false without registering the connection when it has to be shed.
+func (s *connectionShedder) lease(priority bool) (release func(), ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setShedding(s.active >= s.watermark)
+	if s.shedding && !priority {
+		return nil, false
+	}
+	s.active++
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.active--
+		s.setShedding(s.active >= s.watermark)
+	}, true
+}
+
+func (s *connectionShedder) setShedding(shedding bool) {
+	if shedding == s.shedding {
+		return
+	}
+	s.shedding = shedding
+	if shedding {
+		sheddingMetric.Set(1)
+		log.WithField("prefix", "connectionShedder").Warnf("%v streaming connections, shedding new anonymous ones", s.active)
+	} else {
+		sheddingMetric.Set(0)
+		log.WithField("prefix", "connectionShedder").Infof("%v streaming connections, stopped shedding", s.active)
+	}
+}
+
+// shedMiddleware rejects new anonymous /bridge/events requests with 503 and Retry-After while the instance
+// holds watermark streaming connections or more, priority requests are always accepted. 0 disables shedding.
+func shedMiddleware(watermark int, priority func(c echo.Context) bool) echo.MiddlewareFunc {
+	shedder := newConnectionShedder(watermark)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if watermark <= 0 || c.Path() != "/bridge/events" {
+				return next(c)
+			}
+			release, ok := shedder.lease(priority(c))
+			if !ok {
+				shedConnectionsMetric.Inc()
+				c.Response().Header().Set("Retry-After", strconv.Itoa(shedRetryAfter))
+				return c.JSON(HttpResError(fmt.Sprintf("bridge is overloaded, retry in %v seconds", shedRetryAfter), http.StatusServiceUnavailable))
+			}
+			defer release()
+			return next(c)
+		}
+	}
+}
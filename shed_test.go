@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestConnectionShedder(t *testing.T) {
+	s := newConnectionShedder(2)
+	first, ok := s.lease(false)
+	if !ok {
+		t.Fatal("first connection is shed")
+	}
+	if _, ok := s.lease(false); !ok {
+		t.Fatal("second connection is shed")
+	}
+	if _, ok := s.lease(false); ok {
+		t.Fatal("anonymous connection above the watermark is accepted")
+	}
+	if _, ok := s.lease(true); !ok {
+		t.Fatal("priority connection above the watermark is shed")
+	}
+	first()
+	if _, ok := s.lease(false); ok {
+		t.Fatal("anonymous connection is accepted while the priority one keeps the instance above the watermark")
+	}
+}
+
+func TestShedMiddleware(t *testing.T) {
+	e := echo.New()
+	held, release := make(chan struct{}), make(chan struct{})
+	e.GET("/bridge/events", func(c echo.Context) error {
+		if c.QueryParam("hold") != "" {
+			held <- struct{}{}
+			<-release
+		}
+		return c.NoContent(http.StatusOK)
+	}, shedMiddleware(1, func(c echo.Context) bool {
+		return c.Request().Header.Get("Authorization") == "Bearer token"
+	}))
+	done := make(chan struct{})
+	go func() {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/bridge/events?hold=1", nil))
+		close(done)
+	}()
+	<-held
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bridge/events", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("want 503 with Retry-After, got %v %v", rec.Code, rec.Header())
+	}
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/bridge/events", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("token authenticated request is shed: %v", rec.Code)
+	}
+
+	close(release)
+	<-done
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bridge/events", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("request is shed below the watermark: %v", rec.Code)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tonkeeper/bridge/config"
+)
+
+var (
+	sideEffectCallsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_side_effect_calls",
+		Help: "The total number of webhook and CopyToURL calls by kind, destination host and result: attempted, succeeded, failed or dropped",
+	}, []string{"kind", "destination", "result"})
+	sideEffectDurationMetric = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "side_effect_duration_seconds",
+		Help: "How long webhook and CopyToURL calls take by kind and destination host",
+	}, []string{"kind", "destination"})
+)
+
+// Kinds of side effects of accepted messages.
+const (
+	sideEffectWebhook = "webhook"
+	sideEffectCopy    = "copy"
+)
+
+// Results of side effect calls. A call retried several times is attempted every time
+// and either succeeds or fails once.
+const (
+	sideEffectAttempted = "attempted"
+	sideEffectSucceeded = "succeeded"
+	sideEffectFailed    = "failed"
+	sideEffectDropped   = "dropped"
+)
+
+// newSideEffectClient returns the client of webhook and CopyToURL calls, a destination that doesn't answer
+// holds a worker for at most SIDE_EFFECT_TIMEOUT_MS.
+func newSideEffectClient() *http.Client {
+	return &http.Client{Timeout: time.Duration(config.Config.SideEffectTimeout) * time.Millisecond}
+}
+
+// sideEffectFailuresSize is the number of recent failures kept for /admin/side-effects.
+const sideEffectFailuresSize = 100
+
+// sideEffectDestination returns the host of u, which keeps the metric labels bounded:
+// webhook urls end with the client id.
+func sideEffectDestination(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		return "invalid"
+	}
+	return parsed.Host
+}
+
+type sideEffectFailure struct {
+	Time        time.Time `json:"time"`
+	Kind        string    `json:"kind"`
+	Destination string    `json:"destination"`
+	Attempt     int       `json:"attempt"`
+	Retried     bool      `json:"retried"`
+	Error       string    `json:"error"`
+}
+
+// sideEffectFailures keeps the most recent failed calls in a fixed-size ring buffer.
+// A nil *sideEffectFailures is valid and records nothing.
+type sideEffectFailures struct {
+	mu       sync.Mutex
+	failures []sideEffectFailure
+	next     int
+}
+
+func newSideEffectFailures(size int) *sideEffectFailures {
+	return &sideEffectFailures{failures: make([]sideEffectFailure, 0, size)}
+}
+
+func (r *sideEffectFailures) Record(f sideEffectFailure) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.failures) < cap(r.failures) {
+		r.failures = append(r.failures, f)
+		return
+	}
+	r.failures[r.next] = f
+	r.next = (r.next + 1) % len(r.failures)
+}
+
+// Recent returns the recorded failures, newest first.
+func (r *sideEffectFailures) Recent() []sideEffectFailure {
+	recent := []sideEffectFailure{}
+	if r == nil {
+		return recent
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ordered := append(append([]sideEffectFailure{}, r.failures[r.next:]...), r.failures[:r.next]...)
+	for i := len(ordered) - 1; i >= 0; i-- {
+		recent = append(recent, ordered[i])
+	}
+	return recent
+}
+
+// recordSideEffect counts a call of kind to destination that took duration and records it in failures
+// if it failed with err. retried tells a failed attempt that will be repeated from the final failure.
+func recordSideEffect(failures *sideEffectFailures, kind, destination string, attempt int, duration time.Duration, err error, retried bool) {
+	sideEffectCallsMetric.WithLabelValues(kind, destination, sideEffectAttempted).Inc()
+	sideEffectDurationMetric.WithLabelValues(kind, destination).Observe(duration.Seconds())
+	if err == nil {
+		sideEffectCallsMetric.WithLabelValues(kind, destination, sideEffectSucceeded).Inc()
+		return
+	}
+	if !retried {
+		sideEffectCallsMetric.WithLabelValues(kind, destination, sideEffectFailed).Inc()
+	}
+	failures.Record(sideEffectFailure{
+		Time:        time.Now(),
+		Kind:        kind,
+		Destination: destination,
+		Attempt:     attempt,
+		Retried:     retried,
+		Error:       err.Error(),
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tonkeeper/bridge/config"
+)
+
+func TestSideEffectFailures(t *testing.T) {
+	failures := newSideEffectFailures(2)
+	failed := counterValue(sideEffectCallsMetric.WithLabelValues(sideEffectWebhook, "example.com", sideEffectFailed))
+	for i := 0; i < 3; i++ {
+		recordSideEffect(failures, sideEffectWebhook, "example.com", i, time.Millisecond, errors.New("boom"), i < 2)
+	}
+	recent := failures.Recent()
+	if len(recent) != 2 || recent[0].Attempt != 2 || recent[0].Retried || recent[1].Attempt != 1 {
+		t.Fatalf("unexpected failures: %+v", recent)
+	}
+	if got := counterValue(sideEffectCallsMetric.WithLabelValues(sideEffectWebhook, "example.com", sideEffectFailed)) - failed; got != 1 {
+		t.Fatalf("want 1 failed call after retries, got %v", got)
+	}
+	var none *sideEffectFailures
+	none.Record(sideEffectFailure{})
+	if recent := none.Recent(); recent == nil || len(recent) != 0 {
+		t.Fatalf("want an empty list, got %v", recent)
+	}
+}
+
+func TestCopyToURL_Failure(t *testing.T) {
+	defer func(u string) { config.Config.CopyToURL = u }(config.Config.CopyToURL)
+	copies := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer copies.Close()
+	config.Config.CopyToURL = copies.URL + "/copy"
+	h := &handler{sideEffects: newSideEffectFailures(sideEffectFailuresSize), copyClient: newSideEffectClient()}
+	destination := sideEffectDestination(config.Config.CopyToURL)
+	attempted := counterValue(sideEffectCallsMetric.WithLabelValues(sideEffectCopy, destination, sideEffectAttempted))
+
+	h.copyToURL(destination, url.Values{"to": {"wallet"}}, http.Header{}, []byte("message"))
+	recent := h.sideEffects.Recent()
+	if len(recent) != 1 || recent[0].Kind != sideEffectCopy || recent[0].Destination != destination || !strings.Contains(recent[0].Error, "502") {
+		t.Fatalf("unexpected failures: %+v", recent)
+	}
+	if got := counterValue(sideEffectCallsMetric.WithLabelValues(sideEffectCopy, destination, sideEffectAttempted)) - attempted; got != 1 {
+		t.Fatalf("want 1 attempted copy, got %v", got)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+const (
+	senderSignatureOff      = "off"
+	senderSignatureOptional = "optional"
+	senderSignatureRequired = "required"
+)
+
+var (
+	errInvalidSenderKey       = errors.New("client_id is not a hex encoded ed25519 public key")
+	errInvalidSenderSignature = errors.New("invalid sender signature")
+	errInvalidAckSignature    = errors.New("invalid acknowledgement signature")
+)
+
+// senderSignaturePayload builds the bytes a sender signs: to, ttl and the sha256 of the body separated by new lines.
+func senderSignaturePayload(to, ttl string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	payload := make([]byte, 0, len(to)+len(ttl)+2+len(bodyHash))
+	payload = append(payload, to...)
+	payload = append(payload, '\n')
+	payload = append(payload, ttl...)
+	payload = append(payload, '\n')
+	return append(payload, bodyHash[:]...)
+}
+
+// ackSignaturePayload builds the bytes a receiver signs to acknowledge a message: "ack" and the event id
+// separated by a new line.
+func ackSignaturePayload(eventId string) []byte {
+	return append([]byte("ack\n"), eventId...)
+}
+
+// verifySenderSignature checks that signature (hex) was made by the key encoded in clientId over to, ttl and body.
+func verifySenderSignature(clientId, to, ttl string, body []byte, signature string) error {
+	return verifySignature(clientId, senderSignaturePayload(to, ttl, body), signature, errInvalidSenderSignature)
+}
+
+// verifyAckSignature checks that signature (hex) was made by the key encoded in clientId over the acknowledged eventId.
+func verifyAckSignature(clientId, eventId, signature string) error {
+	return verifySignature(clientId, ackSignaturePayload(eventId), signature, errInvalidAckSignature)
+}
+
+func verifySignature(clientId string, payload []byte, signature string, errInvalid error) error {
+	key, err := hex.DecodeString(clientId)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errInvalidSenderKey
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errInvalid
+	}
+	if !ed25519.Verify(key, payload, sig) {
+		return errInvalid
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+func Test_verifySenderSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientId := hex.EncodeToString(pub)
+	body := []byte("message")
+	signature := hex.EncodeToString(ed25519.Sign(priv, senderSignaturePayload("wallet", "300", body)))
+
+	if err := verifySenderSignature(clientId, "wallet", "300", body, signature); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	if err := verifySenderSignature(clientId, "wallet", "60", body, signature); err != errInvalidSenderSignature {
+		t.Fatalf("signature over another ttl accepted: %v", err)
+	}
+	if err := verifySenderSignature(clientId, "other", "300", body, signature); err != errInvalidSenderSignature {
+		t.Fatalf("signature over another receiver accepted: %v", err)
+	}
+	if err := verifySenderSignature("not-a-key", "wallet", "300", body, signature); err != errInvalidSenderKey {
+		t.Fatalf("bad client id accepted: %v", err)
+	}
+}
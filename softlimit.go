@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/tonkeeper/bridge/config"
+)
+
+var softLimitWarningsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "number_of_soft_limit_warnings",
+	Help: "The total number of responses warning that a client is close to a hard limit",
+}, []string{"limit"})
+
+// limitWarningHeader lists the limits a client is approaching, e.g. "rate=4/5, connections=41/50".
+const limitWarningHeader = "X-Bridge-Limit-Warning"
+
+// warnSoftLimit adds a warning header to the response if used reached SOFT_LIMIT_RATIO of max.
+func warnSoftLimit(c echo.Context, limit string, used, max int) {
+	ratio := config.Config.SoftLimitRatio
+	if ratio <= 0 || max <= 0 || float64(used) < ratio*float64(max) {
+		return
+	}
+	softLimitWarningsMetric.WithLabelValues(limit).Inc()
+	c.Response().Header().Add(limitWarningHeader, fmt.Sprintf("%v=%v/%v", limit, used, max))
+}
+
+// requestRateTracker counts requests per key in fixed one second windows.
+type requestRateTracker struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	counts      map[string]int
+}
+
+func newRequestRateTracker() *requestRateTracker {
+	return &requestRateTracker{counts: map[string]int{}}
+}
+
+// Hit counts a request for key and returns the number of its requests in the current window.
+func (t *requestRateTracker) Hit(key string, now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.windowStart) >= time.Second {
+		t.windowStart = now
+		t.counts = map[string]int{}
+	}
+	t.counts[key]++
+	return t.counts[key]
+}
+
+const (
+	rateLimitHeader          = "X-RateLimit-Limit"
+	rateLimitRemainingHeader = "X-RateLimit-Remaining"
+	// rateLimitSkippedKey carries the skipper decision from rateLimitHeadersMiddleware to the rate limiter
+	// so allowlisted requests are only counted once.
+	rateLimitSkippedKey = "rate_limit_skipped"
+)
+
+// rateLimitHeadersMiddleware tells clients their rps limit and how many requests are left in the current second,
+// warning them when they approach the limit.
+func rateLimitHeadersMiddleware(limit int, skipper func(c echo.Context) bool) echo.MiddlewareFunc {
+	tracker := newRequestRateTracker()
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			skipped := skipper(c)
+			c.Set(rateLimitSkippedKey, skipped)
+			if !skipped {
+				used := tracker.Hit(requestContext(c).IP, time.Now())
+				remaining := limit - used
+				if remaining < 0 {
+					remaining = 0
+				}
+				c.Response().Header().Set(rateLimitHeader, strconv.Itoa(limit))
+				c.Response().Header().Set(rateLimitRemainingHeader, strconv.Itoa(remaining))
+				warnSoftLimit(c, "rate", used, limit)
+			}
+			return next(c)
+		}
+	}
+}
+
+// rateLimitSkipped reports the decision made by rateLimitHeadersMiddleware.
+func rateLimitSkipped(c echo.Context) bool {
+	skipped, _ := c.Get(rateLimitSkippedKey).(bool)
+	return skipped
+}
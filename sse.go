@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// sseModeStrict is the value of the "sse" param of /bridge/events that selects canonical SSE framing:
+// fields in id, event, data order, LF line endings, multiline data split into several data fields
+// and a data field in every event, so spec compliant parsers dispatch heartbeats too.
+const sseModeStrict = "strict"
+
+// encodeSseEvent writes a canonical SSE event to buf. id is omitted when empty.
+func encodeSseEvent(buf *bytes.Buffer, id, event string, data []byte) {
+	if id != "" {
+		writeSseField(buf, "id", id)
+	}
+	writeSseField(buf, "event", event)
+	writeSseData(buf, data)
+	buf.WriteByte('\n')
+}
+
+// writeSseField writes a single line field, line breaks in value are dropped so it can't end the event early.
+func writeSseField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	buf.WriteString(strings.NewReplacer("\r", "", "\n", "").Replace(value))
+	buf.WriteByte('\n')
+}
+
+// writeSseData writes data as data fields, one per line of data, so line breaks in a payload
+// ("\n", "\r\n" or "\r") never end the event or start a spoofed one. A parser joins them back with "\n".
+func writeSseData(buf *bytes.Buffer, data []byte) {
+	lines := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(string(data))
+	for _, line := range strings.Split(lines, "\n") {
+		buf.WriteString("data: ")
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+type specEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// parseSpecSse interprets stream as the event stream parsing algorithm of the HTML spec does
+// and returns the dispatched events.
+func parseSpecSse(stream string) []specEvent {
+	stream = strings.TrimPrefix(stream, "\ufeff")
+	stream = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(stream)
+	var events []specEvent
+	var lastId, event string
+	var data strings.Builder
+	for _, line := range strings.Split(stream, "\n") {
+		if line == "" {
+			if data.Len() == 0 {
+				event = ""
+				continue
+			}
+			name := event
+			if name == "" {
+				name = "message"
+			}
+			events = append(events, specEvent{id: lastId, event: name, data: strings.TrimSuffix(data.String(), "\n")})
+			event = ""
+			data.Reset()
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+		case "id":
+			if !strings.Contains(value, "\x00") {
+				lastId = value
+			}
+		}
+	}
+	return events
+}
+
+func TestStrictSse_Conformance(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	session := NewSession(h.storage, []string{"wallet"}, 0)
+	session.strict = true
+
+	var buf bytes.Buffer
+	buf.WriteString("\n")
+	if err := writeSseMessage(&buf, "7", datatype.SseMessage{EventId: 7, Message: []byte("line1\r\nline2\rline3")}, true); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString(h.heartbeat(session, time.Now()))
+	encodeSseEvent(&buf, "", "close", []byte(`{"reason":"shutdown"}`))
+
+	stream := buf.String()
+	if strings.Contains(stream, "\r") {
+		t.Fatalf("strict stream contains CR: %q", stream)
+	}
+	want := []specEvent{
+		{id: "7", event: "message", data: "line1\nline2\nline3"},
+		{id: "7", event: "heartbeat", data: ""},
+		{id: "7", event: "close", data: `{"reason":"shutdown"}`},
+	}
+	got := parseSpecSse(stream)
+	if len(got) != len(want) {
+		t.Fatalf("want %v events, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %v: want %+v, got %+v", i, want[i], got[i])
+		}
+	}
+	if !strings.HasPrefix(stream, "\nid: 7\nevent: message\n") {
+		t.Errorf("fields are not in id, event, data order: %q", stream)
+	}
+}
+
+func TestLegacySse_HeartbeatNotDispatched(t *testing.T) {
+	h := newHandler(memory.NewStorage(), time.Minute)
+	defer h.Close()
+	session := NewSession(h.storage, []string{"wallet"}, 0)
+	if events := parseSpecSse(h.heartbeat(session, time.Now())); len(events) != 0 {
+		t.Fatalf("legacy heartbeat is expected to be ignored by spec parsers, got %+v", events)
+	}
+}
+
+func FuzzWriteSseMessage(f *testing.F) {
+	f.Add([]byte(`{"from":"dapp","message":"hello"}`), false)
+	f.Add([]byte("a\n\nevent: message\nid: 1\ndata: spoofed\n\n"), false)
+	f.Add([]byte("a\r\n\r\nid: 9\r\rdata"), true)
+	f.Add([]byte(""), true)
+	f.Fuzz(func(t *testing.T, payload []byte, strict bool) {
+		var buf bytes.Buffer
+		if err := writeSseMessage(&buf, "42", datatype.SseMessage{EventId: 42, Message: payload}, strict); err != nil {
+			t.Fatal(err)
+		}
+		events := parseSpecSse(buf.String())
+		if len(events) != 1 {
+			t.Fatalf("payload %q is framed as %v events: %q", payload, len(events), buf.String())
+		}
+		want := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(string(payload))
+		if events[0].id != "42" || events[0].event != "message" || events[0].data != want {
+			t.Fatalf("payload %q is parsed as %+v", payload, events[0])
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// version is overridden at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>bridge status</title>
+<style>body{font-family:monospace;margin:2em}td{padding:0.2em 1em}</style>
+</head>
+<body>
+<h1>bridge {{.Version}}</h1>
+<table>
+<tr><td>storage</td><td>{{.Storage}}</td></tr>
+<tr><td>status</td><td>{{.Health.Status}}</td></tr>
+{{range $name, $d := .Health.Dependencies}}<tr><td>{{$name}}</td><td>{{$d.State}}{{if $d.LastError}} ({{$d.LastError}}){{end}}</td></tr>
+{{end}}<tr><td>clock skew</td><td>{{.ClockSkew}}</td></tr>
+<tr><td>uptime</td><td>{{.Uptime}}</td></tr>
+<tr><td>active connections</td><td>{{.ActiveConnections}}</td></tr>
+<tr><td>active subscriptions</td><td>{{.ActiveSubscriptions}}</td></tr>
+<tr><td>transferred messages</td><td>{{.TransferedMessages}}</td></tr>
+<tr><td>messages/sec</td><td>{{printf "%.2f" .MessagesPerSecond}}</td></tr>
+<tr><td>delivered messages</td><td>{{.DeliveredMessages}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+type statusData struct {
+	Version             string
+	Storage             string
+	Health              healthReport
+	ClockSkew           time.Duration
+	Uptime              time.Duration
+	ActiveConnections   float64
+	ActiveSubscriptions float64
+	TransferedMessages  float64
+	MessagesPerSecond   float64
+	DeliveredMessages   float64
+}
+
+// statusPage renders live counters taken from the prometheus registry and the state of the dependencies.
+type statusPage struct {
+	token     string
+	storage   string
+	health    *healthTracker
+	gatherer  prometheus.Gatherer
+	startedAt time.Time
+
+	mu           sync.Mutex
+	lastSampleAt time.Time
+	lastSample   float64
+}
+
+func newStatusPage(token, storage string, health *healthTracker) *statusPage {
+	return &statusPage{
+		token:     token,
+		storage:   storage,
+		health:    health,
+		gatherer:  prometheus.DefaultGatherer,
+		startedAt: time.Now(),
+	}
+}
+
+func (p *statusPage) authorized(r *http.Request) bool {
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		provided = password
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(p.token)) == 1
+}
+
+func (p *statusPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="bridge"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	values, err := gatherValues(p.gatherer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	data := statusData{
+		Version:             version,
+		Storage:             p.storage,
+		Health:              p.health.Report(p.storage),
+		ClockSkew:           time.Duration(values["clock_skew_seconds"] * float64(time.Second)).Round(time.Millisecond),
+		Uptime:              now.Sub(p.startedAt).Round(time.Second),
+		ActiveConnections:   values["number_of_acitve_connections"],
+		ActiveSubscriptions: values["number_of_active_subscriptions"],
+		TransferedMessages:  values["number_of_transfered_messages"],
+		DeliveredMessages:   values["number_of_delivered_messages"],
+	}
+	p.mu.Lock()
+	if !p.lastSampleAt.IsZero() {
+		data.MessagesPerSecond = (data.TransferedMessages - p.lastSample) / now.Sub(p.lastSampleAt).Seconds()
+	}
+	p.lastSampleAt, p.lastSample = now, data.TransferedMessages
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, data); err != nil {
+		log.WithField("prefix", "statusPage").Errorf("render: %v", err)
+	}
+}
+
+// gatherValues sums every sample of each gauge and counter metric family by name.
+func gatherValues(g prometheus.Gatherer) (map[string]float64, error) {
+	families, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64, len(families))
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			switch {
+			case m.GetGauge() != nil:
+				values[f.GetName()] += m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				values[f.GetName()] += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return values, nil
+}
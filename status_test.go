@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusPage(t *testing.T) {
+	defer func(skew float64) { clockSkewMetric.Set(skew) }(gaugeValue(clockSkewMetric))
+	clockSkewMetric.Set(1.5)
+	health := newHealthTracker("storage")
+	health.Failure("storage", errors.New("connection refused"))
+	p := newStatusPage("secret", "memory", health)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without credentials, got %v", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	req.SetBasicAuth("admin", "secret")
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"active connections", "memory", "degraded (connection refused)", "1.5s"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("%q is missing in the body: %v", want, body)
+		}
+	}
+}
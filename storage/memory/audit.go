@@ -0,0 +1,40 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+func (s *Storage) AddAuditRecord(ctx context.Context, record datatype.AuditRecord) error {
+	s.auditLock.Lock()
+	defer s.auditLock.Unlock()
+	s.audit = append(s.audit, record)
+	return nil
+}
+
+func (s *Storage) GetAuditRecords(ctx context.Context, from, to time.Time) ([]datatype.AuditRecord, error) {
+	s.auditLock.Lock()
+	defer s.auditLock.Unlock()
+	records := []datatype.AuditRecord{}
+	for _, r := range s.audit {
+		if !r.CreatedAt.Before(from) && r.CreatedAt.Before(to) {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+func (s *Storage) RemoveAuditRecordsBefore(ctx context.Context, before time.Time) error {
+	s.auditLock.Lock()
+	defer s.auditLock.Unlock()
+	records := make([]datatype.AuditRecord, 0, len(s.audit))
+	for _, r := range s.audit {
+		if !r.CreatedAt.Before(before) {
+			records = append(records, r)
+		}
+	}
+	s.audit = records
+	return nil
+}
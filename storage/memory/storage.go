@@ -2,13 +2,27 @@ package memory
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/tonkeeper/bridge/datatype"
 )
 
+// shardsCount is the number of independently locked partitions of the storage.
+const shardsCount = 64
+
 type Storage struct {
+	shards [shardsCount]*shard
+
+	audit     []datatype.AuditRecord
+	auditLock sync.Mutex
+
+	hookLock  sync.Mutex
+	onExpired func(key string, count int)
+}
+
+type shard struct {
 	db   map[string][]message
 	lock sync.Mutex
 }
@@ -23,13 +37,29 @@ func (m message) IsExpired(now time.Time) bool {
 }
 
 func NewStorage() *Storage {
-	s := Storage{
-		db: map[string][]message{},
-	}
+	s := newStorage()
 	go s.watcher()
+	return s
+}
+
+func newStorage() *Storage {
+	s := Storage{}
+	for i := range s.shards {
+		s.shards[i] = &shard{db: map[string][]message{}}
+	}
 	return &s
 }
 
+// shard returns the partition holding key, picked by its FNV-1a hash.
+func (s *Storage) shard(key string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return s.shards[h%shardsCount]
+}
+
 func removeExpiredMessages(ms []message, now time.Time) []message {
 	results := make([]message, 0)
 	for _, m := range ms {
@@ -42,43 +72,97 @@ func removeExpiredMessages(ms []message, now time.Time) []message {
 
 func (s *Storage) watcher() {
 	for {
-		s.lock.Lock()
-		for key, ms := range s.db {
-			s.db[key] = removeExpiredMessages(ms, time.Now())
-		}
-		s.lock.Unlock()
+		s.RemoveExpired(context.Background())
 		time.Sleep(time.Second)
 	}
 }
 
-func (s *Storage) GetMessages(ctx context.Context, keys []string, lastEventId int64) ([]datatype.SseMessage, error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+// RemoveExpired deletes expired messages and returns how many were removed.
+func (s *Storage) RemoveExpired(ctx context.Context) (int64, error) {
+	var removed int64
+	expired := map[string]int{}
+	for _, sh := range s.shards {
+		sh.lock.Lock()
+		for key, ms := range sh.db {
+			left := removeExpiredMessages(ms, time.Now())
+			if n := len(ms) - len(left); n > 0 {
+				removed += int64(n)
+				expired[key] = n
+			}
+			sh.db[key] = left
+		}
+		sh.lock.Unlock()
+	}
+	s.hookLock.Lock()
+	onExpired := s.onExpired
+	s.hookLock.Unlock()
+	if onExpired != nil {
+		for key, n := range expired {
+			onExpired(key, n)
+		}
+	}
+	return removed, nil
+}
+
+// OnExpired sets f to be called with the number of expired messages of every key after they're removed.
+func (s *Storage) OnExpired(f func(key string, count int)) {
+	s.hookLock.Lock()
+	defer s.hookLock.Unlock()
+	s.onExpired = f
+}
 
+func (s *Storage) GetMessages(ctx context.Context, keys []string, lastEventId int64) ([]datatype.SseMessage, error) {
 	now := time.Now()
 	results := make([]datatype.SseMessage, 0)
 	for _, key := range keys {
-		messages, ok := s.db[key]
-		if !ok {
-			continue
-		}
-		for _, m := range messages {
+		sh := s.shard(key)
+		sh.lock.Lock()
+		for _, m := range sh.db[key] {
 			if m.IsExpired(now) {
 				continue
 			}
-			if m.EventId < lastEventId {
+			if m.EventId <= lastEventId {
 				continue
 			}
 			results = append(results, m.SseMessage)
 		}
+		sh.lock.Unlock()
 	}
 	return results, nil
 }
 
+// GetMessagesPage returns up to limit messages after lastEventId ordered by event id
+// and the event id to continue from, 0 after the last page.
+func (s *Storage) GetMessagesPage(ctx context.Context, keys []string, lastEventId int64, limit int) ([]datatype.SseMessage, int64, error) {
+	messages, _ := s.GetMessages(ctx, keys, lastEventId)
+	sort.Slice(messages, func(i, j int) bool { return messages[i].EventId < messages[j].EventId })
+	if len(messages) <= limit {
+		return messages, 0, nil
+	}
+	return messages[:limit], messages[limit-1].EventId, nil
+}
+
 func (s *Storage) Add(ctx context.Context, key string, ttl int64, mes datatype.SseMessage) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+	sh := s.shard(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	sh.db[key] = append(sh.db[key], message{SseMessage: mes, expireAt: time.Now().Add(time.Duration(ttl) * time.Second)})
+	return nil
+}
+
+// Remove deletes the message with eventId stored for key.
+func (s *Storage) Remove(ctx context.Context, key string, eventId int64) error {
+	sh := s.shard(key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
 
-	s.db[key] = append(s.db[key], message{SseMessage: mes, expireAt: time.Now().Add(time.Duration(ttl) * time.Second)})
+	ms := sh.db[key]
+	for i, m := range ms {
+		if m.EventId == eventId {
+			sh.db[key] = append(ms[:i:i], ms[i+1:]...)
+			break
+		}
+	}
 	return nil
 }
@@ -2,6 +2,8 @@ package memory
 
 import (
 	"context"
+	"fmt"
+	"math/rand"
 	"reflect"
 	"testing"
 	"time"
@@ -63,7 +65,7 @@ func Test_removeExpiredMessages(t *testing.T) {
 }
 
 func TestStorage(t *testing.T) {
-	s := &Storage{db: map[string][]message{}}
+	s := newStorage()
 	s.Add(context.Background(), "1", 2, datatype.SseMessage{EventId: 1})
 	s.Add(context.Background(), "2", 2, datatype.SseMessage{EventId: 2})
 	s.Add(context.Background(), "2", 2, datatype.SseMessage{EventId: 3})
@@ -82,6 +84,14 @@ func TestStorage(t *testing.T) {
 				{EventId: 4},
 			},
 		},
+		{
+			name:        "after last event id",
+			keys:        []string{"1"},
+			lastEventId: 1,
+			want: []datatype.SseMessage{
+				{EventId: 4},
+			},
+		},
 		{
 			name: "keys not found",
 			keys: []string{"10", "20"},
@@ -145,15 +155,113 @@ func TestStorage_watcher(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := &Storage{db: tt.db}
+			s := newStorage()
+			for key, ms := range tt.db {
+				s.shard(key).db[key] = ms
+			}
 			go s.watcher()
 			time.Sleep(500 * time.Millisecond)
-			s.lock.Lock()
-			defer s.lock.Unlock()
 
-			if !reflect.DeepEqual(s.db, tt.want) {
+			got := map[string][]message{}
+			for _, sh := range s.shards {
+				sh.lock.Lock()
+				for key, ms := range sh.db {
+					got[key] = ms
+				}
+				sh.lock.Unlock()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("GetMessages() = %v, want %v", message{}, tt.want)
 			}
 		})
 	}
 }
+
+func BenchmarkStorage_Parallel(b *testing.B) {
+	const topics = 10000
+	keys := make([]string, topics)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%064x", i)
+	}
+	s := newStorage()
+	ctx := context.Background()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		i := int64(0)
+		for pb.Next() {
+			key := keys[r.Intn(topics)]
+			i++
+			if i%2 == 0 {
+				s.Add(ctx, key, 60, datatype.SseMessage{EventId: i})
+			} else {
+				s.GetMessages(ctx, []string{key}, i)
+			}
+		}
+	})
+}
+
+func TestStorage_Remove(t *testing.T) {
+	s := newStorage()
+	for i := 1; i <= 3; i++ {
+		if err := s.Add(context.Background(), "wallet", 60, datatype.SseMessage{EventId: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Remove(context.Background(), "wallet", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(context.Background(), "other", 1); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := s.GetMessages(context.Background(), []string{"wallet"}, 0)
+	var ids []int64
+	for _, m := range messages {
+		ids = append(ids, m.EventId)
+	}
+	if !reflect.DeepEqual(ids, []int64{1, 3}) {
+		t.Fatalf("want [1 3], got %v", ids)
+	}
+}
+
+func TestStorage_RemoveExpired(t *testing.T) {
+	s := newStorage()
+	s.Add(context.Background(), "wallet", 60, datatype.SseMessage{EventId: 1})
+	s.Add(context.Background(), "wallet", -1, datatype.SseMessage{EventId: 2})
+	s.Add(context.Background(), "other", -1, datatype.SseMessage{EventId: 3})
+	removed, err := s.RemoveExpired(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatalf("want 2 removed messages, got %v", removed)
+	}
+}
+
+func TestStorage_GetMessagesPage(t *testing.T) {
+	s := newStorage()
+	for i, to := range []string{"b", "a", "b", "a", "b"} {
+		if err := s.Add(context.Background(), to, 60, datatype.SseMessage{EventId: int64(i + 1), To: to}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var pages [][]int64
+	for after := int64(0); ; {
+		messages, next, err := s.GetMessagesPage(context.Background(), []string{"a", "b"}, after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, m := range messages {
+			ids = append(ids, m.EventId)
+		}
+		pages = append(pages, ids)
+		if next == 0 {
+			break
+		}
+		after = next
+	}
+	if want := [][]int64{{1, 2}, {3, 4}, {5}}; !reflect.DeepEqual(pages, want) {
+		t.Fatalf("want pages %v, got %v", want, pages)
+	}
+}
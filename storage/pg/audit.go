@@ -0,0 +1,51 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+func (s *Storage) AddAuditRecord(ctx context.Context, record datatype.AuditRecord) error {
+	_, err := s.postgres.Exec(ctx, `
+		INSERT INTO bridge.audit_log
+		(
+		event_id,
+		from_hash,
+		to_hash,
+		topic,
+		size,
+		ttl,
+		created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, record.EventId, record.FromHash, record.ToHash, record.Topic, record.Size, record.TTL, record.CreatedAt.UTC())
+	return err
+}
+
+func (s *Storage) GetAuditRecords(ctx context.Context, from, to time.Time) ([]datatype.AuditRecord, error) {
+	rows, err := s.postgres.Query(ctx, `SELECT event_id, from_hash, to_hash, topic, size, ttl, created_at
+	FROM bridge.audit_log
+	WHERE created_at >= $1 AND created_at < $2
+	ORDER BY created_at`, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []datatype.AuditRecord{}
+	for rows.Next() {
+		var r datatype.AuditRecord
+		err = rows.Scan(&r.EventId, &r.FromHash, &r.ToHash, &r.Topic, &r.Size, &r.TTL, &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func (s *Storage) RemoveAuditRecordsBefore(ctx context.Context, before time.Time) error {
+	_, err := s.postgres.Exec(ctx, `DELETE FROM bridge.audit_log WHERE created_at < $1`, before.UTC())
+	return err
+}
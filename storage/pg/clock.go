@@ -0,0 +1,44 @@
+package pg
+
+import (
+	"context"
+	"time"
+)
+
+// StorageTime returns the current time of the postgres server.
+func (s *Storage) StorageTime(ctx context.Context) (time.Time, error) {
+	var t time.Time
+	err := s.postgres.QueryRow(ctx, `SELECT clock_timestamp()`).Scan(&t)
+	return t, err
+}
+
+// ShareClock stores the clock offset of this instance in bridge.instance_clocks
+// and returns the offsets of the instances that updated theirs within ttl.
+func (s *Storage) ShareClock(ctx context.Context, offset, ttl time.Duration) (map[string]time.Duration, error) {
+	_, err := s.postgres.Exec(ctx, `
+		INSERT INTO bridge.instance_clocks (instance, offset_us, updated_at) VALUES ($1, $2, now())
+		ON CONFLICT (instance) DO UPDATE SET offset_us = $2, updated_at = now()`,
+		s.instance, offset.Microseconds())
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.postgres.Exec(ctx, `DELETE FROM bridge.instance_clocks WHERE updated_at < now() - $1 * interval '1 microsecond'`, ttl.Microseconds())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.postgres.Query(ctx, `SELECT instance, offset_us FROM bridge.instance_clocks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	offsets := map[string]time.Duration{}
+	for rows.Next() {
+		var instance string
+		var us int64
+		if err := rows.Scan(&instance, &us); err != nil {
+			return nil, err
+		}
+		offsets[instance] = time.Duration(us) * time.Microsecond
+	}
+	return offsets, rows.Err()
+}
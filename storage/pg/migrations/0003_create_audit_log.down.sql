@@ -0,0 +1,3 @@
+BEGIN;
+drop table if exists bridge.audit_log;
+COMMIT;
\ No newline at end of file
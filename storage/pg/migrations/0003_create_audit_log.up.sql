@@ -0,0 +1,16 @@
+BEGIN;
+create table if not exists bridge.audit_log
+(
+    event_id                  bigint               not null,
+    from_hash                 text                 not null,
+    to_hash                   text                 not null,
+    topic                     text                 not null,
+    size                      integer              not null,
+    ttl                       bigint               not null,
+    created_at                timestamp            not null
+);
+
+create index audit_log_created_at_index
+    on bridge.audit_log (created_at);
+
+COMMIT;
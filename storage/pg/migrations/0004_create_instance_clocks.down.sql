@@ -0,0 +1,3 @@
+BEGIN;
+drop table if exists bridge.instance_clocks;
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,9 @@
+BEGIN;
+create table if not exists bridge.instance_clocks
+(
+    instance                  text                 not null primary key,
+    offset_us                 bigint               not null,
+    updated_at                timestamp            not null
+);
+
+COMMIT;
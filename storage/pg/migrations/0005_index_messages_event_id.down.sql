@@ -0,0 +1,3 @@
+BEGIN;
+drop index if exists bridge.messages_client_id_event_id_index;
+COMMIT;
\ No newline at end of file
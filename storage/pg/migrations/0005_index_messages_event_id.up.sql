@@ -0,0 +1,5 @@
+BEGIN;
+create index if not exists messages_client_id_event_id_index
+    on bridge.messages (client_id, event_id);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,132 @@
+package pg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+// relayChannel is the LISTEN/NOTIFY channel passing live messages between bridge instances.
+const relayChannel = "bridge_messages"
+
+// notifyPayloadLimit is a bit less than the 8000 bytes postgres allows in a notification.
+const notifyPayloadLimit = 7900
+
+type relayedMessage struct {
+	// Instance identifies the publishing storage, so it skips its own messages.
+	Instance string `json:"i"`
+	EventId  int64  `json:"id"`
+	To       string `json:"to"`
+	Message  []byte `json:"msg,omitempty"`
+	// Stored is set instead of Message when the message doesn't fit into a notification
+	// and has to be read from bridge.messages.
+	Stored bool `json:"stored,omitempty"`
+}
+
+func newInstanceId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Publish passes mes to the other instances with NOTIFY.
+func (s *Storage) Publish(ctx context.Context, mes datatype.SseMessage) error {
+	m := relayedMessage{Instance: s.instance, EventId: mes.EventId, To: mes.To, Message: mes.Message}
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if len(payload) > notifyPayloadLimit {
+		m.Message, m.Stored = nil, true
+		if payload, err = json.Marshal(m); err != nil {
+			return err
+		}
+	}
+	_, err = s.postgres.Exec(ctx, `SELECT pg_notify($1, $2)`, relayChannel, string(payload))
+	return err
+}
+
+// Subscribe calls deliver for every message published by the other instances until ctx is done,
+// listening again after connection failures.
+func (s *Storage) Subscribe(ctx context.Context, deliver func(datatype.SseMessage)) error {
+	log := log.WithField("prefix", "Storage.Subscribe")
+	for {
+		err := s.listen(ctx, deliver)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Errorf("listen: %v", err)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Storage) listen(ctx context.Context, deliver func(datatype.SseMessage)) error {
+	log := log.WithField("prefix", "Storage.listen")
+	conn, err := s.postgres.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "LISTEN "+relayChannel); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "UNLISTEN "+relayChannel)
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var m relayedMessage
+		if err := json.Unmarshal([]byte(n.Payload), &m); err != nil {
+			log.Errorf("malformed relayed message: %v", err)
+			continue
+		}
+		if m.Instance == s.instance {
+			continue
+		}
+		if m.Stored {
+			// reading the message may wait for the publisher to store it, the notifications behind it don't
+			go func() {
+				message, err := s.loadRelayed(ctx, m.To, m.EventId)
+				if err != nil {
+					log.Errorf("load relayed message %v: %v", m.EventId, err)
+					return
+				}
+				deliver(datatype.SseMessage{EventId: m.EventId, Message: message, To: m.To})
+			}()
+			continue
+		}
+		deliver(datatype.SseMessage{EventId: m.EventId, Message: m.Message, To: m.To})
+	}
+}
+
+// loadRelayed reads a message too large for a notification. The publisher may still be storing it,
+// so a missing message is retried for a second or until ctx is done.
+func (s *Storage) loadRelayed(ctx context.Context, clientId string, eventId int64) ([]byte, error) {
+	var message []byte
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		err = s.postgres.QueryRow(ctx,
+			`SELECT bridge_message FROM bridge.messages WHERE client_id = $1 AND event_id = $2`, clientId, eventId).Scan(&message)
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return message, err
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,112 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	poolConnectionsMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pg_pool_connections",
+		Help: "The number of postgres pool connections by state: acquired, idle, total, max",
+	}, []string{"state"})
+	poolAcquireWaitMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pg_pool_acquire_wait_seconds",
+		Help: "The mean time spent acquiring a postgres connection during the last stats interval",
+	})
+	poolEmptyAcquiresMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pg_pool_empty_acquires",
+		Help: "The total number of acquires that had to wait for a connection because the pool was empty",
+	})
+	oldestMessageAgeMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pg_oldest_message_age_seconds",
+		Help: "The age of the oldest row in bridge.messages, it grows past the max ttl when expired rows are not removed",
+	})
+	lastCleanupAgeMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pg_last_cleanup_age_seconds",
+		Help: "The time since the last successful sweep of expired messages",
+	})
+	cleanupFailuresMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pg_cleanup_failures",
+		Help: "The total number of failed sweeps of expired messages",
+	})
+)
+
+// statsInterval is how often pool statistics are exported.
+const statsInterval = 10 * time.Second
+
+// poolStats is a snapshot of the pgxpool counters exported by statsWorker.
+type poolStats struct {
+	acquired, idle, total, max int32
+	acquireCount               int64
+	emptyAcquireCount          int64
+	acquireDuration            time.Duration
+}
+
+func newPoolStats(stat *pgxpool.Stat) poolStats {
+	return poolStats{
+		acquired:          stat.AcquiredConns(),
+		idle:              stat.IdleConns(),
+		total:             stat.TotalConns(),
+		max:               stat.MaxConns(),
+		acquireCount:      stat.AcquireCount(),
+		emptyAcquireCount: stat.EmptyAcquireCount(),
+		acquireDuration:   stat.AcquireDuration(),
+	}
+}
+
+// poolStatsDelta returns the mean acquire wait and the number of empty acquires between two snapshots.
+// The counters of pgxpool only grow, the difference is what happened during the last interval.
+func poolStatsDelta(prev, cur poolStats) (wait time.Duration, emptyAcquires int64) {
+	if count := cur.acquireCount - prev.acquireCount; count > 0 {
+		wait = (cur.acquireDuration - prev.acquireDuration) / time.Duration(count)
+	}
+	return wait, cur.emptyAcquireCount - prev.emptyAcquireCount
+}
+
+// statsWorker exports pgxpool statistics and logs an alarm when acquiring a connection takes longer than alarm.
+func (s *Storage) statsWorker(alarm time.Duration) {
+	var prev poolStats
+	for {
+		time.Sleep(statsInterval)
+		prev = exportPoolStats(prev, newPoolStats(s.postgres.Stat()), alarm)
+		if last, _ := s.CleanupStatus(); !last.IsZero() {
+			lastCleanupAgeMetric.Set(time.Since(last).Seconds())
+		}
+	}
+}
+
+// exportPoolStats sets the pool metrics from the cur snapshot and the change since prev and returns cur.
+func exportPoolStats(prev, cur poolStats, alarm time.Duration) poolStats {
+	poolConnectionsMetric.WithLabelValues("acquired").Set(float64(cur.acquired))
+	poolConnectionsMetric.WithLabelValues("idle").Set(float64(cur.idle))
+	poolConnectionsMetric.WithLabelValues("total").Set(float64(cur.total))
+	poolConnectionsMetric.WithLabelValues("max").Set(float64(cur.max))
+	wait, empty := poolStatsDelta(prev, cur)
+	poolEmptyAcquiresMetric.Add(float64(empty))
+	poolAcquireWaitMetric.Set(wait.Seconds())
+	if alarm > 0 && wait > alarm {
+		log.WithField("prefix", "Storage.statsWorker").Warnf("postgres pool saturated: mean acquire wait %v, %v/%v connections acquired", wait, cur.acquired, cur.max)
+	}
+	return cur
+}
+
+// exportOldestMessage exports the age of the oldest stored message.
+// Event ids are unix time in microseconds of the message creation, so no extra column is needed.
+func (s *Storage) exportOldestMessage(ctx context.Context) {
+	var oldest *int64
+	if err := s.postgres.QueryRow(ctx, `SELECT min(event_id) FROM bridge.messages`).Scan(&oldest); err != nil {
+		log.WithField("prefix", "Storage.exportOldestMessage").Infof("oldest message query error: %v", err)
+		return
+	}
+	if oldest == nil {
+		oldestMessageAgeMetric.Set(0)
+		return
+	}
+	oldestMessageAgeMetric.Set(time.Since(time.UnixMicro(*oldest)).Seconds())
+}
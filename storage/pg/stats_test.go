@@ -0,0 +1,68 @@
+package pg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestPoolStatsDelta(t *testing.T) {
+	tests := []struct {
+		name      string
+		prev, cur poolStats
+		wantWait  time.Duration
+		wantEmpty int64
+	}{
+		{name: "first snapshot", cur: poolStats{acquireCount: 4, acquireDuration: 40 * time.Millisecond, emptyAcquireCount: 1}, wantWait: 10 * time.Millisecond, wantEmpty: 1},
+		{
+			name:      "interval",
+			prev:      poolStats{acquireCount: 4, acquireDuration: 40 * time.Millisecond, emptyAcquireCount: 1},
+			cur:       poolStats{acquireCount: 6, acquireDuration: 240 * time.Millisecond, emptyAcquireCount: 3},
+			wantWait:  100 * time.Millisecond,
+			wantEmpty: 2,
+		},
+		{
+			name: "no acquires",
+			prev: poolStats{acquireCount: 6, acquireDuration: 240 * time.Millisecond, emptyAcquireCount: 3},
+			cur:  poolStats{acquireCount: 6, acquireDuration: 240 * time.Millisecond, emptyAcquireCount: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wait, empty := poolStatsDelta(tt.prev, tt.cur)
+			if wait != tt.wantWait || empty != tt.wantEmpty {
+				t.Fatalf("got %v, %v, want %v, %v", wait, empty, tt.wantWait, tt.wantEmpty)
+			}
+		})
+	}
+}
+
+func TestExportPoolStats(t *testing.T) {
+	value := func(c prometheus.Collector) float64 {
+		m := &dto.Metric{}
+		c.(prometheus.Metric).Write(m)
+		if m.Gauge != nil {
+			return m.GetGauge().GetValue()
+		}
+		return m.GetCounter().GetValue()
+	}
+	empty := value(poolEmptyAcquiresMetric)
+	prev := poolStats{acquireCount: 10, acquireDuration: time.Second, emptyAcquireCount: 5}
+	cur := poolStats{acquired: 3, idle: 2, total: 5, max: 10, acquireCount: 20, acquireDuration: 3 * time.Second, emptyAcquireCount: 8}
+	if got := exportPoolStats(prev, cur, time.Second); got != cur {
+		t.Fatalf("want the current snapshot back, got %+v", got)
+	}
+	for state, want := range map[string]float64{"acquired": 3, "idle": 2, "total": 5, "max": 10} {
+		if got := value(poolConnectionsMetric.WithLabelValues(state)); got != want {
+			t.Errorf("pg_pool_connections{state=%v} = %v, want %v", state, got, want)
+		}
+	}
+	if got := value(poolAcquireWaitMetric); got != 0.2 {
+		t.Errorf("pg_pool_acquire_wait_seconds = %v, want 0.2", got)
+	}
+	if got := value(poolEmptyAcquiresMetric) - empty; got != 3 {
+		t.Errorf("pg_pool_empty_acquires grew by %v, want 3", got)
+	}
+}
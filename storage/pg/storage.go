@@ -4,11 +4,16 @@ import (
 	"context"
 	"embed"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -24,6 +29,25 @@ var expiredMessagesMetric = promauto.NewCounter(prometheus.CounterOpts{
 type Message []byte
 type Storage struct {
 	postgres *pgxpool.Pool
+	options  Options
+	instance string
+
+	cleanupLock sync.Mutex
+	lastCleanup time.Time
+	cleanupErr  error
+
+	hookLock  sync.Mutex
+	onExpired func(clientId string, count int)
+}
+
+type Options struct {
+	// QueryTimeout limits GetMessages queries, zero means no limit.
+	QueryTimeout time.Duration
+	// AcquireWaitAlarm logs a warning when acquiring a connection takes longer on average, zero disables it.
+	AcquireWaitAlarm time.Duration
+	// Password, if set, returns the password for new connections instead of the one in the uri,
+	// so a rotated password is picked up without a restart.
+	Password func() string
 }
 
 //go:embed migrations/*.sql
@@ -52,11 +76,64 @@ func MigrateDb(postgresURI string) error {
 	return nil
 }
 
-func NewStorage(postgresURI string) (*Storage, error) {
+// CheckMigrations returns an error unless the schema is at the latest embedded migration.
+func (s *Storage) CheckMigrations(ctx context.Context) error {
+	latest, err := latestMigration()
+	if err != nil {
+		return err
+	}
+	var version int64
+	var dirty bool
+	err = s.postgres.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("migration %v is dirty", version)
+	}
+	if version != latest {
+		return fmt.Errorf("schema version is %v, the latest migration is %v", version, latest)
+	}
+	return nil
+}
+
+// latestMigration returns the version of the newest embedded migration.
+func latestMigration() (int64, error) {
+	entries, err := fs.ReadDir("migrations")
+	if err != nil {
+		return 0, err
+	}
+	var latest int64
+	for _, e := range entries {
+		prefix, _, _ := strings.Cut(e.Name(), "_")
+		v, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("malformed migration name %v", e.Name())
+		}
+		if v > latest {
+			latest = v
+		}
+	}
+	return latest, nil
+}
+
+func NewStorage(postgresURI string, options Options) (*Storage, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	log := log.WithField("prefix", "NewStorage")
 	defer cancel()
-	c, err := pgxpool.Connect(ctx, postgresURI)
+	poolConfig, err := pgxpool.ParseConfig(postgresURI)
+	if err != nil {
+		return nil, err
+	}
+	if options.Password != nil {
+		poolConfig.BeforeConnect = func(ctx context.Context, cc *pgx.ConnConfig) error {
+			if p := options.Password(); p != "" {
+				cc.Password = p
+			}
+			return nil
+		}
+	}
+	c, err := pgxpool.ConnectConfig(ctx, poolConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -67,8 +144,11 @@ func NewStorage(postgresURI string) (*Storage, error) {
 	}
 	s := Storage{
 		postgres: c,
+		options:  options,
+		instance: newInstanceId(),
 	}
 	go s.worker()
+	go s.statsWorker(options.AcquireWaitAlarm)
 	return &s, nil
 }
 
@@ -77,16 +157,70 @@ func (s *Storage) worker() {
 	for {
 		<-time.NewTimer(time.Minute).C
 		log.Info("time to db check")
-		_, err := s.postgres.Exec(context.TODO(),
-			`DELETE FROM bridge.messages 
-			 	 WHERE current_timestamp > end_time`)
+		_, err := s.RemoveExpired(context.TODO())
 		if err != nil {
+			cleanupFailuresMetric.Inc()
 			log.Infof("remove expired messages error: %v", err)
 		}
+		s.cleanupLock.Lock()
+		s.cleanupErr = err
+		if err == nil {
+			s.lastCleanup = time.Now()
+		}
+		s.cleanupLock.Unlock()
+		s.exportOldestMessage(context.TODO())
 	}
 
 }
 
+// CleanupStatus returns the time of the last successful periodic sweep of expired messages
+// and the error of the last sweep if it failed.
+func (s *Storage) CleanupStatus() (time.Time, error) {
+	s.cleanupLock.Lock()
+	defer s.cleanupLock.Unlock()
+	return s.lastCleanup, s.cleanupErr
+}
+
+// RemoveExpired deletes expired messages and returns how many were removed.
+func (s *Storage) RemoveExpired(ctx context.Context) (int64, error) {
+	rows, err := s.postgres.Query(ctx, `
+		WITH expired AS (
+			DELETE FROM bridge.messages WHERE current_timestamp > end_time RETURNING client_id
+		)
+		SELECT client_id, count(*) FROM expired GROUP BY client_id`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	s.hookLock.Lock()
+	onExpired := s.onExpired
+	s.hookLock.Unlock()
+	var removed int64
+	for rows.Next() {
+		var clientId string
+		var count int
+		if err := rows.Scan(&clientId, &count); err != nil {
+			return removed, err
+		}
+		removed += int64(count)
+		if onExpired != nil {
+			onExpired(clientId, count)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return removed, err
+	}
+	expiredMessagesMetric.Add(float64(removed))
+	return removed, nil
+}
+
+// OnExpired sets f to be called with the number of expired messages of every client_id after they're removed.
+func (s *Storage) OnExpired(f func(clientId string, count int)) {
+	s.hookLock.Lock()
+	defer s.hookLock.Unlock()
+	s.onExpired = f
+}
+
 func (s *Storage) Add(ctx context.Context, key string, ttl int64, mes datatype.SseMessage) error {
 	_, err := s.postgres.Exec(ctx, `
 		INSERT INTO bridge.messages
@@ -104,10 +238,21 @@ func (s *Storage) Add(ctx context.Context, key string, ttl int64, mes datatype.S
 	return nil
 }
 
+// Remove deletes the message with eventId stored for key.
+func (s *Storage) Remove(ctx context.Context, key string, eventId int64) error {
+	_, err := s.postgres.Exec(ctx, `DELETE FROM bridge.messages WHERE client_id = $1 AND event_id = $2`, key, eventId)
+	return err
+}
+
 func (s *Storage) GetMessages(ctx context.Context, keys []string, lastEventId int64) ([]datatype.SseMessage, error) { // interface{}
 	log := log.WithField("prefix", "Storage.GetQueue")
+	if s.options.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.options.QueryTimeout)
+		defer cancel()
+	}
 	var messages []datatype.SseMessage
-	rows, err := s.postgres.Query(ctx, `SELECT event_id, bridge_message
+	rows, err := s.postgres.Query(ctx, `SELECT event_id, bridge_message, client_id
 	FROM bridge.messages
 	WHERE current_timestamp < end_time 
 	AND event_id > $1
@@ -118,7 +263,7 @@ func (s *Storage) GetMessages(ctx context.Context, keys []string, lastEventId in
 	}
 	for rows.Next() {
 		var mes datatype.SseMessage
-		err = rows.Scan(&mes.EventId, &mes.Message)
+		err = rows.Scan(&mes.EventId, &mes.Message, &mes.To)
 		if err != nil {
 			log.Info(err)
 			return nil, err
@@ -127,3 +272,52 @@ func (s *Storage) GetMessages(ctx context.Context, keys []string, lastEventId in
 	}
 	return messages, nil
 }
+
+// GetMessagesPage returns up to limit messages after lastEventId ordered by event id
+// and the event id to continue from, 0 after the last page.
+func (s *Storage) GetMessagesPage(ctx context.Context, keys []string, lastEventId int64, limit int) ([]datatype.SseMessage, int64, error) {
+	log := log.WithField("prefix", "Storage.GetMessagesPage")
+	if s.options.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.options.QueryTimeout)
+		defer cancel()
+	}
+	// one row more than the page tells whether there is a next one
+	rows, err := s.postgres.Query(ctx, `SELECT event_id, bridge_message, client_id
+	FROM bridge.messages
+	WHERE current_timestamp < end_time
+	AND event_id > $1
+	AND client_id = any($2)
+	ORDER BY event_id
+	LIMIT $3`, lastEventId, keys, limit+1)
+	if err != nil {
+		log.Info(err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var messages []datatype.SseMessage
+	for rows.Next() {
+		var mes datatype.SseMessage
+		if err := rows.Scan(&mes.EventId, &mes.Message, &mes.To); err != nil {
+			log.Info(err)
+			return nil, 0, err
+		}
+		messages = append(messages, mes)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(messages) <= limit {
+		return messages, 0, nil
+	}
+	return messages[:limit], messages[limit-1].EventId, nil
+}
+
+// URIPassword returns the password in a postgres uri or connection string.
+func URIPassword(postgresURI string) (string, error) {
+	c, err := pgx.ParseConfig(postgresURI)
+	if err != nil {
+		return "", err
+	}
+	return c.Password, nil
+}
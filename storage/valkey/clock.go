@@ -0,0 +1,59 @@
+package valkey
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clocksKey is a hash of "<offset>:<updated at>" in microseconds by instance,
+// a single key works with every topology.
+const clocksKey = keyPrefix + "clocks"
+
+// StorageTime returns the current time of the Valkey server.
+func (s *Storage) StorageTime(ctx context.Context) (time.Time, error) {
+	return s.client.Time(ctx).Result()
+}
+
+// ShareClock stores the clock offset of this instance in clocksKey
+// and returns the offsets of the instances that updated theirs within ttl.
+func (s *Storage) ShareClock(ctx context.Context, offset, ttl time.Duration) (map[string]time.Duration, error) {
+	now, err := s.StorageTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	value := fmt.Sprintf("%d:%d", offset.Microseconds(), now.UnixMicro())
+	if err := s.client.HSet(ctx, clocksKey, s.instance, value).Err(); err != nil {
+		return nil, err
+	}
+	s.client.Expire(ctx, clocksKey, ttl)
+	all, err := s.client.HGetAll(ctx, clocksKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	offsets := map[string]time.Duration{}
+	for instance, v := range all {
+		o, updated, err := parseClock(v)
+		if err != nil || updated < now.Add(-ttl).UnixMicro() {
+			s.client.HDel(ctx, clocksKey, instance)
+			continue
+		}
+		offsets[instance] = o
+	}
+	return offsets, nil
+}
+
+func parseClock(v string) (offset time.Duration, updated int64, err error) {
+	o, u, ok := strings.Cut(v, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed clock %q", v)
+	}
+	us, err := strconv.ParseInt(o, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	updated, err = strconv.ParseInt(u, 10, 64)
+	return time.Duration(us) * time.Microsecond, updated, err
+}
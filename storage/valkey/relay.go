@@ -0,0 +1,66 @@
+package valkey
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+// relayChannel passes live messages between bridge instances.
+const relayChannel = keyPrefix + "relay"
+
+type relayedMessage struct {
+	// Instance identifies the publishing storage, so it skips its own messages.
+	Instance string `json:"i"`
+	EventId  int64  `json:"id"`
+	To       string `json:"to"`
+	Message  []byte `json:"msg"`
+}
+
+func newInstanceId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Publish passes mes to the other instances with PUBLISH.
+func (s *Storage) Publish(ctx context.Context, mes datatype.SseMessage) error {
+	payload, err := json.Marshal(relayedMessage{Instance: s.instance, EventId: mes.EventId, To: mes.To, Message: mes.Message})
+	if err != nil {
+		return err
+	}
+	return s.client.Publish(ctx, relayChannel, payload).Err()
+}
+
+// Subscribe calls deliver for every message published by the other instances until ctx is done.
+// The subscription is restored by the client after connection failures.
+func (s *Storage) Subscribe(ctx context.Context, deliver func(datatype.SseMessage)) error {
+	log := log.WithField("prefix", "Storage.Subscribe")
+	pubsub := s.client.Subscribe(ctx, relayChannel)
+	defer pubsub.Close()
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-ch:
+			if !ok {
+				return errors.New("subscription closed")
+			}
+			var m relayedMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+				log.Errorf("malformed relayed message: %v", err)
+				continue
+			}
+			if m.Instance == s.instance {
+				continue
+			}
+			deliver(datatype.SseMessage{EventId: m.EventId, Message: m.Message, To: m.To})
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/tonkeeper/bridge/datatype"
+)
+
+var (
+	storageWriteFailuresMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_storage_write_failures",
+		Help: "The total number of messages that could not be stored, by STORAGE_DOWN_POLICY",
+	}, []string{"policy"})
+	storageWriteRetriesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "number_of_storage_write_retries",
+		Help: "The total number of storage write retries by outcome: retried, recovered, lost",
+	}, []string{"outcome"})
+)
+
+// Policies applied when a message can't be written to the storage.
+const (
+	// storagePolicyFailOpen stores messages in the background and answers 200 even if storing fails.
+	storagePolicyFailOpen = "fail_open"
+	// storagePolicyFailClosed stores messages before delivering them and answers 503 if storing fails.
+	storagePolicyFailClosed = "fail_closed"
+	// storagePolicyLiveOnly stores messages before answering, if storing fails the message is still
+	// delivered to connected receivers and the response carries "X-Bridge-Stored: false".
+	storagePolicyLiveOnly = "live_only"
+	// storagePolicyRetry stores messages in the background retrying failed writes with backoff.
+	storagePolicyRetry = "retry"
+)
+
+// storedHeader is set to "false" when a message was accepted but not stored.
+const storedHeader = "X-Bridge-Stored"
+
+var errStorageUnavailable = errors.New("storage is unavailable")
+
+const (
+	storageRetryAttempts = 5
+	storageRetryBackoff  = 100 * time.Millisecond
+)
+
+// persistWithRetry makes attempt to write sseMessage. A failed write is submitted to the storage pool again
+// after backoff, doubled every time, while the message is still alive before deadline.
+// The retry waits on a timer, so a storage outage doesn't tie up the workers of the pool.
+func (h *handler) persistWithRetry(to string, ttl int64, traceId string, sseMessage datatype.SseMessage, attempt int, backoff time.Duration, deadline time.Time) {
+	err := h.persist(context.Background(), to, ttl, traceId, sseMessage)
+	if err == nil {
+		if attempt > 1 {
+			storageWriteRetriesMetric.WithLabelValues("recovered").Inc()
+		}
+		return
+	}
+	if attempt == storageRetryAttempts || time.Now().Add(backoff).After(deadline) {
+		storageWriteFailuresMetric.WithLabelValues(storagePolicyRetry).Inc()
+		storageWriteRetriesMetric.WithLabelValues("lost").Inc()
+		log.WithField("prefix", "persistWithRetry").Errorf("message %v to %v lost after %v attempts: %v", sseMessage.EventId, logId(to), attempt, err)
+		return
+	}
+	storageWriteRetriesMetric.WithLabelValues("retried").Inc()
+	time.AfterFunc(backoff, func() {
+		h.storagePool.Submit(func() {
+			h.persistWithRetry(to, ttl, traceId, sseMessage, attempt+1, backoff*2, deadline)
+		})
+	})
+}
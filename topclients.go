@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Kinds of per client_id counts kept by topClients.
+const (
+	clientCountSent      = "sent"
+	clientCountDelivered = "delivered"
+	clientCountExpired   = "expired"
+)
+
+const (
+	// topClientsBucket is the granularity of the topClients window.
+	topClientsBucket = time.Minute
+	// topClientsBucketSize bounds the number of client ids counted in a bucket, later ones are dropped.
+	topClientsBucketSize = 100000
+)
+
+// expiredObserver is implemented by storages that report expired messages by client_id.
+type expiredObserver interface {
+	OnExpired(func(clientId string, count int))
+}
+
+type clientCounts struct {
+	ClientId  string `json:"client_id"`
+	Sent      int64  `json:"sent"`
+	Delivered int64  `json:"delivered"`
+	Expired   int64  `json:"expired"`
+}
+
+func (c *clientCounts) add(kind string, n int64) {
+	switch kind {
+	case clientCountSent:
+		c.Sent += n
+	case clientCountDelivered:
+		c.Delivered += n
+	case clientCountExpired:
+		c.Expired += n
+	}
+}
+
+func (c *clientCounts) get(kind string) int64 {
+	switch kind {
+	case clientCountSent:
+		return c.Sent
+	case clientCountDelivered:
+		return c.Delivered
+	default:
+		return c.Expired
+	}
+}
+
+type countsBucket struct {
+	start  time.Time
+	counts map[string]*clientCounts
+}
+
+// topClients counts sent, delivered and expired messages by client_id over a rolling window,
+// so heavy hitters can be found without a metric label per client_id.
+// A nil *topClients is valid and counts nothing.
+type topClients struct {
+	mu      sync.Mutex
+	window  time.Duration
+	buckets []*countsBucket
+}
+
+func newTopClients(window time.Duration) *topClients {
+	if window <= 0 {
+		return nil
+	}
+	return &topClients{window: window}
+}
+
+// Add counts n messages of kind for clientId.
+func (t *topClients) Add(clientId, kind string, n int64, now time.Time) {
+	if t == nil || clientId == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.trim(now)
+	start := now.Truncate(topClientsBucket)
+	if len(t.buckets) == 0 || t.buckets[len(t.buckets)-1].start.Before(start) {
+		t.buckets = append(t.buckets, &countsBucket{start: start, counts: map[string]*clientCounts{}})
+	}
+	b := t.buckets[len(t.buckets)-1]
+	c, ok := b.counts[clientId]
+	if !ok {
+		if len(b.counts) >= topClientsBucketSize {
+			return
+		}
+		c = &clientCounts{ClientId: clientId}
+		b.counts[clientId] = c
+	}
+	c.add(kind, n)
+}
+
+// Top returns up to n client ids with the most messages of kind within the window.
+func (t *topClients) Top(kind string, n int, now time.Time) []clientCounts {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	totals := map[string]*clientCounts{}
+	t.trim(now)
+	for _, b := range t.buckets {
+		for id, c := range b.counts {
+			total, ok := totals[id]
+			if !ok {
+				total = &clientCounts{ClientId: id}
+				totals[id] = total
+			}
+			total.Sent += c.Sent
+			total.Delivered += c.Delivered
+			total.Expired += c.Expired
+		}
+	}
+	t.mu.Unlock()
+
+	top := make([]clientCounts, 0, len(totals))
+	for _, c := range totals {
+		if c.get(kind) > 0 {
+			top = append(top, *c)
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].get(kind) != top[j].get(kind) {
+			return top[i].get(kind) > top[j].get(kind)
+		}
+		return top[i].ClientId < top[j].ClientId
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// trim drops buckets that left the window.
+func (t *topClients) trim(now time.Time) {
+	since := now.Add(-t.window)
+	i := 0
+	for i < len(t.buckets) && !t.buckets[i].start.Add(topClientsBucket).After(since) {
+		i++
+	}
+	t.buckets = t.buckets[i:]
+}
+
+type topClientsRes struct {
+	WindowSeconds float64        `json:"window_seconds"`
+	By            string         `json:"by"`
+	Clients       []clientCounts `json:"clients"`
+}
+
+// TopClientsHandler returns the client ids with the most sent, delivered or expired messages within the window.
+func (h *handler) TopClientsHandler(c echo.Context) error {
+	if h.topClients == nil {
+		return c.JSON(HttpResError("top clients are disabled", http.StatusNotFound))
+	}
+	by := c.QueryParam("by")
+	switch by {
+	case "":
+		by = clientCountSent
+	case clientCountSent, clientCountDelivered, clientCountExpired:
+	default:
+		return c.JSON(HttpResError("param \"by\" should be one of sent, delivered, expired", http.StatusBadRequest))
+	}
+	n := 10
+	if v := c.QueryParam("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+			return c.JSON(HttpResError("param \"n\" should be a positive int", http.StatusBadRequest))
+		}
+	}
+	return c.JSON(http.StatusOK, topClientsRes{
+		WindowSeconds: h.topClients.window.Seconds(),
+		By:            by,
+		Clients:       h.topClients.Top(by, n, time.Now()),
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tonkeeper/bridge/datatype"
+	"github.com/tonkeeper/bridge/storage/memory"
+)
+
+func TestTopClients(t *testing.T) {
+	top := newTopClients(time.Hour)
+	now := time.Now()
+	top.Add("old", clientCountSent, 100, now.Add(-2*time.Hour))
+	top.Add("dapp", clientCountSent, 3, now.Add(-30*time.Minute))
+	top.Add("dapp", clientCountSent, 2, now)
+	top.Add("wallet", clientCountSent, 4, now)
+	top.Add("wallet", clientCountDelivered, 5, now)
+	top.Add("idle", clientCountExpired, 1, now)
+
+	want := []clientCounts{
+		{ClientId: "dapp", Sent: 5},
+		{ClientId: "wallet", Sent: 4, Delivered: 5},
+	}
+	if got := top.Top(clientCountSent, 10, now); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+	if got := top.Top(clientCountSent, 1, now); len(got) != 1 || got[0].ClientId != "dapp" {
+		t.Fatalf("want only dapp, got %+v", got)
+	}
+	if got := top.Top(clientCountExpired, 10, now); len(got) != 1 || got[0].ClientId != "idle" {
+		t.Fatalf("want only idle, got %+v", got)
+	}
+	if got := top.Top(clientCountSent, 10, now.Add(time.Hour+topClientsBucket)); len(got) != 0 {
+		t.Fatalf("counts outside the window: %+v", got)
+	}
+}
+
+func TestTopClients_Expired(t *testing.T) {
+	storage := memory.NewStorage()
+	h := newHandler(storage, time.Minute)
+	defer h.Close()
+	msg := datatype.SseMessage{EventId: 1, Message: []byte("expiring")}
+	if err := storage.Add(context.Background(), "wallet", 0, msg); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := storage.RemoveExpired(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.topClients.Top(clientCountExpired, 10, time.Now()); len(got) != 1 || got[0].Expired != 1 {
+		t.Fatalf("want one expired message for wallet, got %+v", got)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	traceStageReceived     = "received"
+	traceStageStored       = "stored"
+	traceStageStoreFailed  = "store_failed"
+	traceStageDelivered    = "delivered"
+	traceStageUndelivered  = "undelivered"
+	traceStageAcknowledged = "acknowledged"
+	traceStageReported     = "reported"
+)
+
+type traceEvent struct {
+	Time     time.Time `json:"time"`
+	TraceId  string    `json:"trace_id,omitempty"`
+	EventId  int64     `json:"event_id"`
+	Stage    string    `json:"stage"`
+	ClientId string    `json:"client_id,omitempty"`
+	Details  string    `json:"details,omitempty"`
+}
+
+// traceRing keeps the most recent trace events in a fixed-size ring buffer.
+// A nil *traceRing is valid and records nothing.
+type traceRing struct {
+	mu     sync.Mutex
+	events []traceEvent
+	next   int
+}
+
+func newTraceRing(size int) *traceRing {
+	if size <= 0 {
+		return nil
+	}
+	return &traceRing{events: make([]traceEvent, 0, size)}
+}
+
+func (r *traceRing) Record(e traceEvent) {
+	if r == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) < cap(r.events) {
+		r.events = append(r.events, e)
+		return
+	}
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+}
+
+// Find returns, oldest first, all events with the given trace id or belonging to the event ids it was assigned.
+func (r *traceRing) Find(traceId string, eventId int64) []traceEvent {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ordered := append(append([]traceEvent{}, r.events[r.next:]...), r.events[:r.next]...)
+
+	eventIds := map[int64]struct{}{}
+	if eventId != 0 {
+		eventIds[eventId] = struct{}{}
+	}
+	if traceId != "" {
+		for _, e := range ordered {
+			if e.TraceId == traceId {
+				eventIds[e.EventId] = struct{}{}
+			}
+		}
+	}
+	var results []traceEvent
+	for _, e := range ordered {
+		if _, ok := eventIds[e.EventId]; ok {
+			results = append(results, e)
+		}
+	}
+	return results
+}
+
+func newTraceId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
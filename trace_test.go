@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTraceRing_Find(t *testing.T) {
+	r := newTraceRing(3)
+	r.Record(traceEvent{TraceId: "a", EventId: 1, Stage: traceStageReceived})
+	r.Record(traceEvent{TraceId: "b", EventId: 2, Stage: traceStageReceived})
+	r.Record(traceEvent{EventId: 1, Stage: traceStageDelivered})
+	r.Record(traceEvent{TraceId: "a", EventId: 1, Stage: traceStageStored})
+
+	var stages []string
+	for _, e := range r.Find("a", 0) {
+		stages = append(stages, e.Stage)
+	}
+	if want := []string{traceStageDelivered, traceStageStored}; !reflect.DeepEqual(stages, want) {
+		t.Fatalf("got stages %v, want %v", stages, want)
+	}
+	if got := r.Find("", 2); len(got) != 1 || got[0].TraceId != "b" {
+		t.Fatalf("bad lookup by event id: %v", got)
+	}
+
+	var disabled *traceRing
+	disabled.Record(traceEvent{EventId: 1})
+	if got := disabled.Find("", 1); got != nil {
+		t.Fatalf("disabled ring must be empty, got %v", got)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	uniqueTransferedMessagesNumMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_unique_transfered_messages",
+		Help: "The total number of transfered_messages not seen before within MAX_TTL",
+	})
+	duplicateTransferedMessagesNumMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "number_of_duplicate_transfered_messages",
+		Help: "The total number of transfered_messages repeating a recent message from the same sender to the same receiver",
+	})
+)
+
+type transferedEntry struct {
+	hash     [sha256.Size]byte
+	expireAt time.Time
+}
+
+// transferedCache is an LRU of hashes of recently sent messages, so retries of the same message
+// can be told apart from new ones in the transfered messages statistics.
+// It holds at most size hashes, a message evicted before its window ends is counted as unique again.
+type transferedCache struct {
+	mu     sync.Mutex
+	window time.Duration
+	size   int
+	ll     *list.List
+	items  map[[sha256.Size]byte]*list.Element
+}
+
+func newTransferedCache(window time.Duration, size int) *transferedCache {
+	return &transferedCache{
+		window: window,
+		size:   size,
+		ll:     list.New(),
+		items:  make(map[[sha256.Size]byte]*list.Element, size),
+	}
+}
+
+func (c *transferedCache) watcher(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Minute):
+		}
+		c.removeExpired(time.Now())
+	}
+}
+
+func (c *transferedCache) removeExpired(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for hash, e := range c.items {
+		if e.Value.(*transferedEntry).expireAt.Before(now) {
+			c.ll.Remove(e)
+			delete(c.items, hash)
+		}
+	}
+}
+
+// MarkIfNotExists remembers the message and reports whether it wasn't seen within the window.
+func (c *transferedCache) MarkIfNotExists(from, to string, message []byte, now time.Time) bool {
+	h := sha256.New()
+	h.Write([]byte(from))
+	h.Write([]byte{0})
+	h.Write([]byte(to))
+	h.Write([]byte{0})
+	h.Write(message)
+	var hash [sha256.Size]byte
+	copy(hash[:], h.Sum(nil))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[hash]; ok {
+		c.ll.MoveToFront(e)
+		entry := e.Value.(*transferedEntry)
+		if !entry.expireAt.Before(now) {
+			return false
+		}
+		entry.expireAt = now.Add(c.window)
+		return true
+	}
+	c.items[hash] = c.ll.PushFront(&transferedEntry{hash: hash, expireAt: now.Add(c.window)})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*transferedEntry).hash)
+	}
+	return true
+}
+
+// Count updates the unique and duplicate transfered messages metrics for a sent message.
+func (c *transferedCache) Count(from, to string, message []byte, now time.Time) {
+	if c == nil {
+		return
+	}
+	if c.MarkIfNotExists(from, to, message, now) {
+		uniqueTransferedMessagesNumMetric.Inc()
+		return
+	}
+	duplicateTransferedMessagesNumMetric.Inc()
+}
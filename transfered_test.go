@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransferedCache(t *testing.T) {
+	c := newTransferedCache(time.Minute, 10)
+	now := time.Now()
+	unique, duplicate := counterValue(uniqueTransferedMessagesNumMetric), counterValue(duplicateTransferedMessagesNumMetric)
+
+	c.Count("a", "b", []byte("hello"), now)
+	c.Count("a", "b", []byte("hello"), now.Add(time.Second))
+	c.Count("a", "c", []byte("hello"), now)
+	c.Count("ab", "", []byte("hello"), now)
+	c.Count("a", "b", []byte("other"), now)
+	if got := counterValue(uniqueTransferedMessagesNumMetric) - unique; got != 4 {
+		t.Fatalf("unique = %v, want 4", got)
+	}
+	if got := counterValue(duplicateTransferedMessagesNumMetric) - duplicate; got != 1 {
+		t.Fatalf("duplicate = %v, want 1", got)
+	}
+
+	if !c.MarkIfNotExists("a", "b", []byte("hello"), now.Add(2*time.Minute)) {
+		t.Fatal("message is a duplicate after the window")
+	}
+	c.removeExpired(now.Add(5 * time.Minute))
+	if len(c.items) != 0 || c.ll.Len() != 0 {
+		t.Fatalf("expired hashes are kept: %v", len(c.items))
+	}
+}
+
+func TestTransferedCache_Size(t *testing.T) {
+	c := newTransferedCache(time.Minute, 2)
+	now := time.Now()
+	c.MarkIfNotExists("a", "b", []byte("first"), now)
+	c.MarkIfNotExists("a", "b", []byte("second"), now)
+	// seeing first again makes second the least recently used
+	if c.MarkIfNotExists("a", "b", []byte("first"), now) {
+		t.Fatal("first is unique again before the cache is full")
+	}
+	c.MarkIfNotExists("a", "b", []byte("third"), now)
+	if len(c.items) != 2 || c.ll.Len() != 2 {
+		t.Fatalf("cache holds %v hashes, want 2", len(c.items))
+	}
+	if c.MarkIfNotExists("a", "b", []byte("first"), now) {
+		t.Fatal("recently used hash is evicted")
+	}
+	if !c.MarkIfNotExists("a", "b", []byte("second"), now) {
+		t.Fatal("least recently used hash is kept")
+	}
+}
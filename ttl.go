@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+
+	"github.com/tonkeeper/bridge/config"
+)
+
+var errTTLTooHigh = errors.New("param \"ttl\" too high")
+
+// topicMaxTTL returns the longest ttl in seconds allowed for messages of topic:
+// its TOPIC_MAX_TTL override or MAX_TTL.
+func topicMaxTTL(topic string) int64 {
+	if ttl, ok := config.Config.TopicTTLs[topic]; ok {
+		return int64(ttl)
+	}
+	return int64(config.Config.MaxTTL)
+}
+
+// longestTTL returns the longest ttl in seconds any message may have, overrides included.
+func longestTTL() int64 {
+	longest := int64(config.Config.MaxTTL)
+	if int64(config.Config.DisconnectTTL) > longest {
+		longest = int64(config.Config.DisconnectTTL)
+	}
+	for _, ttl := range config.Config.TopicTTLs {
+		if int64(ttl) > longest {
+			longest = int64(ttl)
+		}
+	}
+	return longest + maxTTLJitter(longest)
+}
+
+// checkTTL validates the ttl of a message of topic against its maximum.
+// A ttl over the maximum is lowered to it with TTL_CLAMP, otherwise it is errTTLTooHigh.
+func checkTTL(ttl int64, topic string) (int64, error) {
+	max := topicMaxTTL(topic)
+	if ttl <= max {
+		return ttl, nil
+	}
+	if !config.Config.TTLClamp {
+		return 0, errTTLTooHigh
+	}
+	ttlClampedMetric.Inc()
+	return max, nil
+}
+
+// disconnectTopic is the topic of the event a dapp or a wallet sends when the user ends the session.
+const disconnectTopic = "disconnect"
+
+// disconnectTTL raises the ttl of a disconnect event to DISCONNECT_TTL, the other side may stay offline
+// much longer than a request lives and would keep a dead session otherwise. Only events up to
+// DISCONNECT_MAX_SIZE bytes are kept that long, so the topic can't be used to store large messages.
+func disconnectTTL(ttl int64, topic string, size int) int64 {
+	if topic != disconnectTopic || size > config.Config.DisconnectMaxSize || int64(config.Config.DisconnectTTL) <= ttl {
+		return ttl
+	}
+	disconnectTTLsMetric.Inc()
+	return int64(config.Config.DisconnectTTL)
+}
+
+// maxTTLJitter returns the most jitterTTL may add to ttl: TTL_JITTER_PERCENT of it.
+func maxTTLJitter(ttl int64) int64 {
+	return ttl * int64(config.Config.TTLJitterPercent) / 100
+}
+
+// jitterTTL adds a random delay of up to TTL_JITTER_PERCENT to the ttl a message is stored with,
+// so a burst of messages with the same ttl doesn't expire at once and spike the cleanup of the storage.
+// The ttl is never shortened.
+func jitterTTL(ttl int64) int64 {
+	max := maxTTLJitter(ttl)
+	if max <= 0 {
+		return ttl
+	}
+	return ttl + rand.Int63n(max+1)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tonkeeper/bridge/config"
+)
+
+func TestCheckTTL(t *testing.T) {
+	defer func(max int, topics map[string]int, clamp bool) {
+		config.Config.MaxTTL, config.Config.TopicTTLs, config.Config.TTLClamp = max, topics, clamp
+	}(config.Config.MaxTTL, config.Config.TopicTTLs, config.Config.TTLClamp)
+	config.Config.MaxTTL = 300
+	config.Config.TopicTTLs = map[string]int{"connect": 600}
+
+	tests := []struct {
+		name  string
+		ttl   int64
+		topic string
+		clamp bool
+		want  int64
+		err   error
+	}{
+		{name: "within max", ttl: 300, want: 300},
+		{name: "over max", ttl: 301, err: errTTLTooHigh},
+		{name: "over max clamped", ttl: 301, clamp: true, want: 300},
+		{name: "topic override", ttl: 600, topic: "connect", want: 600},
+		{name: "over topic override clamped", ttl: 601, topic: "connect", clamp: true, want: 600},
+		{name: "topic without override", ttl: 600, topic: "sendTransaction", err: errTTLTooHigh},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.TTLClamp = tt.clamp
+			got, err := checkTTL(tt.ttl, tt.topic)
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Fatalf("want %v, %v, got %v, %v", tt.want, tt.err, got, err)
+			}
+		})
+	}
+	if got := longestTTL(); got != 600 {
+		t.Fatalf("want the longest ttl 600, got %v", got)
+	}
+}
+
+func TestDisconnectTTL(t *testing.T) {
+	defer func(ttl, size int) {
+		config.Config.DisconnectTTL, config.Config.DisconnectMaxSize = ttl, size
+	}(config.Config.DisconnectTTL, config.Config.DisconnectMaxSize)
+	config.Config.DisconnectTTL = 86400
+	config.Config.DisconnectMaxSize = 512
+
+	tests := []struct {
+		name  string
+		ttl   int64
+		topic string
+		size  int
+		want  int64
+	}{
+		{name: "disconnect", ttl: 300, topic: "disconnect", size: 100, want: 86400},
+		{name: "large disconnect", ttl: 300, topic: "disconnect", size: 513, want: 300},
+		{name: "other topic", ttl: 300, topic: "sendTransaction", size: 100, want: 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := disconnectTTL(tt.ttl, tt.topic, tt.size); got != tt.want {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+	if got := longestTTL(); got != 86400 {
+		t.Fatalf("want the longest ttl 86400, got %v", got)
+	}
+	config.Config.DisconnectTTL = 0
+	if got := disconnectTTL(300, "disconnect", 100); got != 300 {
+		t.Fatalf("want the ttl unchanged when DISCONNECT_TTL is 0, got %v", got)
+	}
+}
+
+func TestJitterTTL(t *testing.T) {
+	defer func(percent, max int, topics map[string]int) {
+		config.Config.TTLJitterPercent, config.Config.MaxTTL, config.Config.TopicTTLs = percent, max, topics
+	}(config.Config.TTLJitterPercent, config.Config.MaxTTL, config.Config.TopicTTLs)
+	config.Config.MaxTTL = 300
+	config.Config.TopicTTLs = map[string]int{}
+
+	config.Config.TTLJitterPercent = 0
+	if got := jitterTTL(300); got != 300 {
+		t.Fatalf("want the ttl unchanged without jitter, got %v", got)
+	}
+	config.Config.TTLJitterPercent = 10
+	seen := map[int64]bool{}
+	for i := 0; i < 1000; i++ {
+		got := jitterTTL(300)
+		if got < 300 || got > 330 {
+			t.Fatalf("jittered ttl %v is out of [300, 330]", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("want spread ttls, got %v", seen)
+	}
+	if got := longestTTL(); got != 330 {
+		t.Fatalf("want the longest ttl to include the jitter, got %v", got)
+	}
+}
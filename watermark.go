@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	maxDeliveryLagMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "max_client_delivery_lag",
+		Help: "The largest difference between the newest stored and the newest delivered event id among connected clients",
+	})
+	laggingClientsMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "number_of_lagging_clients",
+		Help: "The number of connected clients whose newest stored event was not delivered yet",
+	})
+)
+
+// watermarkTracker remembers the newest stored and the newest delivered event id per client_id.
+// The watermarks are kept in memory, so an instance only knows about the messages it stored since it started.
+type watermarkTracker struct {
+	mu      sync.Mutex
+	clients map[string]*watermark
+}
+
+type watermark struct {
+	Stored    int64     `json:"stored"`
+	Delivered int64     `json:"delivered"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newWatermarkTracker() *watermarkTracker {
+	return &watermarkTracker{clients: map[string]*watermark{}}
+}
+
+func (t *watermarkTracker) get(clientId string) *watermark {
+	w, ok := t.clients[clientId]
+	if !ok {
+		w = &watermark{}
+		t.clients[clientId] = w
+	}
+	return w
+}
+
+// Stored is called once a message is written to the storage.
+func (t *watermarkTracker) Stored(clientId string, eventId int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w := t.get(clientId)
+	if eventId > w.Stored {
+		w.Stored = eventId
+	}
+	w.UpdatedAt = time.Now()
+}
+
+func (t *watermarkTracker) Delivered(clientId string, eventId int64) {
+	if clientId == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w := t.get(clientId)
+	if eventId > w.Delivered {
+		w.Delivered = eventId
+	}
+	w.UpdatedAt = time.Now()
+}
+
+// NewestStored returns the newest stored event id among clientIds.
+func (t *watermarkTracker) NewestStored(clientIds []string) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var newest int64
+	for _, id := range clientIds {
+		if w, ok := t.clients[id]; ok && w.Stored > newest {
+			newest = w.Stored
+		}
+	}
+	return newest
+}
+
+// Lag returns the largest lag and the number of lagging clients among the given connected client ids
+// and forgets clients that were not updated since expireBefore.
+func (t *watermarkTracker) Lag(connected func(clientId string) bool, expireBefore time.Time) (maxLag int64, lagging int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, w := range t.clients {
+		if w.UpdatedAt.Before(expireBefore) {
+			delete(t.clients, id)
+			continue
+		}
+		if !connected(id) || w.Stored <= w.Delivered {
+			continue
+		}
+		lagging++
+		if lag := w.Stored - w.Delivered; lag > maxLag {
+			maxLag = lag
+		}
+	}
+	return maxLag, lagging
+}